@@ -12,6 +12,7 @@ const (
 	//APIVision api版本号
 	APIVision   = "1.0" //鸟币API版本号
 	MaxSkillNum = 200   //每个用户最多可以上架多少個技能
+	MaxUploads  = 9     //每个用户最多同时有多少个未完成的断点续传上传
 	//pg debug db
 	PQIrisIDKey = "iris_pq"
 	PQHost      = "localhost"
@@ -34,12 +35,24 @@ const (
 	//translocks
 	TxLocksIrisKey = "iris_tx_locks"
 	//beanstalk tube为不同延迟队列的分组
-	BeanstalkURI     = "localhost:11300"
-	BeanstalkTubeReq = "req"
+	BeanstalkURI        = "localhost:11300"
+	BeanstalkTubeReq    = "req"
+	BeanstalkTubeRemind = "remind"
+	//ImgJobKind 图片处理任务的类型
+	ImgJobPic    = "pic"    //上传单张图片
+	ImgJobSkill  = "skill"  //新建技能时上传的图片，完成后更新技能的图片
+	ImgJobQRC    = "qrc"    //鸟币号二维码
+	ImgJobAvatar = "avatar" //默认头像
+	//StorageBackend 图片存储后端
+	StorageLocal = "local"
+	StorageS3    = "s3"
 	//NewsTableName
-	NewsTableReq   = "req"
-	NewsTablePay   = "pay"
-	NewsTableRePay = "repay"
+	NewsTableReq     = "req"
+	NewsTablePay     = "pay"
+	NewsTableRePay   = "repay"
+	NewsTableInvoice = "invoice"
+	NewsTableVoucher = "voucher"
+	NewsTableGift    = "gift"
 )
 
 //PQInfo pq连接字符串
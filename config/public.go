@@ -3,7 +3,6 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 
 	"github.com/kezhuw/toml"
 )
@@ -20,8 +19,19 @@ type (
 		}
 
 		Dir struct {
-			RootDir string
-			DataDir string
+			RootDir  string
+			DataDir  string
+			CacheDir string //按需生成的图片缓存目录
+		}
+
+		Storage struct {
+			Backend     string //图片存储后端：local、s3
+			S3Endpoint  string
+			S3Region    string
+			S3Bucket    string
+			S3AccessKey string
+			S3SecretKey string
+			S3PathStyle bool
 		}
 
 		// ExchangeRate
@@ -32,13 +42,20 @@ type (
 		}
 
 		Name struct {
-			SysName []string //系统保留关键字
+			SysName   []string //系统保留关键字
+			AdminName []string //管理员鸟币号
+		}
+
+		Loc struct {
+			MinPrivacy uint32 //最小隐私半径（米）
 		}
 
 		Pic struct {
 			MaxUploadPic          int64
 			MaxUploadPics         int64
 			QualityOfPic          int
+			InputFormats          []string //允许上传的图片格式
+			ExtraFormats          []string //缩略图除jpg外另外生成的格式
 			PicNameSuffixOriginal string
 			PicNameSuffixDefault  string
 			PicNameSuffixBiggest  string
@@ -65,6 +82,19 @@ type (
 			SkillPicLongBigThum   uint
 			SkillPicLongThum      uint
 			SkillPicScaleMax      float64
+			UserQuota             int64    //每个用户的图片存储空间（字节），0表示不限制
+			GCGraceHours          int      //未被引用的图片超过此小时数后回收
+			GCEveryHours          int      //图片回收的间隔小时数
+			JobWorkers            int      //图片处理任务的worker数量
+			JobMaxTries           uint32   //图片处理任务的最大执行次数
+			JobRetrySeconds       int      //图片处理任务重试的延时秒数，乘以已执行的次数
+			ServeMaxAge           int      //图片访问的浏览器缓存秒数
+			VariantWidths         []uint   //允许按需生成的图片宽度
+			VariantFormats        []string //允许按需生成的图片格式
+			SignedOnly            bool     //是否所有图片都必须使用签名链接访问
+			SignMinutes           int      //签名链接的有效分钟数
+			PHashDistance         int      //近似图片的感知哈希最大汉明距离，-1表示不合并近似图片
+			UploadExpireHours     int      //断点续传的上传过期小时数
 		}
 
 		Req struct {
@@ -84,6 +114,37 @@ type (
 			I30 string
 			B31 string
 			I31 string
+			B32 string
+			I32 string
+
+			B20Remind   string
+			I20Remind   string
+			B20Escalate string
+			I20Escalate string
+			B20Auto     string
+			I20Auto     string
+		}
+
+		Remind struct {
+			RemindDays   int    //兑现中超过N天，提醒双方
+			EscalateDays int    //兑现中超过M天，再次提醒双方
+			AutoDays     int    //兑现中超过此天数，自动修改状态，0表示不自动处理
+			AutoState    uint8  //自动处理后的状态：23或30
+			RedoDays     int    //两次重做的间隔天数
+			MaxRedo      uint32 //最多可重做的次数，0表示不限制
+		}
+
+		Sign struct {
+			Required       bool  //是否所有用户都须登记公钥并签名交易
+			MaxSkewSeconds int64 //签名时间与服务器时间最多相差的秒数
+		}
+
+		Ledger struct {
+			CheckpointMinutes int //每隔多少分钟生成一个账本检查点
+		}
+
+		Gift struct {
+			ClaimsPerHour int64 //每个用户每小时最多领取多少个兑换码
 		}
 
 		Err struct {
@@ -133,6 +194,55 @@ type (
 			E1043 string
 			E1044 string
 			E1045 string
+			E1046 string
+			E1047 string
+			E1048 string
+			E1049 string
+			E1050 string
+			E1051 string
+			E1052 string
+			E1053 string
+			E1054 string
+			E1055 string
+			E1056 string
+			E1057 string
+			E1058 string
+			E1059 string
+			E1060 string
+			E1061 string
+			E1062 string
+			E1063 string
+			E1064 string
+			E1065 string
+			E1066 string
+			E1067 string
+			E1068 string
+			E1069 string
+			E1070 string
+			E1071 string
+			E1072 string
+			E1073 string
+			E1074 string
+			E1075 string
+			E1076 string
+			E1077 string
+			E1078 string
+			E1079 string
+			E1080 string
+			E1081 string
+			E1082 string
+			E1083 string
+			E1084 string
+			E1085 string
+			E1086 string
+			E1087 string
+			E1088 string
+			E1089 string
+			E1090 string
+			E1091 string
+			E1092 string
+			E1093 string
+			E1094 string
 		}
 
 		Tips struct {
@@ -145,6 +255,14 @@ type (
 			T1006 string
 			T1007 string
 			T1008 string
+			T1009 string
+			T1010 string
+			T1011 string
+			T1012 string
+			T1013 string
+			T1014 string
+			T1015 string
+			T1016 string
 		}
 	}
 )
@@ -166,13 +284,18 @@ func Load() {
 
 	Public.Exr.RmbExr = Public.Exr.RmbM2Now / Public.Exr.RmbM2Init
 
+	//自动处理后的状态只能是23（未兑现）或30（交易完成），AutoDays为0时不自动处理，不检查
+	if Public.Remind.AutoDays > 0 && Public.Remind.AutoState != 23 && Public.Remind.AutoState != 30 {
+		panic(fmt.Sprintf("config: remind.AutoState must be 23 or 30, got %d", Public.Remind.AutoState))
+	}
+	//图片回收的宽限期和间隔为0时会删除刚上传的图片或不停地执行
+	if Public.Pic.GCGraceHours <= 0 || Public.Pic.GCEveryHours <= 0 {
+		panic(fmt.Sprintf("config: pic.GCGraceHours and pic.GCEveryHours must be positive, got %d and %d", Public.Pic.GCGraceHours, Public.Pic.GCEveryHours))
+	}
+
 	if Public.Debug {
 		fmt.Println("======config======")
 		fmt.Printf("%+v\n", Public)
 		fmt.Println("======config end======")
 	}
-
-	//建立文件夹
-	os.MkdirAll(Public.Dir.DataDir, os.ModePerm)
-	os.Chmod(Public.Dir.DataDir, os.ModePerm)
 }
@@ -0,0 +1,218 @@
+package controller
+
+import (
+	"encoding/json"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"github.com/thinkeridea/go-extend/exbytes"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+)
+
+//NewBundle 新建套餐
+func NewBundle(ctx context.Context, form model.NewBundleForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	lock := GetTxLocks(ctx)
+
+	//转账和套餐不能同时处理
+	if lock.Locks[coinName] == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1019)
+	}
+	lock.Locks[coinName] = true
+	defer func() {
+		delete(lock.Locks, coinName)
+	}()
+
+	//同一用户不能插入相同标题的套餐
+	has, err := pq.Exist(&db.Bundle{Owner: coinName, Title: form.Title})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1057)
+	}
+
+	//检查技能和价格
+	ok, err := checkBundle(pq, coinName, form.SkillIDs, form.Price)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1055)
+	}
+
+	bundle := db.Bundle{Owner: coinName, Title: form.Title, Price: form.Price, Desc: form.Desc, SkillIDs: form.SkillIDs, IsOpen: true}
+	affected, err := pq.UseBool().Insert(&bundle)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1004)
+	}
+
+	ctx.JSON(&bundle)
+}
+
+//UpdateBundle 更新套餐，更新后发币时生成新的套餐快照
+func UpdateBundle(ctx context.Context, form model.UpdateBundleForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	lock := GetTxLocks(ctx)
+
+	//转账和套餐不能同时处理
+	if lock.Locks[coinName] == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1019)
+	}
+	lock.Locks[coinName] = true
+	defer func() {
+		delete(lock.Locks, coinName)
+	}()
+
+	//检查是否是本人账号更新
+	bundle := db.Bundle{ID: form.BundleID, Owner: coinName}
+	has, err := pq.Cols("version").Get(&bundle)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1054)
+	}
+
+	//检查技能和价格
+	ok, err := checkBundle(pq, coinName, form.SkillIDs, form.Price)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1055)
+	}
+
+	bundle = db.Bundle{Price: form.Price, Desc: form.Desc, SkillIDs: form.SkillIDs, Version: bundle.Version}
+	affected, err := pq.ID(form.BundleID).MustCols("desc").Update(&bundle)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1054)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//OpenBundle 上架下架套餐
+func OpenBundle(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	lock := GetTxLocks(ctx)
+	id := ctx.Params().GetUint64Default("id", 0)
+	open, err := ctx.Params().GetBool("open")
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1000, nil)
+
+	//转账和套餐不能同时处理
+	if lock.Locks[coinName] == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1019)
+	}
+	lock.Locks[coinName] = true
+	defer func() {
+		delete(lock.Locks, coinName)
+	}()
+
+	//检查是否是本人账号操作
+	bundle := db.Bundle{ID: id, Owner: coinName}
+	has, err := pq.Cols("version", "price", "skill_ids").Get(&bundle)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1054)
+	}
+	//上架时重新检查技能和价格，技能降价或下架后套餐可能已无效
+	if open {
+		ok, err := checkBundle(pq, coinName, bundle.SkillIDs, bundle.Price)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if ok == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1055)
+		}
+	}
+
+	//上架下架
+	bundle = db.Bundle{IsOpen: open, Version: bundle.Version}
+	affected, err := pq.ID(id).UseBool().Update(&bundle)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1054)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//DeleteBundle 删除套餐，软删除
+func DeleteBundle(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	affected, err := pq.ID(id).Delete(&db.Bundle{Owner: coinName})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1054)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//GetBundleList 获取某用户的套餐列表，别人只能看到上架的套餐
+func GetBundleList(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	name := ctx.Params().Get("name")
+
+	session := pq.Where("owner = ?", name)
+	if name != coinName {
+		session = session.And("is_open = ?", true)
+	}
+	bundles := []*db.Bundle{}
+	err := session.Desc("id").Find(&bundles)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&bundles)
+}
+
+//checkBundle 检查套餐：技能须全部为本人未删除且上架中的技能，套餐价格须低于技能单价之和
+func checkBundle(pq *xorm.Engine, coinName string, skillIDs []uint64, price uint64) (bool, error) {
+	skills := []*db.Skill{}
+	err := pq.In("id", skillIDs).Where("owner = ? AND is_open = ?", coinName, true).Cols("id", "price").Find(&skills)
+	if err != nil || len(skills) != len(skillIDs) {
+		return false, err
+	}
+	return price < sumSkillPrice(skills), nil
+}
+
+//closeOverpricedBundles 技能降价后，下架包含此技能、总价不再低于技能单价之和的套餐，避免以高于单买的价格生成快照
+func closeOverpricedBundles(pq *xorm.Engine, coinName string, skillID uint64) error {
+	bundles := []*db.Bundle{}
+	data, _ := json.Marshal([]uint64{skillID})
+	err := pq.Where("owner = ? AND is_open = ? AND skill_ids @> ?", coinName, true, exbytes.ToString(data)).Find(&bundles)
+	if err != nil {
+		return err
+	}
+	for _, bundle := range bundles {
+		skills := []*db.Skill{}
+		err = pq.In("id", bundle.SkillIDs).Cols("price").Find(&skills)
+		if err != nil {
+			return err
+		}
+		if bundle.Price < sumSkillPrice(skills) {
+			continue
+		}
+		_, err = pq.ID(bundle.ID).UseBool().Update(&db.Bundle{IsOpen: false, Version: bundle.Version})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//sumSkillPrice 技能单价之和
+func sumSkillPrice(skills []*db.Skill) uint64 {
+	sum := uint64(0)
+	for _, skill := range skills {
+		sum += skill.Price
+	}
+	return sum
+}
@@ -1,10 +1,10 @@
 package controller
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"image/jpeg"
-	"io/ioutil"
-	"os"
 	"time"
 
 	"github.com/boombuler/barcode"
@@ -94,16 +94,21 @@ func Register(ctx context.Context, form model.RegisterForm) {
 			return nil, err
 		}
 
+		//生成鸟币号二维码和默认头像的图片处理任务
+		_, err = NewImgJob(session, config.ImgJobQRC, coin.Name, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		_, err = NewImgJob(session, config.ImgJobAvatar, coin.Name, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+
 		return coin, nil
 	})
 
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 	ctx.JSON(&coin)
-
-	//生成鸟币号二维码
-	GoGenQRC(&coin)
-	//生成默认头像
-	GoGenDefaultAvatar(&coin)
 }
 
 //Login 登录
@@ -178,39 +183,38 @@ func UpdatePwd(ctx context.Context, form model.NewPwdForm) {
 	ctx.JSON(&model.UpdateRes{Ok: true})
 }
 
-//UpdateAvatar 修改头像
+//UpdateAvatar 修改头像，可用crop参数"x,y,w,h"指定裁剪区域（原图像素坐标），不指定时整张图片补边为正方形
 func UpdateAvatar(ctx context.Context) {
 	e := new(model.CommonError)
 	pq := GetPQ(ctx)
 	cid := GetJwtUser(ctx)[config.JwtCIDKey].(float64)
 	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
 
-	//-----1.接收原图，移动到：./files/udata/鸟币号/pic/鸟币号_avatar-original.jpg-----
+	//-----1.接收原图，原图只用于生成缩略图，不保存-----
 	_, fh, err := ctx.FormFile("file")
 	if err != nil {
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 	}
-
-	//原图路径
-	pic := config.Public.Pic
-	meta := db.NewSquareJPGMeta(coinName+pic.AvatarSuffix+pic.PicNameSuffixOriginal, pic.AvatarSizeBiggest)
-	dirOriginal := db.GetUserPicDir(coinName, meta)
-
-	var delPic = func(err error) bool {
-		if err != nil {
-			os.Remove(dirOriginal)
-			return true
-		}
-		return false
+	oriBuffer, err := util.ReadUpload(fh)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	if msg := checkPicFormat(oriBuffer); msg != "" {
+		e.ReturnError(ctx, iris.StatusOK, msg)
 	}
-
-	//保存原图
-	_, err = util.SaveFileTo(fh, dirOriginal)
-	if delPic(err) {
+	crop, ok := parsePicCrop(ctx.FormValue("crop"), oriBuffer)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1066)
+	}
+	//按EXIF方向旋转，旋转后的宽高才是实际宽高
+	oriBuffer, err = db.NormalizePic(oriBuffer)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	//裁剪头像，裁剪区域不是正方形时仍会补边
+	if crop.Empty() == false {
+		oriBuffer, err = db.CropPic(oriBuffer, crop)
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 	}
 
 	//-----2.获取图片信息，生成缩略图------
+	pic := config.Public.Pic
 	guid := xid.New().String()
 	avatar := db.Pic{
 		Biggest: db.NewSquareJPGMeta(coinName+pic.AvatarSuffix+guid+pic.PicNameSuffixBiggest, pic.AvatarSizeBiggest),
@@ -220,14 +224,8 @@ func UpdateAvatar(ctx context.Context) {
 	}
 
 	//获取图片宽高信息
-	oriBuffer, err := bimg.Read(dirOriginal)
-	if delPic(err) {
-		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
-	}
 	size, err := bimg.NewImage(oriBuffer).Size()
-	if delPic(err) {
-		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
-	}
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 	width := uint(size.Width)
 
 	//生成缩略图
@@ -251,15 +249,10 @@ func UpdateAvatar(ctx context.Context) {
 	} else {
 		err = db.CompressUserJPG(coinName, oriBuffer, avatar.Small, false)
 	}
-	if delPic(err) {
-		os.Remove(db.GetUserPicDir(coinName, avatar.Biggest))
-		os.Remove(db.GetUserPicDir(coinName, avatar.Large))
-		os.Remove(db.GetUserPicDir(coinName, avatar.Middle))
-		os.Remove(db.GetUserPicDir(coinName, avatar.Small))
+	if err != nil {
+		db.RemoveUserPics(coinName, avatar.Biggest, avatar.Large, avatar.Middle, avatar.Small)
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 	}
-	//删除原图
-	os.Remove(dirOriginal)
 
 	//-----3.更新数据库------
 	//获取老头像
@@ -272,10 +265,7 @@ func UpdateAvatar(ctx context.Context) {
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 
 	//移除老头像
-	os.Remove(db.GetUserPicDir(coinName, oldAvatars.Biggest))
-	os.Remove(db.GetUserPicDir(coinName, oldAvatars.Large))
-	os.Remove(db.GetUserPicDir(coinName, oldAvatars.Middle))
-	os.Remove(db.GetUserPicDir(coinName, oldAvatars.Small))
+	db.RemoveUserPics(coinName, oldAvatars.Biggest, oldAvatars.Large, oldAvatars.Middle, oldAvatars.Small)
 
 	ctx.JSON(&model.UpdateRes{Ok: true})
 }
@@ -361,62 +351,68 @@ func GetMyActivity(ctx context.Context) {
 	ctx.JSON(&info)
 }
 
-//GoGenQRC 异步生成鸟币号二维码
-func GoGenQRC(coin *db.Coin) {
-	go func(coin *db.Coin) {
-		//生成qrcode原图：./files/udata/鸟币号/pic/鸟币号_qrc-original.jpg
-		pic := config.Public.Pic
-		qrc, err := qr.Encode(coin.Name, qr.M, qr.Auto)
-		meta := db.NewSquareJPGMeta(coin.Name+pic.QRCSuffix+pic.PicNameSuffixOriginal, config.Public.Pic.QRSizeBiggest)
-		dir := db.GetUserPicDir(coin.Name, meta)
-		if err != nil {
-			return
-		}
+//genQRC 生成鸟币号二维码，由图片处理任务调用
+func genQRC(pq *xorm.Engine, coinName string) error {
+	coin := db.Coin{}
+	has, err := pq.Where("name = ?", coinName).Cols("qrc").Get(&coin)
+	if err != nil {
+		return err
+	}
+	if has == false || coin.Qrc.Biggest == nil {
+		return errors.New(config.Public.Err.E1059)
+	}
 
-		qrc, err = barcode.Scale(qrc, int(meta.W), int(meta.H))
-		file, err := os.Create(dir)
-		defer file.Close()
-		err = jpeg.Encode(file, qrc, nil)
-		if err != nil {
-			return
-		}
+	//生成qrcode原图，内容为收款方是自己的付款码，原图只用于生成缩略图，不保存
+	buffer, err := encodeQRC((&util.PayURI{To: coinName}).String())
+	if err != nil {
+		return err
+	}
 
-		//生成4种大小的二维码jpg缩略图，并且删除"鸟币号_qrc-original.jpg"
-		buffer, _ := bimg.Read(dir)
-		err = db.ResizeUserPic(coin.Name, buffer, coin.Qrc.Biggest)
-		err = db.ResizeUserPic(coin.Name, buffer, coin.Qrc.Large)
-		err = db.ResizeUserPic(coin.Name, buffer, coin.Qrc.Middle)
-		err = db.ResizeUserPic(coin.Name, buffer, coin.Qrc.Small)
+	//生成4种大小的二维码jpg缩略图
+	for _, meta := range []*db.PicMeta{coin.Qrc.Biggest, coin.Qrc.Large, coin.Qrc.Middle, coin.Qrc.Small} {
+		err = db.ResizeUserPic(coinName, buffer, meta)
 		if err != nil {
-			return
+			return err
 		}
-		os.Remove(dir)
-	}(coin)
+	}
+	return nil
 }
 
-//GoGenDefaultAvatar 异步生成默认头像，使用default填充biggest字段
-func GoGenDefaultAvatar(user *db.Coin) {
-	//生成默认头像
-	go func(user *db.Coin) {
-		//生成默认头像原图，大小400x400：./files/udata/鸟币号/pic/鸟币号_defaut-avatar.png
-		pic := config.Public.Pic
-		meta := db.NewSquarePNGMeta(user.Name+pic.AvatarSuffix+pic.PicNameSuffixDefault, pic.AvatarSizeDefault)
-		dir := db.GetUserPicDir(user.Name, meta)
+//encodeQRC 生成内容为content的二维码jpg原图，大小为QRSizeBiggest
+func encodeQRC(content string) ([]byte, error) {
+	size := int(config.Public.Pic.QRSizeBiggest)
+	qrc, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+	qrc, err = barcode.Scale(qrc, size, size)
+	if err != nil {
+		return nil, err
+	}
+	var original bytes.Buffer
+	err = jpeg.Encode(&original, qrc, nil)
+	if err != nil {
+		return nil, err
+	}
+	return original.Bytes(), nil
+}
 
-		avatar := adorable.PseudoRandom([]byte(user.Name))
-		err := ioutil.WriteFile(dir, avatar, 0600)
-		if err != nil {
-			return
-		}
+//genDefaultAvatar 生成默认头像，使用default填充biggest字段，由图片处理任务调用
+func genDefaultAvatar(pq *xorm.Engine, coinName string) error {
+	coin := db.Coin{}
+	has, err := pq.Where("name = ?", coinName).Cols("avatar").Get(&coin)
+	if err != nil {
+		return err
+	}
+	if has == false || coin.Avatar.Biggest == nil {
+		return errors.New(config.Public.Err.E1059)
+	}
 
-		//生成400x400的默认头像缩略图：./files/udata/鸟币号/pic/鸟币号_defaut-avatar.jpg。并且删除png原图。
-		buffer, _ := bimg.Read(dir)
-		err = db.ResizeUserPic(user.Name, buffer, user.Avatar.Biggest)
-		if err != nil {
-			return
-		}
-		os.Remove(dir)
-	}(user)
+	//生成默认头像原图（png，400x400），原图只用于生成缩略图，不保存
+	avatar := adorable.PseudoRandom([]byte(coinName))
+
+	//生成400x400的默认头像缩略图：鸟币号/pic/鸟币号_avatar_default.jpg
+	return db.ResizeUserPic(coinName, avatar, coin.Avatar.Biggest)
 }
 
 //获取加密后的秘密码
@@ -451,6 +447,16 @@ func GetJwtUser(ctx context.Context) jwt.MapClaims {
 	return ctx.Values().Get(config.JWTIrisIDKey).(*jwt.Token).Claims.(jwt.MapClaims)
 }
 
+//IsAdmin 是否是管理员，见config.toml的AdminName
+func IsAdmin(coinName string) bool {
+	for _, name := range config.Public.Name.AdminName {
+		if name == coinName {
+			return true
+		}
+	}
+	return false
+}
+
 //GetNewJwtToken 生成新的jwttoken
 func GetNewJwtToken(coin *db.Coin) (string, int64) {
 	unixExp := time.Now().Add(config.JWTExp * time.Hour * time.Duration(1)).Unix()
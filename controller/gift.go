@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+)
+
+//giftCodeAlphabet 兑换码使用的字符（Crockford base32），去掉了容易混淆的I、L、O、U
+const giftCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+//NewGiftBatch 新建兑换码批次，只能发行自己的鸟币。非血盟须有上架的技能。返回批次和所有兑换码
+func NewGiftBatch(ctx context.Context, form model.NewGiftForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	//非血盟发行需要有至少一项上架的技能，领取时才能发行
+	if form.IsMarker == false {
+		exist, err := pq.Where("owner = ? and is_open = ?", coinName, true).UseBool().Exist(new(db.Skill))
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if exist == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1022)
+		}
+	}
+
+	batch := db.GiftBatch{Owner: coinName, Amount: form.Amount, IsMarker: form.IsMarker, Memo: form.Memo, Count: form.Count, ExpireHours: form.ExpireHours, Sig: form.Sig, SignedAt: form.SignedAt}
+	batch.Expires = time.Now().Add(time.Duration(form.ExpireHours) * time.Hour)
+	//领取时由发行者发行鸟币，与代金券相同，已登记公钥的发行者须签名，签名与批次一起保存
+	batch.KeyID = checkTxSig(ctx, pq, coinName, "gift_batch", batch.Sig, batch.SignedAt, giftTxMessage(&batch))
+	codes := make([]*db.GiftCode, form.Count)
+	for i := range codes {
+		code, err := newGiftCode()
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		codes[i] = &db.GiftCode{Code: code}
+	}
+
+	_, err := pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		_, err := session.InsertOne(&batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, code := range codes {
+			code.BatchID = batch.ID
+		}
+		//xorm批量插入一次最多150条左右，这里分割成每次插入100条
+		for i := 0; i < len(codes); i += 100 {
+			end := i + 100
+			if end > len(codes) {
+				end = len(codes)
+			}
+			_, err = session.InsertMulti(codes[i:end])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&model.GiftRes{GiftBatch: &batch, Codes: codes})
+}
+
+//GetGiftBatchList 获取自己创建的兑换码批次列表，按创建时间倒序
+func GetGiftBatchList(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	batches := []*db.GiftBatch{}
+	err := pq.Where("owner = ?", coinName).Desc("id").Find(&batches)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&batches)
+}
+
+//GetGiftBatch 获取自己创建的兑换码批次的报表：已领取的兑换码（领取者、领取时间）和未领取的兑换码
+func GetGiftBatch(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	batch := db.GiftBatch{}
+	has, err := pq.Where("id = ? AND owner = ?", id, coinName).Get(&batch)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1090)
+	}
+
+	codes := []*db.GiftCode{}
+	err = pq.Where("batch_id = ?", batch.ID).Asc("id").Find(&codes)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&model.GiftRes{GiftBatch: &batch, Codes: codes})
+}
+
+//ClaimGift 领取兑换码：由发行者向领取者发行鸟币。每个兑换码只能领取一次，每个用户每个批次只能领取一个
+func ClaimGift(ctx context.Context, form model.ClaimGiftForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	code := db.GiftCode{}
+	has, err := pq.Where("code = ?", form.Code).Get(&code)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1090)
+	}
+	batch := db.GiftBatch{}
+	has, err = pq.ID(code.BatchID).Get(&batch)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1090)
+	}
+	if code.Claimer != "" || batch.IsClaimable() == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1091)
+	}
+	//发行不检查付款方的签名，改为检查批次的签名，避免绕过签名直接写入批次发行鸟币
+	if batch.KeyID == 0 {
+		if config.Public.Sign.Required {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1081)
+		}
+	} else {
+		_, valid, err := verifyKeySig(pq, batch.KeyID, batch.Owner, batch.Sig, giftTxMessage(&batch))
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if valid == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1082)
+		}
+	}
+
+	//每个用户每个批次只能领取一个兑换码
+	exist, err := pq.Where("batch_id = ? AND claimer = ?", batch.ID, coinName).Exist(new(db.GiftCode))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if exist {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1092)
+	}
+	//限制领取频率
+	claims, err := db.CountGiftClaims(pq, coinName, time.Now().Add(-time.Hour))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if claims >= config.Public.Gift.ClaimsPerHour {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1093)
+	}
+
+	payForm := model.NewPayForm{TransCoin: batch.Owner, Receiver: coinName, Amount: batch.Amount, IsMarker: batch.IsMarker, Memo: batch.Memo}
+	txPay(ctx, batch.Owner, &payForm, paySource{gift: &code})
+
+	code.Claimer, code.ClaimedAt = coinName, time.Now()
+	ctx.JSON(&model.GiftRes{GiftBatch: &batch, Codes: []*db.GiftCode{&code}})
+
+	//更新coin表的个人统计
+	UpdateInfo(pq, batch.Owner)
+}
+
+//newGiftCode 随机生成12位的兑换码
+func newGiftCode() (string, error) {
+	b := make([]byte, 12)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = giftCodeAlphabet[b[i]%32]
+	}
+	return string(b), nil
+}
@@ -1,14 +1,26 @@
 package controller
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"os"
+	"fmt"
+	"image"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/asaskevich/govalidator"
 	"github.com/go-xorm/xorm"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/context"
 	"github.com/rs/xid"
+	"github.com/thinkeridea/go-extend/exbytes"
 	"gopkg.in/h2non/bimg.v1"
 	"reqing.org/niaobi-go/config"
 	"reqing.org/niaobi-go/db"
@@ -16,10 +28,9 @@ import (
 	"reqing.org/niaobi-go/util"
 )
 
-//NewPic 上传图片
+//NewPic 上传图片，可用focus参数"x,y"指定焦点，Middle和Small缩略图以焦点为中心裁剪
 func NewPic(ctx context.Context) {
 	e := new(model.CommonError)
-	pq := GetPQ(ctx)
 	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
 
 	_, header, err := ctx.FormFile("file")
@@ -27,46 +38,68 @@ func NewPic(ctx context.Context) {
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 	}
 
-	//临时保存原图到路径：./files/udata/鸟币号/pic/鸟币号_guid-original.jpg
-	guid := xid.New().String()
-	pid := coinName + "_" + guid
-	meta := db.NewJPGMeta(pid+config.Public.Pic.PicNameSuffixOriginal, 0, 0)
-	dirOriginal := db.GetUserPicDir(coinName, meta)
-	_, err = util.SaveFileTo(header, dirOriginal)
-	if err != nil {
-		os.Remove(dirOriginal)
-		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	//检查存储空间
+	ok, err := checkPicQuota(coinName, header.Size)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1058)
 	}
 
-	//取得hash值
-	checksum, err := util.GetHash256(dirOriginal)
-	if err != nil {
-		os.Remove(dirOriginal)
-		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	data, err := util.ReadUpload(header)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	savePic(ctx, coinName, data, ctx.FormValue("focus"))
+}
+
+//savePic 保存上传的图片：检查格式和焦点，图片已存在时直接返回，新图片临时保存原图并加入图片处理任务
+//用于上传图片和完成断点续传的上传
+func savePic(ctx context.Context, coinName string, data []byte, focusParam string) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+
+	if msg := checkPicFormat(data); msg != "" {
+		e.ReturnError(ctx, iris.StatusOK, msg)
+	}
+	focus, ok := parsePicFocus(focusParam, data)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1066)
 	}
+	//取得hash值
+	checksum := util.GetHash256Bytes(data)
 
 	//检查图片hash是否已经存在于数据库
 	img := db.Img{Hash: checksum}
 	has, err := pq.Get(&img)
 	if err != nil {
 		util.LogDebugAll(err)
-		os.Remove(dirOriginal)
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 	}
 	if has == true {
-		//图片已经存在
-		os.Remove(dirOriginal)
+		//图片已经存在，重新计算回收的宽限期
+		err = db.TouchImg(pq, checksum)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
 		ctx.JSON(&img)
 		return
 	}
 
-	//新的client_hash
+	//临时保存原图：鸟币号/pic/鸟币号_guid-original.jpg，按EXIF方向旋转并去除GPS等元数据后保存
+	data, err = db.NormalizePic(data)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	guid := xid.New().String()
+	keyOriginal := getOriginalPicKey(coinName, guid)
+	err = db.PicStore.Put(keyOriginal, data)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+
+	//新的client_hash，加入图片处理任务，可通过/img/job/{id}查询缩略图是否已生成
 	img.Owner = coinName
 	img.GUID = guid
-	img.OriginalDir = dirOriginal
-	ctx.JSON(&img)
+	img.Focus = focus
+	job, err := NewImgJob(pq, config.ImgJobPic, coinName, 0, []*db.Img{&img})
+	if err != nil {
+		db.PicStore.Delete(keyOriginal)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	}
 
-	GenThumbnail(pq, &img, coinName)
+	ctx.JSON(&model.ImgJobRes{Img: &img, JobID: job.ID})
 }
 
 //CheckPicHash 检查图片是否已经上传过
@@ -83,6 +116,9 @@ func CheckPicHash(ctx context.Context) {
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 	}
 	if has == true {
+		//客户端将直接引用此图片，重新计算回收的宽限期
+		err = db.TouchImg(pq, hash)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 		ctx.JSON(&model.ImgExistRes{Exist: true})
 		return
 	}
@@ -90,224 +126,776 @@ func CheckPicHash(ctx context.Context) {
 	ctx.JSON(&model.ImgExistRes{Exist: false})
 }
 
-//GenThumbnail 生成单张图片的缩略图
-func GenThumbnail(pq *xorm.Engine, img *db.Img, coinName string) {
-	images := []*db.Img{img}
-	GenThumbnails(pq, images, coinName, nil)
+//NewImgJob 新建图片处理任务，由worker异步处理
+func NewImgJob(engine xorm.Interface, kind string, coinName string, skillID uint64, imgs []*db.Img) (*db.ImgJob, error) {
+	items := []*db.ImgJobItem{}
+	for _, img := range imgs {
+		items = append(items, &db.ImgJobItem{Hash: img.Hash, GUID: img.GUID, Focus: img.Focus})
+	}
+	job := db.ImgJob{Owner: coinName, Kind: kind, SkillID: skillID, Items: items, RunAt: time.Now()}
+	_, err := engine.Insert(&job)
+	return &job, err
 }
 
-//GenThumbnails 生成多张图片的缩略图，并且更新到技能
-func GenThumbnails(pq *xorm.Engine, imgs []*db.Img, coinName string, skill *db.Skill) {
-	//生成图片缩略图，并且更新对应字段
-	go func(pq *xorm.Engine, images []*db.Img, coinName string, skill *db.Skill) {
-		pics := []*db.Pic{}
-		conf := config.Public.Pic
-		newInsertedImg := []*db.Img{}
-		for _, img := range images {
-			pic := new(db.Pic)
-			if govalidator.IsNull(img.OriginalDir) == false {
-				//===图片首次上传===
-				pidPrefix := coinName + "_" + img.GUID
-				var delPic = func(err error) bool {
-					if err != nil {
-						util.LogDebugAll(err)
-						os.Remove(img.OriginalDir)
-						return true
-					}
-					return false
-				}
+//GetImgJob 获取图片处理任务的状态，仅本人可以查看
+func GetImgJob(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
 
-				//-----获取图片宽高信息-----
-				util.LogDebug(img.OriginalDir)
+	job := db.ImgJob{ID: id, Owner: coinName}
+	has, err := pq.Get(&job)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1059)
+	}
 
-				file, err := os.Open(img.OriginalDir)
-				if delPic(err) {
-					continue
-				}
-				defer file.Close()
+	ctx.JSON(&job)
+}
 
-				w, h := util.GetPicDimensions(file)
+//ResetImgJobs 服务启动时，把处理中（上次服务中断时未完成）的任务恢复为等待处理
+func ResetImgJobs(pq *xorm.Engine) error {
+	_, err := pq.Exec("UPDATE img_job SET state = 0 WHERE state = 1")
+	return err
+}
 
-				//-------计算缩略图大小，并把数据写入数组----------
-				var getNewWH = func(w int, h int, longer float64, shorter float64, configSize float64) (newW uint, newH uint) {
-					scale := configSize / longer
-					longer = configSize
-					shorter = shorter * scale
-					if w > h {
-						return uint(longer), uint(shorter)
-					}
-					return uint(shorter), uint(longer)
-				}
-				var getLongPicWH = func(w int, h int, longer float64, shorter float64, configSize float64) (newW uint, newH uint) {
-					scale := configSize / shorter
-					shorter = configSize
-					longer = longer * scale
-					if w > h {
-						return uint(longer), uint(shorter)
-					}
-					return uint(shorter), uint(longer)
-				}
+//ClaimImgJob 领取一个到期的任务并标记为处理中，没有任务时返回nil
+//使用FOR UPDATE SKIP LOCKED，多个worker同时领取时不会重复
+func ClaimImgJob(pq *xorm.Engine) (*db.ImgJob, error) {
+	job := db.ImgJob{}
+	has, err := pq.SQL("UPDATE img_job SET state = 1, tries = tries + 1, updated = ? WHERE id = (SELECT id FROM img_job WHERE state = 0 AND run_at <= ? ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED) RETURNING *", time.Now(), time.Now()).Get(&job)
+	if err != nil || has == false {
+		return nil, err
+	}
+	return &job, nil
+}
 
-				longer := float64(w)
-				shorter := float64(h)
-				if w < h {
-					longer = float64(h)
-					shorter = float64(w)
-				}
-				//图片太长，最大长宽比为短边:长边=0.025
-				if shorter/longer < conf.SkillPicScaleMax {
-					delPic(errors.New(config.Public.Err.E1017))
-					continue
+//RunImgJob 执行任务，失败时按JobRetrySeconds延时重试，超过JobMaxTries次后标记为失败并删除原图
+func RunImgJob(pq *xorm.Engine, job *db.ImgJob) {
+	var err error
+	switch job.Kind {
+	case config.ImgJobPic, config.ImgJobSkill:
+		err = runThumbJob(pq, job)
+	case config.ImgJobQRC:
+		err = genQRC(pq, job.Owner)
+	case config.ImgJobAvatar:
+		err = genDefaultAvatar(pq, job.Owner)
+	default:
+		err = errors.New("unknown img job kind: " + job.Kind)
+		job.Tries = config.Public.Pic.JobMaxTries
+	}
+
+	conf := config.Public.Pic
+	if err == nil {
+		job.State = 2
+		job.Err = ""
+		pq.ID(job.ID).Cols("state", "pics", "err").Update(job)
+		return
+	}
+
+	util.LogDebugAll(err)
+	job.Err = err.Error()
+	if job.Tries < conf.JobMaxTries {
+		job.State = 0
+		job.RunAt = time.Now().Add(time.Duration(conf.JobRetrySeconds*int(job.Tries)) * time.Second)
+	} else {
+		job.State = 3
+		for _, item := range job.Items {
+			db.PicStore.Delete(getOriginalPicKey(job.Owner, item.GUID))
+		}
+	}
+	pq.ID(job.ID).Cols("state", "run_at", "err").Update(job)
+}
+
+//runThumbJob 生成图片的缩略图并保存到img表，技能的图片任务完成后更新技能的图片
+//重试时已生成的图片可以在img表中查到，不会重复生成
+func runThumbJob(pq *xorm.Engine, job *db.ImgJob) error {
+	pics := []*db.Pic{}
+	for _, item := range job.Items {
+		original := getOriginalPicKey(job.Owner, item.GUID)
+
+		//图片已经上传过
+		img := db.Img{Hash: item.Hash}
+		has, err := pq.Get(&img)
+		if err != nil {
+			return err
+		}
+		if has == true {
+			db.PicStore.Delete(original)
+			db.TouchImg(pq, img.Hash)
+			pics = append(pics, img.Thumb)
+			continue
+		}
+
+		buffer, err := db.PicStore.Get(original)
+		if err != nil {
+			return err
+		}
+		//本人上传过的近似图片（重新保存、压缩、缩放过的图片）直接使用已有图片的缩略图
+		phash, err := db.PicDHash(buffer)
+		if err != nil {
+			util.LogDebugAll(err)
+		}
+		if distance := config.Public.Pic.PHashDistance; distance >= 0 {
+			similar, err := db.FindSimilarImg(pq, job.Owner, phash, distance)
+			if err != nil {
+				return err
+			}
+			if similar != nil {
+				img = db.Img{Hash: item.Hash, Owner: job.Owner, GUID: item.GUID, Thumb: similar.Thumb, PHash: phash, DupOf: similar.Hash}
+				_, err = pq.Insert(&img)
+				if err != nil {
+					return err
 				}
+				db.PicStore.Delete(original)
+				pics = append(pics, similar.Thumb)
+				continue
+			}
+		}
 
-				//注意：bimg默认的内存缓存是100M
-				buffer, err := bimg.Read(img.OriginalDir)
-				if (longer-shorter)/longer < 0.5 {
-					//正常比例图，以长边对准设定值
-					biggest := float64(conf.SkillPicBiggest)
-					large := float64(conf.SkillPicLarge)
-					middle := float64(conf.SkillPicMiddle)
-					small := float64(conf.SkillPicSmall)
-					if longer > biggest {
-						w, h := getNewWH(w, h, longer, shorter, biggest)
-						pic.Biggest = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixBiggest, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Biggest, true)) {
-							continue
-						}
-					} else {
-						pic.Biggest = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixBiggest, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Biggest, false)) {
-							continue
-						}
-					}
-					if longer > large {
-						w, h := getNewWH(w, h, longer, shorter, large)
-						pic.Large = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixLarge, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Large, true)) {
-							continue
-						}
-					} else {
-						pic.Large = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixLarge, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Large, false)) {
-							continue
-						}
-					}
-					if longer > middle {
-						w, h := getNewWH(w, h, longer, shorter, middle)
-						pic.Middle = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixMiddle, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Middle, true)) {
-							continue
-						}
-					} else {
-						pic.Middle = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixMiddle, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Middle, false)) {
-							continue
-						}
-					}
-					if longer > small {
-						w, h := getNewWH(w, h, longer, shorter, small)
-						pic.Small = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixSmall, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Small, true)) {
-							continue
-						}
-					} else {
-						pic.Small = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixSmall, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Small, false)) {
-							continue
-						}
-					}
-				} else {
-					//长图，以短边对准设定值
-					bigOri := float64(conf.SkillPicLongBigOri)
-					ori := float64(conf.SkillPicLongOri)
-					bigThum := float64(conf.SkillPicLongBigThum)
-					thum := float64(conf.SkillPicLongThum)
-					if shorter > bigOri {
-						w, h := getLongPicWH(w, h, longer, shorter, bigOri)
-						pic.Biggest = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixBiggest, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Biggest, true)) {
-							continue
-						}
-					} else {
-						pic.Biggest = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixBiggest, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Biggest, false)) {
-							continue
-						}
-					}
-					if shorter > ori {
-						w, h := getLongPicWH(w, h, longer, shorter, ori)
-						pic.Large = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixLarge, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Large, true)) {
-							continue
-						}
-					} else {
-						pic.Large = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixLarge, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Large, false)) {
-							continue
-						}
-					}
-					if shorter > bigThum {
-						w, h := getLongPicWH(w, h, longer, shorter, bigThum)
-						pic.Middle = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixMiddle, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Middle, true)) {
-							continue
-						}
-					} else {
-						pic.Middle = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixMiddle, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Middle, false)) {
-							continue
-						}
+		pic, err := genPicThumb(job.Owner, item.GUID, buffer, item.Focus)
+		if err != nil {
+			if err.Error() == config.Public.Err.E1017 {
+				//图片太长，无法处理，忽略此图片
+				db.PicStore.Delete(original)
+				continue
+			}
+			return err
+		}
+
+		//数据库插入新图hash
+		img = db.Img{Hash: item.Hash, Owner: job.Owner, GUID: item.GUID, Thumb: pic, PHash: phash}
+		_, err = pq.Insert(&img)
+		if err != nil {
+			removePicFiles(job.Owner, pic)
+			return err
+		}
+		//删除新原图
+		db.PicStore.Delete(original)
+		pics = append(pics, pic)
+	}
+	job.Pics = pics
+
+	if job.Kind == config.ImgJobSkill && job.SkillID > 0 {
+		//更新技能缩略图。图片是新建技能的一部分，不修改version
+		data, err := json.Marshal(pics)
+		if err != nil {
+			return err
+		}
+		_, err = pq.Exec("UPDATE skill SET pics = ?::jsonb WHERE id = ?", exbytes.ToString(data), job.SkillID)
+		return err
+	}
+	return nil
+}
+
+//genPicThumb 根据原图生成4种大小的缩略图，出错时删除已生成的缩略图。focus不为nil时Middle和Small缩略图以焦点为中心裁剪为正方形
+func genPicThumb(coinName string, guid string, buffer []byte, focus *db.PicFocus) (*db.Pic, error) {
+	pic := new(db.Pic)
+	conf := config.Public.Pic
+	pidPrefix := coinName + "_" + guid
+
+	//-----获取图片宽高信息-----
+	//注意：bimg默认的内存缓存是100M
+	info, err := util.DecodePicInfo(buffer)
+	if err != nil {
+		return nil, err
+	}
+	w, h := info.Width, info.Height
+
+	//-------计算缩略图大小，并把数据写入数组----------
+	var getNewWH = func(w int, h int, longer float64, shorter float64, configSize float64) (newW uint, newH uint) {
+		scale := configSize / longer
+		longer = configSize
+		shorter = shorter * scale
+		if w > h {
+			return uint(longer), uint(shorter)
+		}
+		return uint(shorter), uint(longer)
+	}
+	var getLongPicWH = func(w int, h int, longer float64, shorter float64, configSize float64) (newW uint, newH uint) {
+		scale := configSize / shorter
+		shorter = configSize
+		longer = longer * scale
+		if w > h {
+			return uint(longer), uint(shorter)
+		}
+		return uint(shorter), uint(longer)
+	}
+
+	longer := float64(w)
+	shorter := float64(h)
+	if w < h {
+		longer = float64(h)
+		shorter = float64(w)
+	}
+	//图片太长，最大长宽比为短边:长边=0.025
+	if shorter/longer < conf.SkillPicScaleMax {
+		return nil, errors.New(config.Public.Err.E1017)
+	}
+
+	//按长边（正常比例图）或短边（长图）对准设定值，小于设定值时不调整大小
+	var genThumb = func(meta **db.PicMeta, suffix string, size float64, isLong bool) error {
+		if isLong && shorter > size {
+			w, h := getLongPicWH(w, h, longer, shorter, size)
+			*meta = db.NewJPGMeta(pidPrefix+suffix, w, h)
+			return db.CompressUserJPG(coinName, buffer, *meta, true)
+		}
+		if isLong == false && longer > size {
+			w, h := getNewWH(w, h, longer, shorter, size)
+			*meta = db.NewJPGMeta(pidPrefix+suffix, w, h)
+			return db.CompressUserJPG(coinName, buffer, *meta, true)
+		}
+		*meta = db.NewJPGMeta(pidPrefix+suffix, uint(w), uint(h))
+		return db.CompressUserJPG(coinName, buffer, *meta, false)
+	}
+
+	//指定了焦点时，以焦点为中心裁剪出最大的正方形，再缩小到设定值
+	var genFocusThumb = func(meta **db.PicMeta, suffix string, size float64) error {
+		cropped, err := db.CropPic(buffer, focusRect(w, h, focus))
+		if err != nil {
+			return err
+		}
+		if shorter > size {
+			*meta = db.NewSquareJPGMeta(pidPrefix+suffix, uint(size))
+			return db.CompressUserJPG(coinName, cropped, *meta, true)
+		}
+		*meta = db.NewSquareJPGMeta(pidPrefix+suffix, uint(shorter))
+		return db.CompressUserJPG(coinName, cropped, *meta, false)
+	}
+
+	isLong := (longer-shorter)/longer >= 0.5
+	sizes := []uint{conf.SkillPicBiggest, conf.SkillPicLarge, conf.SkillPicMiddle, conf.SkillPicSmall}
+	if isLong {
+		//长图，以短边对准设定值
+		sizes = []uint{conf.SkillPicLongBigOri, conf.SkillPicLongOri, conf.SkillPicLongBigThum, conf.SkillPicLongThum}
+	}
+	metas := []**db.PicMeta{&pic.Biggest, &pic.Large, &pic.Middle, &pic.Small}
+	suffixes := []string{conf.PicNameSuffixBiggest, conf.PicNameSuffixLarge, conf.PicNameSuffixMiddle, conf.PicNameSuffixSmall}
+	for i := range metas {
+		if focus != nil && (metas[i] == &pic.Middle || metas[i] == &pic.Small) {
+			err = genFocusThumb(metas[i], suffixes[i], float64(sizes[i]))
+		} else {
+			err = genThumb(metas[i], suffixes[i], float64(sizes[i]), isLong)
+		}
+		if err != nil {
+			removePicFiles(coinName, pic)
+			return nil, err
+		}
+	}
+
+	return pic, nil
+}
+
+//focusRect 宽w高h的图片中以焦点为中心的最大正方形，靠近边缘时移到图片范围内
+func focusRect(w int, h int, focus *db.PicFocus) image.Rectangle {
+	side := w
+	if h < side {
+		side = h
+	}
+	var clamp = func(v int, max int) int {
+		if v < 0 {
+			return 0
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+	left := clamp(focus.X-side/2, w-side)
+	top := clamp(focus.Y-side/2, h-side)
+	return image.Rect(left, top, left+side, top+side)
+}
+
+//parsePicInts 解析逗号分隔的n个非负整数
+func parsePicInts(s string, n int) ([]int, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != n {
+		return nil, false
+	}
+	nums := make([]int, n)
+	for i, part := range parts {
+		num, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || num < 0 {
+			return nil, false
+		}
+		nums[i] = num
+	}
+	return nums, true
+}
+
+//parsePicFocus 解析焦点参数"x,y"，为按EXIF方向旋转后的原图像素坐标，须在图片范围内。为空时返回nil
+func parsePicFocus(s string, data []byte) (*db.PicFocus, bool) {
+	if s == "" {
+		return nil, true
+	}
+	nums, ok := parsePicInts(s, 2)
+	if ok == false {
+		return nil, false
+	}
+	info, err := util.DecodePicInfo(data)
+	if err != nil || nums[0] >= info.Width || nums[1] >= info.Height {
+		return nil, false
+	}
+	return &db.PicFocus{X: nums[0], Y: nums[1]}, true
+}
+
+//parsePicCrop 解析裁剪区域参数"x,y,w,h"，为按EXIF方向旋转后的原图像素坐标，须在图片范围内。为空时返回空区域
+func parsePicCrop(s string, data []byte) (image.Rectangle, bool) {
+	if s == "" {
+		return image.Rectangle{}, true
+	}
+	nums, ok := parsePicInts(s, 4)
+	if ok == false || nums[2] == 0 || nums[3] == 0 {
+		return image.Rectangle{}, false
+	}
+	info, err := util.DecodePicInfo(data)
+	rect := image.Rect(nums[0], nums[1], nums[0]+nums[2], nums[1]+nums[3])
+	if err != nil || rect.In(image.Rect(0, 0, info.Width, info.Height)) == false {
+		return image.Rectangle{}, false
+	}
+	return rect, true
+}
+
+//getOriginalPicKey 新上传图片的原图临时存放的key：鸟币号/pic/鸟币号_guid-original.jpg
+func getOriginalPicKey(coinName string, guid string) string {
+	meta := db.NewJPGMeta(coinName+"_"+guid+config.Public.Pic.PicNameSuffixOriginal, 0, 0)
+	return db.UserPicKey(coinName, meta)
+}
+
+//removePicFiles 删除图片的所有缩略图文件
+func removePicFiles(coinName string, pic *db.Pic) {
+	db.RemoveUserPics(coinName, pic.Biggest, pic.Large, pic.Middle, pic.Small)
+}
+
+//GetImgQuota 获取自己的图片存储空间
+func GetImgQuota(ctx context.Context) {
+	e := new(model.CommonError)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	used, err := db.GetUserPicUsage(coinName)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&model.ImgQuotaRes{Used: used, Quota: config.Public.Pic.UserQuota})
+}
+
+//ImgGC 立即执行图片回收（管理员），返回回收结果
+func ImgGC(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	if IsAdmin(coinName) == false {
+		e.ReturnError(ctx, iris.StatusForbidden, config.Public.Err.E1047)
+	}
+
+	res, err := GCImgs(pq)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&res)
+}
+
+//ImgDupReport 近似图片报告（管理员）：按感知哈希把图片分组，列出包含多个用户图片的分组，用于发现盗图的技能
+func ImgDupReport(ctx context.Context, form model.ImgDupForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	if IsAdmin(coinName) == false {
+		e.ReturnError(ctx, iris.StatusForbidden, config.Public.Err.E1047)
+	}
+
+	distance := form.D
+	if distance == 0 {
+		distance = config.Public.Pic.PHashDistance
+	}
+	if distance < 0 || distance > 7 {
+		distance = 0
+	}
+
+	imgs := []*db.Img{}
+	err := pq.Cols("hash", "owner", "thumb", "phash", "dup_of", "created").Where("phash <> 0").Asc("created").Find(&imgs)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	res := model.ImgDupRes{Distance: distance, Clusters: []*model.ImgDupGroup{}}
+	for _, group := range groupSimilarImgs(imgs, distance) {
+		owners := []string{}
+		seen := map[string]bool{}
+		items := []*model.ImgDupImg{}
+		for _, img := range group {
+			if seen[img.Owner] == false {
+				seen[img.Owner] = true
+				owners = append(owners, img.Owner)
+			}
+			items = append(items, &model.ImgDupImg{
+				Hash:    img.Hash,
+				Owner:   img.Owner,
+				PHash:   fmt.Sprintf("%016x", uint64(img.PHash)),
+				DupOf:   img.DupOf,
+				Thumb:   img.Thumb,
+				Created: img.Created.Unix(),
+			})
+		}
+		if len(owners) > 1 {
+			res.Clusters = append(res.Clusters, &model.ImgDupGroup{Owners: owners, Imgs: items})
+		}
+	}
+	sort.SliceStable(res.Clusters, func(i, j int) bool {
+		return len(res.Clusters[i].Imgs) > len(res.Clusters[j].Imgs)
+	})
+
+	ctx.JSON(&res)
+}
+
+//groupSimilarImgs 把感知哈希汉明距离不超过distance（最大7）的图片分为一组，只返回多于一张图片的分组
+//64位哈希分为8段，距离不超过7的两个哈希至少有一段完全相同，所以只需比较有相同段的图片
+func groupSimilarImgs(imgs []*db.Img, distance int) [][]*db.Img {
+	parent := make([]int, len(imgs))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for band := uint(0); band < 8; band++ {
+		buckets := map[uint8][]int{}
+		for i, img := range imgs {
+			key := uint8(uint64(img.PHash) >> (band * 8))
+			buckets[key] = append(buckets[key], i)
+		}
+		for _, bucket := range buckets {
+			for x := 0; x < len(bucket); x++ {
+				for y := x + 1; y < len(bucket); y++ {
+					a, b := bucket[x], bucket[y]
+					if db.PHashDistance(imgs[a].PHash, imgs[b].PHash) > distance {
+						continue
 					}
-					if shorter > thum {
-						w, h := getLongPicWH(w, h, longer, shorter, thum)
-						pic.Small = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixSmall, w, h)
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Small, true)) {
-							continue
-						}
-					} else {
-						pic.Small = db.NewJPGMeta(pidPrefix+conf.PicNameSuffixSmall, uint(w), uint(h))
-						if delPic(db.CompressUserJPG(coinName, buffer, pic.Small, false)) {
-							continue
-						}
+					ra, rb := find(a), find(b)
+					if ra != rb {
+						parent[rb] = ra
 					}
 				}
-				img.Thumb = pic
-
-				//数据库插入新图hash
-				_, err = pq.Insert(img)
-				if err == nil {
-					newInsertedImg = append(newInsertedImg, img)
-				}
-			} else {
-				//===图片已经上传过===
-				pic = img.Thumb
 			}
-			//删除新原图
-			os.Remove(img.OriginalDir)
+		}
+	}
 
-			pics = append(pics, pic)
+	groups := map[int][]*db.Img{}
+	roots := []int{}
+	for i, img := range imgs {
+		root := find(i)
+		if _, ok := groups[root]; ok == false {
+			roots = append(roots, root)
 		}
+		groups[root] = append(groups[root], img)
+	}
+	res := [][]*db.Img{}
+	for _, root := range roots {
+		if len(groups[root]) > 1 {
+			res = append(res, groups[root])
+		}
+	}
+	return res
+}
 
-		//出错时，删除缩略图
-		var delOnErr = func() {
-			for _, img := range newInsertedImg {
-				pq.Delete(img)
-			}
-			for _, pic := range pics {
-				os.Remove(db.GetUserPicDir(coinName, pic.Biggest))
-				os.Remove(db.GetUserPicDir(coinName, pic.Large))
-				os.Remove(db.GetUserPicDir(coinName, pic.Middle))
-				os.Remove(db.GetUserPicDir(coinName, pic.Small))
+//GCImgs 图片回收：删除未被技能、技能快照、头像和二维码引用的图片文件和img记录
+//技能更新图片、生成缩略图中途失败等情况都会留下未引用的图片。已删除的技能的图片仍可能被快照引用，所以统一按引用计算
+//刚上传的图片可能尚未被技能引用，所以只删除超过GCGraceHours小时的图片。另外删除过期的断点续传上传
+func GCImgs(pq *xorm.Engine) (model.ImgGCRes, error) {
+	res := model.ImgGCRes{}
+	grace := time.Now().Add(-time.Duration(config.Public.Pic.GCGraceHours) * time.Hour)
+
+	//-----1.收集所有被引用的pid-----
+	refs := map[string]bool{}
+	var addRefs = func(pics ...*db.Pic) {
+		for _, pic := range pics {
+			for _, pid := range pic.PIDs() {
+				refs[pid] = true
 			}
 		}
+	}
+	//已删除（软删除）的技能仍显示在本人的技能列表中，其图片同样保留
+	err := pq.Unscoped().Cols("pics").BufferSize(100).Iterate(new(db.Skill), func(i int, bean interface{}) error {
+		addRefs(bean.(*db.Skill).Pics...)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	err = pq.Cols("pics").BufferSize(100).Iterate(new(db.Snap), func(i int, bean interface{}) error {
+		addRefs(bean.(*db.Snap).Pics...)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	err = pq.Cols("avatar", "qrc").BufferSize(100).Iterate(new(db.Coin), func(i int, bean interface{}) error {
+		coin := bean.(*db.Coin)
+		addRefs(&coin.Avatar, &coin.Qrc)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
 
-		if skill != nil {
-			//更新skill缩略图
-			skill.Pics = pics
-			affected, err := pq.ID(skill.ID).Update(skill)
-			if affected == 0 || err != nil {
-				delOnErr()
+	//-----2.删除未被引用的img记录，删除后同一图片可重新上传-----
+	imgs := []*db.Img{}
+	err = pq.Find(&imgs)
+	if err != nil {
+		return res, err
+	}
+	for _, img := range imgs {
+		//宽限期内的图片及其缩略图文件都保留，上传时间为空的旧数据同样保留（启动时已补上上传时间）
+		if img.Created.IsZero() || img.Created.After(grace) {
+			addRefs(img.Thumb)
+			continue
+		}
+		referenced := false
+		for _, pid := range img.Thumb.PIDs() {
+			if refs[pid] {
+				referenced = true
+				break
 			}
 		}
-	}(pq, imgs, coinName, skill)
+		if referenced == false {
+			affected, err := pq.Delete(&db.Img{Hash: img.Hash})
+			if err != nil {
+				return res, err
+			}
+			res.Imgs += int(affected)
+		}
+	}
+
+	//-----3.删除未被引用的图片文件（包括生成缩略图失败时残留的原图）-----
+	//key格式：鸟币号/pic/pid.格式
+	infos, err := db.PicStore.List("")
+	if err != nil {
+		return res, err
+	}
+	for _, info := range infos {
+		if path.Base(path.Dir(info.Key)) != "pic" || info.ModTime.After(grace) {
+			continue
+		}
+		pid := strings.TrimSuffix(path.Base(info.Key), path.Ext(info.Key))
+		if refs[pid] {
+			continue
+		}
+		if db.PicStore.Delete(info.Key) == nil {
+			res.Files++
+			res.Bytes += info.Size
+			removePicVariants(pid)
+		}
+	}
+
+	//-----4.删除过期的断点续传上传-----
+	uploads := []*db.ImgUpload{}
+	err = pq.Where("expires <= ?", time.Now()).Find(&uploads)
+	if err != nil {
+		return res, err
+	}
+	for _, upload := range uploads {
+		files, size := removeImgUpload(pq, upload)
+		res.Files += files
+		res.Bytes += size
+	}
+
+	return res, nil
+}
+
+//checkPicFormat 检查上传图片的格式，返回错误信息，格式支持时返回空字符串
+func checkPicFormat(data []byte) string {
+	f := util.SniffPicFormat(data)
+	if f == "heic" || f == "avif" {
+		return config.Public.Err.E1064
+	}
+	t, ok := db.PicTypes[f]
+	if ok == false || bimg.IsTypeSupported(t) == false {
+		return config.Public.Err.E1063
+	}
+	for _, allowed := range config.Public.Pic.InputFormats {
+		if f != allowed {
+			continue
+		}
+		//文件头不完整或已损坏
+		if _, err := util.DecodePicInfo(data); err != nil {
+			return config.Public.Err.E1065
+		}
+		return ""
+	}
+	return config.Public.Err.E1063
+}
+
+//checkPicQuota 检查用户的图片存储空间是否足够存放新上传的add字节
+func checkPicQuota(coinName string, add int64) (bool, error) {
+	quota := config.Public.Pic.UserQuota
+	if quota == 0 {
+		return true, nil
+	}
+	used, err := db.GetUserPicUsage(coinName)
+	if err != nil {
+		return false, err
+	}
+	return used+add <= quota, nil
+}
+
+//ServeImg 访问图片：/img/{pid}，可用w、f参数按需生成config中允许的宽度和格式，生成的图片缓存在CacheDir
+//设置ETag、Last-Modified和Cache-Control，浏览器再次请求时返回304。带签名的链接需验证签名和过期时间
+func ServeImg(ctx context.Context, form model.ImgVariantForm) {
+	e := new(model.CommonError)
+	conf := config.Public.Pic
+	pid := ctx.Params().Get("pid")
+	if i := strings.Index(pid, "."); i >= 0 {
+		pid = pid[:i]
+	}
+
+	//签名链接
+	now := time.Now().Unix()
+	signed := form.Sig != ""
+	if signed || conf.SignedOnly {
+		if form.Exp < now || hmac.Equal([]byte(form.Sig), []byte(imgSignature(pid, form.Exp))) == false {
+			e.ReturnError(ctx, iris.StatusForbidden, config.Public.Err.E1062)
+		}
+	}
+
+	//只允许config中的宽度
+	if form.W > 0 {
+		allowed := false
+		for _, w := range conf.VariantWidths {
+			allowed = allowed || w == form.W
+		}
+		if allowed == false {
+			e.ReturnError(ctx, iris.StatusBadRequest, config.Public.Err.E1061)
+		}
+	}
+
+	//原图（上传后尚未处理的图片）不可访问
+	owner := getPicOwner(pid)
+	if owner == "" || strings.HasSuffix(pid, conf.PicNameSuffixOriginal) {
+		e.ReturnError(ctx, iris.StatusNotFound, config.Public.Err.E1060)
+	}
+	info, err := findPicFile(owner, pid, form.F)
+	if err == db.ErrNotExist {
+		e.ReturnError(ctx, iris.StatusNotFound, config.Public.Err.E1060)
+	}
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	//按需生成其他尺寸和格式
+	var data []byte
+	format := strings.TrimPrefix(path.Ext(info.Key), ".")
+	if form.F == "" {
+		form.F = format
+	}
+	if form.W > 0 || form.F != format {
+		info, data, err = getPicVariant(owner, pid, info, form.W, form.F)
+	} else {
+		data, err = db.PicStore.Get(info.Key)
+	}
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.Header("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime.UnixNano(), info.Size))
+	if signed {
+		//签名链接只能在过期前缓存
+		ctx.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", form.Exp-now))
+	} else {
+		ctx.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", conf.ServeMaxAge))
+	}
+	//ServeContent处理If-None-Match、If-Modified-Since、Range和Content-Type
+	http.ServeContent(ctx.ResponseWriter(), ctx.Request(), path.Base(info.Key), info.ModTime, bytes.NewReader(data))
+}
+
+//GetImgURL 获取自己图片的签名链接，SignMinutes分钟内有效
+func GetImgURL(ctx context.Context) {
+	e := new(model.CommonError)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	pid := ctx.Params().Get("pid")
+
+	if getPicOwner(pid) != coinName {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1060)
+	}
+
+	exp := time.Now().Add(time.Duration(config.Public.Pic.SignMinutes) * time.Minute).Unix()
+	url := fmt.Sprintf("/img/%s?exp=%d&sig=%s", pid, exp, imgSignature(pid, exp))
+	ctx.JSON(&model.ImgURLRes{URL: url, Exp: exp})
+}
+
+//imgSignature 图片链接的签名
+func imgSignature(pid string, exp int64) string {
+	mac := hmac.New(sha256.New, []byte(config.JWTSecret))
+	mac.Write([]byte(fmt.Sprintf("img:%s:%d", pid, exp)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+//getPicOwner 从pid中解析出鸟币号，pid格式如：鸟币号_guid-biggest、鸟币号_qrc-biggest
+//鸟币号只包含字母数字短横线，pid不合法时返回空字符串
+func getPicOwner(pid string) string {
+	i := strings.Index(pid, "_")
+	if i <= 0 || strings.ContainsAny(pid, "/\\.") {
+		return ""
+	}
+	return pid[:i]
+}
+
+//findPicFile 查找pid对应的图片文件，图片的格式不在pid中，先尝试prefer格式（已另外生成的格式），再依次尝试允许的格式
+func findPicFile(owner string, pid string, prefer string) (*db.ObjectInfo, error) {
+	formats := config.Public.Pic.VariantFormats
+	if prefer != "" {
+		formats = append([]string{prefer}, formats...)
+	}
+	for _, f := range formats {
+		info, err := db.PicStore.Stat(db.UserPicKey(owner, &db.PicMeta{PID: pid, Format: f}))
+		if err != db.ErrNotExist {
+			return info, err
+		}
+	}
+	return nil, db.ErrNotExist
+}
+
+//getPicVariant 获取图片指定宽度和格式的缓存，缓存不存在或比原图旧时重新生成
+//宽度为0或不小于原图宽度时不调整大小
+func getPicVariant(owner string, pid string, info *db.ObjectInfo, w uint, f string) (*db.ObjectInfo, []byte, error) {
+	key := fmt.Sprintf("%s/%s-w%d.%s", owner, pid, w, f)
+	cached, err := db.PicCacheStore.Stat(key)
+	if err == nil && cached.ModTime.Before(info.ModTime) == false {
+		data, err := db.PicCacheStore.Get(key)
+		return cached, data, err
+	}
+
+	buffer, err := db.PicStore.Get(info.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	size, err := bimg.Size(buffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	options := bimg.Options{Type: db.PicTypes[f], Quality: config.Public.Pic.QualityOfPic, StripMetadata: true}
+	if w > 0 && int(w) < size.Width {
+		options.Width = int(w)
+	}
+	buffer, err = bimg.NewImage(buffer).Process(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = db.PicCacheStore.Put(key, buffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &db.ObjectInfo{Key: key, Size: int64(len(buffer)), ModTime: time.Now()}, buffer, nil
+}
+
+//removePicVariants 删除图片按需生成的缓存
+func removePicVariants(pid string) {
+	owner := getPicOwner(pid)
+	if owner == "" {
+		return
+	}
+	infos, _ := db.PicCacheStore.List(owner + "/" + pid + "-w")
+	for _, info := range infos {
+		db.PicCacheStore.Delete(info.Key)
+	}
 }
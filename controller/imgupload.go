@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"github.com/rs/xid"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+)
+
+//NewImgUpload 创建断点续传的图片上传，之后用PATCH /img/upload/{id}分块上传，全部上传后POST /img/upload/{id}/finish
+func NewImgUpload(ctx context.Context, form model.NewImgUploadForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	if form.Size > config.Public.Pic.MaxUploadPic {
+		e.ReturnError(ctx, iris.StatusRequestEntityTooLarge, config.Public.Err.E1015)
+	}
+
+	//检查存储空间
+	ok, err := checkPicQuota(coinName, form.Size)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1058)
+	}
+
+	//未完成的上传不计入存储空间，限制数量
+	count, err := pq.Where("owner = ? AND expires > ?", coinName, time.Now()).Count(new(db.ImgUpload))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if count >= config.MaxUploads {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1071)
+	}
+
+	upload := db.ImgUpload{
+		ID:      xid.New().String(),
+		Owner:   coinName,
+		Size:    form.Size,
+		Focus:   form.Focus,
+		Expires: time.Now().Add(time.Duration(config.Public.Pic.UploadExpireHours) * time.Hour),
+	}
+	_, err = pq.Insert(&upload)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.Header("Upload-Offset", "0")
+	ctx.JSON(&upload)
+}
+
+//GetImgUpload 查询已上传的大小，同时在Upload-Offset响应头返回，用于中断后继续上传
+func GetImgUpload(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	upload, err := getImgUpload(pq, coinName, ctx.Params().Get("id"))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if upload == nil {
+		e.ReturnError(ctx, iris.StatusNotFound, config.Public.Err.E1067)
+	}
+
+	ctx.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+	ctx.JSON(upload)
+}
+
+//PatchImgUpload 上传一个分块，请求头Upload-Offset须等于已上传的大小，请求体为分块的数据，返回新的偏移量
+func PatchImgUpload(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().Get("id")
+
+	offset, err := strconv.ParseInt(ctx.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		e.ReturnError(ctx, iris.StatusBadRequest, config.Public.Err.E1068)
+	}
+	//多读1个字节，用于判断是否超过图片大小
+	data, err := ioutil.ReadAll(io.LimitReader(ctx.Request().Body, config.Public.Pic.MaxUploadPic+1))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+
+	upload := new(db.ImgUpload)
+	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		//锁定上传记录，同一偏移量的并发请求只有一个成功
+		has, err := session.Where("id = ? AND owner = ? AND expires > ?", id, coinName, time.Now()).ForUpdate().Get(upload)
+		if err != nil {
+			return nil, err
+		}
+		if has == false {
+			return nil, errors.New(config.Public.Err.E1067)
+		}
+		if offset != upload.Received {
+			return nil, errors.New(config.Public.Err.E1068)
+		}
+		if int64(len(data)) > upload.Size-upload.Received {
+			return nil, errors.New(config.Public.Err.E1069)
+		}
+		if len(data) == 0 {
+			return nil, nil
+		}
+
+		key := db.UserUploadChunkKey(coinName, id, offset)
+		err = db.PicStore.Put(key, data)
+		if err != nil {
+			return nil, err
+		}
+		upload.Received += int64(len(data))
+		_, err = session.Exec("UPDATE img_upload SET received = ? WHERE id = ?", upload.Received, id)
+		if err != nil {
+			db.PicStore.Delete(key)
+		}
+		return nil, err
+	})
+	if err != nil {
+		switch err.Error() {
+		case config.Public.Err.E1067:
+			e.ReturnError(ctx, iris.StatusNotFound, err.Error())
+		case config.Public.Err.E1068:
+			ctx.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+			e.ReturnError(ctx, iris.StatusConflict, err.Error())
+		case config.Public.Err.E1069:
+			e.ReturnError(ctx, iris.StatusRequestEntityTooLarge, err.Error())
+		}
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	}
+
+	ctx.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+	ctx.JSON(upload)
+}
+
+//FinishImgUpload 完成上传：合并所有分块，与上传图片一样检查图片hash并加入图片处理任务，返回的hash可用于更新技能的图片
+//完成后（包括图片格式等检查失败）删除上传的分块和记录
+func FinishImgUpload(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	upload, err := getImgUpload(pq, coinName, ctx.Params().Get("id"))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if upload == nil {
+		e.ReturnError(ctx, iris.StatusNotFound, config.Public.Err.E1067)
+	}
+	if upload.Received != upload.Size {
+		ctx.Header("Upload-Offset", strconv.FormatInt(upload.Received, 10))
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1070)
+	}
+
+	data, err := readImgUpload(upload)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	defer removeImgUpload(pq, upload)
+
+	//检查存储空间
+	ok, err := checkPicQuota(coinName, upload.Size)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1058)
+	}
+
+	savePic(ctx, coinName, data, upload.Focus)
+}
+
+//DeleteImgUpload 取消上传，删除已上传的分块
+func DeleteImgUpload(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	upload, err := getImgUpload(pq, coinName, ctx.Params().Get("id"))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if upload != nil {
+		removeImgUpload(pq, upload)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//getImgUpload 获取自己未过期的上传，不存在时返回nil
+func getImgUpload(pq *xorm.Engine, coinName string, id string) (*db.ImgUpload, error) {
+	upload := new(db.ImgUpload)
+	has, err := pq.Where("id = ? AND owner = ? AND expires > ?", id, coinName, time.Now()).Get(upload)
+	if err != nil || has == false {
+		return nil, err
+	}
+	return upload, nil
+}
+
+//readImgUpload 按偏移量顺序合并所有分块，分块须连续且总大小等于图片大小
+func readImgUpload(upload *db.ImgUpload) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, upload.Size))
+	for buf.Len() < int(upload.Size) {
+		chunk, err := db.PicStore.Get(db.UserUploadChunkKey(upload.Owner, upload.ID, int64(buf.Len())))
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return nil, errors.New("empty upload chunk")
+		}
+		buf.Write(chunk)
+	}
+	if int64(buf.Len()) != upload.Size {
+		return nil, errors.New("upload size mismatch")
+	}
+	return buf.Bytes(), nil
+}
+
+//removeImgUpload 删除上传的分块和记录
+func removeImgUpload(pq *xorm.Engine, upload *db.ImgUpload) (files int, size int64) {
+	infos, _ := db.PicStore.List(db.UserUploadPrefix(upload.Owner, upload.ID))
+	for _, info := range infos {
+		if db.PicStore.Delete(info.Key) == nil {
+			files++
+			size += info.Size
+		}
+	}
+	pq.Delete(&db.ImgUpload{ID: upload.ID})
+	return files, size
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+)
+
+//NewInvoice 新建收款单，付款方转账(/tx/pay)时填写收款单ID即可
+func NewInvoice(ctx context.Context, form model.NewInvoiceForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	//默认只接受自己发行的鸟币，其他鸟币须存在
+	coins := form.Coins
+	if len(coins) == 0 {
+		coins = []string{coinName}
+	}
+	for _, coin := range coins {
+		if coin == coinName {
+			continue
+		}
+		exist, err := pq.Exist(&db.Coin{Name: coin})
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if exist == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1020)
+		}
+	}
+
+	invoice := db.Invoice{Owner: coinName, Coins: coins, Amount: form.Amount, Memo: form.Memo, MultiUse: form.MultiUse}
+	if form.ExpireHours > 0 {
+		invoice.Expires = time.Now().Add(time.Duration(form.ExpireHours) * time.Hour)
+	}
+	affected, err := pq.UseBool().InsertOne(&invoice)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1004)
+	}
+
+	ctx.JSON(&invoice)
+}
+
+//GetInvoice 获取收款单，付款方付款前查看收款方、鸟币和数额
+func GetInvoice(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	invoice := db.Invoice{}
+	has, err := pq.ID(id).Get(&invoice)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1074)
+	}
+
+	ctx.JSON(&invoice)
+}
+
+//GetInvoiceList 获取自己的收款单列表，按创建时间倒序
+func GetInvoiceList(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	invoices := []*db.Invoice{}
+	err := pq.Where("owner = ?", coinName).Desc("id").Find(&invoices)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&invoices)
+}
+
+//VoidInvoice 作废自己待付款的收款单，已付款的记录不受影响
+func VoidInvoice(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	res, err := pq.Exec("UPDATE invoice SET state = 2, updated = ? WHERE id = ? AND owner = ? AND state = 0", time.Now(), id, coinName)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	affected, err := res.RowsAffected()
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1075)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//fillInvoicePay 按收款单填写转账参数：收款方和数额为空时使用收款单的，不为空时须与收款单相同，鸟币须为收款单接受的鸟币，备注为空时使用收款单的备注
+func fillInvoicePay(ctx context.Context, pq *xorm.Engine, form *model.NewPayForm) *db.Invoice {
+	e := new(model.CommonError)
+
+	invoice := db.Invoice{}
+	has, err := pq.ID(form.InvoiceID).Get(&invoice)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1074)
+	}
+	if invoice.IsPayable() == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1075)
+	}
+	if (form.Receiver != "" && form.Receiver != invoice.Owner) || (form.Amount != 0 && form.Amount != invoice.Amount) {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1077)
+	}
+	if form.TransCoin == "" && len(invoice.Coins) == 1 {
+		form.TransCoin = invoice.Coins[0]
+	}
+	if invoice.AcceptCoin(form.TransCoin) == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1076)
+	}
+	form.Receiver = invoice.Owner
+	form.Amount = invoice.Amount
+	if form.Memo == "" {
+		form.Memo = invoice.Memo
+	}
+	return &invoice
+}
@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+	"reqing.org/niaobi-go/util"
+)
+
+//GetLedgerCheckpoints 获取最近的账本检查点（公开），按id倒序，参数before为id，用于分页
+func GetLedgerCheckpoints(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	before := ctx.URLParamInt64Default("before", 0)
+
+	session := pq.Desc("id").Limit(100)
+	if before > 0 {
+		session = session.Where("id < ?", before)
+	}
+	checkpoints := []*db.LedgerCheckpoint{}
+	err := session.Find(&checkpoints)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&checkpoints)
+}
+
+//GetLedgerCheckpoint 获取账本检查点（公开）
+func GetLedgerCheckpoint(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	checkpoint := db.LedgerCheckpoint{}
+	has, err := pq.ID(id).Get(&checkpoint)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1087)
+	}
+
+	ctx.JSON(&checkpoint)
+}
+
+//GetLedgerProof 获取交易记录在账本中的证明，仅交易双方和管理员可以查询。table为pay或repay
+func GetLedgerProof(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	table := ctx.Params().Get("table")
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	//交易双方
+	parties := []string{}
+	switch table {
+	case config.NewsTablePay:
+		pay := db.Pay{}
+		has, err := pq.ID(id).Cols("payer", "receiver").Get(&pay)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if has {
+			parties = append(parties, pay.Payer, pay.Receiver)
+		}
+	case config.NewsTableRePay:
+		repay := db.Repay{}
+		has, err := pq.ID(id).Cols("bearer", "issuer").Get(&repay)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if has {
+			parties = append(parties, repay.Bearer, repay.Issuer)
+		}
+	}
+	if len(parties) == 0 || (coinName != parties[0] && coinName != parties[1] && IsAdmin(coinName) == false) {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1085)
+	}
+
+	//启用账本之前的记录不在账本中
+	entry := db.Ledger{}
+	has, err := pq.Where("tbl = ? AND record_id = ?", table, id).Get(&entry)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1086)
+	}
+	content, err := db.LedgerRecordContent(pq, table, id)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	res := model.LedgerProofRes{Entry: &entry, Content: string(content)}
+
+	checkpoint := db.LedgerCheckpoint{}
+	has, err = pq.Where("from_seq <= ? AND to_seq >= ?", entry.ID, entry.ID).Get(&checkpoint)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has {
+		entries := []*db.Ledger{}
+		err = pq.Where("id >= ? AND id <= ?", checkpoint.FromSeq, checkpoint.ToSeq).Asc("id").Cols("id", "hash").Find(&entries)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		res.Index, res.Path, err = ledgerProof(entries, entry.ID)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		res.Checkpoint = &checkpoint
+	}
+
+	ctx.JSON(&res)
+}
+
+//NewLedgerCheckpoint 为上一个检查点之后追加的账本记录生成检查点，没有新的账本记录时返回nil
+func NewLedgerCheckpoint(pq *xorm.Engine) (*db.LedgerCheckpoint, error) {
+	res, err := pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		err := db.LockLedger(session)
+		if err != nil {
+			return nil, err
+		}
+		last := db.LedgerCheckpoint{}
+		_, err = session.Desc("id").Get(&last)
+		if err != nil {
+			return nil, err
+		}
+		entries := []*db.Ledger{}
+		err = session.Where("id > ?", last.ToSeq).Asc("id").Cols("id", "hash").Find(&entries)
+		if err != nil || len(entries) == 0 {
+			return nil, err
+		}
+		leaves, err := ledgerLeaves(entries)
+		if err != nil {
+			return nil, err
+		}
+
+		head := entries[len(entries)-1]
+		checkpoint := db.LedgerCheckpoint{FromSeq: entries[0].ID, ToSeq: head.ID, Count: uint32(len(entries)), Root: ledgerRoot(leaves), Head: head.Hash}
+		_, err = session.InsertOne(&checkpoint)
+		return &checkpoint, err
+	})
+	if err != nil || res == nil {
+		return nil, err
+	}
+	return res.(*db.LedgerCheckpoint), nil
+}
+
+//VerifyLedger 验证整个账本：哈希链是否连续，每条账本记录的hash是否与pay、repay记录的内容一致，检查点的根哈希是否正确
+func VerifyLedger(pq *xorm.Engine) (*model.LedgerVerifyRes, error) {
+	res := model.LedgerVerifyRes{Problems: []string{}}
+	var problem = func(format string, a ...interface{}) {
+		res.Problems = append(res.Problems, fmt.Sprintf(format, a...))
+	}
+
+	checkpoints := []*db.LedgerCheckpoint{}
+	err := pq.Asc("id").Find(&checkpoints)
+	if err != nil {
+		return nil, err
+	}
+	cp := 0
+	leaves := [][]byte{}
+
+	prev := ""
+	afterID := uint64(0)
+	for {
+		entries := []*db.Ledger{}
+		err = pq.Where("id > ?", afterID).Asc("id").Limit(500).Find(&entries)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		for _, entry := range entries {
+			res.Entries++
+			if entry.Prev != prev {
+				problem("ledger %d: prev hash does not match the previous entry", entry.ID)
+			}
+			prev = entry.Hash
+			content, err := db.LedgerRecordContent(pq, entry.Tbl, entry.RecordID)
+			if err != nil {
+				return nil, err
+			}
+			if content == nil {
+				problem("ledger %d: %s %d is missing", entry.ID, entry.Tbl, entry.RecordID)
+			} else if db.LedgerHash(entry.Prev, content) != entry.Hash {
+				problem("ledger %d: %s %d does not match its hash", entry.ID, entry.Tbl, entry.RecordID)
+			}
+
+			//检查点
+			if cp < len(checkpoints) && entry.ID >= checkpoints[cp].FromSeq {
+				leaf, err := hex.DecodeString(entry.Hash)
+				if err != nil {
+					problem("ledger %d: invalid hash", entry.ID)
+				}
+				leaves = append(leaves, leaf)
+			}
+			if cp < len(checkpoints) && entry.ID == checkpoints[cp].ToSeq {
+				checkpoint := checkpoints[cp]
+				if int(checkpoint.Count) != len(leaves) || checkpoint.Head != entry.Hash || checkpoint.Root != ledgerRoot(leaves) {
+					problem("checkpoint %d: root does not match ledger %d-%d", checkpoint.ID, checkpoint.FromSeq, checkpoint.ToSeq)
+				}
+				res.Checkpoints++
+				cp++
+				leaves = [][]byte{}
+			}
+		}
+		afterID = entries[len(entries)-1].ID
+	}
+	for ; cp < len(checkpoints); cp++ {
+		problem("checkpoint %d: ledger %d-%d is missing", checkpoints[cp].ID, checkpoints[cp].FromSeq, checkpoints[cp].ToSeq)
+	}
+	return &res, nil
+}
+
+//ledgerLeaves 账本记录的hash解码后作为Merkle树的叶子
+func ledgerLeaves(entries []*db.Ledger) ([][]byte, error) {
+	leaves := make([][]byte, len(entries))
+	for i, entry := range entries {
+		leaf, err := hex.DecodeString(entry.Hash)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	return leaves, nil
+}
+
+//ledgerRoot 检查点公开的根哈希（hex）
+func ledgerRoot(leaves [][]byte) string {
+	return hex.EncodeToString(util.MerkleRoot(leaves))
+}
+
+//ledgerProof 序号为seq的账本记录在检查点entries中的位置和Merkle证明
+func ledgerProof(entries []*db.Ledger, seq uint64) (int, []util.MerkleStep, error) {
+	leaves, err := ledgerLeaves(entries)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i := range entries {
+		if entries[i].ID == seq {
+			return i, util.MerkleProof(leaves, i), nil
+		}
+	}
+	return 0, nil, fmt.Errorf("ledger %d is not in the checkpoint", seq)
+}
@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"encoding/hex"
+	"strconv"
+	"testing"
+
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/util"
+)
+
+//ledgerTestChain 按账本的方式生成n条哈希链接的账本记录，序号从first开始
+func ledgerTestChain(first uint64, n int) []*db.Ledger {
+	entries := []*db.Ledger{}
+	prev := ""
+	for i := 0; i < n; i++ {
+		pay := db.Pay{ID: uint64(100 + i), Payer: "alice", Receiver: "bob", TransCoin: "alice", Amount: uint64(i + 1), GUID: "guid" + strconv.Itoa(i)}
+		hash := db.LedgerHash(prev, pay.LedgerContent())
+		entries = append(entries, &db.Ledger{ID: first + uint64(i), Tbl: "pay", RecordID: pay.ID, Prev: prev, Hash: hash})
+		prev = hash
+	}
+	return entries
+}
+
+//GetLedgerProof返回的证明须能通过检查点公开的根哈希验证
+func TestLedgerProofVerifiesAgainstCheckpoint(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		entries := ledgerTestChain(41, n)
+		leaves, err := ledgerLeaves(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := hex.DecodeString(ledgerRoot(leaves))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, entry := range entries {
+			index, path, err := ledgerProof(entries, entry.ID)
+			if err != nil || index != i {
+				t.Fatalf("n=%d seq=%d: index %d, err %v", n, entry.ID, index, err)
+			}
+			leaf, _ := hex.DecodeString(entry.Hash)
+			if util.VerifyMerkleProof(leaf, path, root) == false {
+				t.Errorf("n=%d seq=%d: proof does not verify against the checkpoint root", n, entry.ID)
+			}
+			//篡改记录后重新计算的hash不能通过验证
+			tampered, _ := hex.DecodeString(db.LedgerHash(entry.Prev, []byte("tampered")))
+			if util.VerifyMerkleProof(tampered, path, root) {
+				t.Errorf("n=%d seq=%d: tampered entry verifies", n, entry.ID)
+			}
+		}
+		if _, _, err := ledgerProof(entries, 41+uint64(n)); err == nil {
+			t.Errorf("n=%d: proof for a seq outside the checkpoint", n)
+		}
+	}
+}
+
+func TestLedgerLeavesInvalidHash(t *testing.T) {
+	entries := ledgerTestChain(1, 3)
+	entries[1].Hash = "zz"
+	if _, err := ledgerLeaves(entries); err == nil {
+		t.Error("invalid hash accepted")
+	}
+}
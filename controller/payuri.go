@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+	"reqing.org/niaobi-go/util"
+)
+
+//PayQRC 生成付款码二维码（jpg），内容见util.PayURI，可指定鸟币、数额、血盟标记和备注。二维码不保存
+func PayQRC(ctx context.Context, form model.PayQRCForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	pic := config.Public.Pic
+
+	size := form.W
+	if size == 0 {
+		size = pic.QRSizeMiddle
+	}
+	if size != pic.QRSizeBiggest && size != pic.QRSizeLarge && size != pic.QRSizeMiddle && size != pic.QRSizeSmall {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1061)
+	}
+	checkPayURICoins(ctx, pq, form.To, form.Coin)
+
+	uri := util.PayURI{To: form.To, Coin: form.Coin, Amount: form.Amount, IsMarker: form.IsMarker, Memo: form.Memo}
+	buffer, err := encodeQRC(uri.String())
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	if size != pic.QRSizeBiggest {
+		buffer, err = db.ResizePic(buffer, size, size)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	}
+
+	ctx.ContentType("image/jpeg")
+	ctx.Write(buffer)
+}
+
+//ParsePayURI 解析付款码（扫描二维码得到的内容），检查收款方和鸟币是否存在，返回的内容可直接作为转账(/tx/pay)的参数
+func ParsePayURI(ctx context.Context, form model.PayURIForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+
+	uri, err := util.ParsePayURI(form.URI)
+	if err == util.ErrPayURIVersion {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1073)
+	}
+	if err != nil {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1072)
+	}
+	checkPayURICoins(ctx, pq, uri.To, uri.Coin)
+
+	res := model.PayURIRes{Version: uri.Version, TransCoin: uri.Coin, Receiver: uri.To, Amount: uri.Amount, IsMarker: uri.IsMarker, Memo: uri.Memo}
+	err = util.Strings(&res)
+	e.CheckError(ctx, err, iris.StatusNotAcceptable, config.Public.Err.E1002, nil)
+
+	ctx.JSON(&res)
+}
+
+//checkPayURICoins 付款码的收款方须存在，指定了鸟币时鸟币须存在
+func checkPayURICoins(ctx context.Context, pq *xorm.Engine, to string, coinName string) {
+	e := new(model.CommonError)
+
+	has, err := pq.Exist(&db.Coin{Name: to})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1018)
+	}
+	if coinName == "" || coinName == to {
+		return
+	}
+	has, err = pq.Exist(&db.Coin{Name: coinName})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1020)
+	}
+}
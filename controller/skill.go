@@ -1,14 +1,17 @@
 package controller
 
 import (
-	"encoding/hex"
-	"io"
-	"os"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
 
+	"github.com/go-xorm/xorm"
 	"github.com/kataras/iris/v12"
 	"github.com/kataras/iris/v12/context"
 	"github.com/rs/xid"
-	"golang.org/x/crypto/blake2b"
+	"github.com/thinkeridea/go-extend/exbytes"
 	"reqing.org/niaobi-go/config"
 	"reqing.org/niaobi-go/db"
 	"reqing.org/niaobi-go/model"
@@ -49,6 +52,18 @@ func NewSkill(ctx context.Context, form model.NewSkillForm) {
 		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1026)
 	}
 
+	//转换为规范的标签名称
+	tags, err := db.NormalizeTags(pq, form.Tags)
+	if err != nil {
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	}
+
+	//价格档位的数量不能重复
+	tiers, ok := model.PriceTiers(form.Tiers)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1056)
+	}
+
 	err = ctx.Request().ParseMultipartForm(config.Public.Pic.MaxUploadPics)
 	if err != nil {
 		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1016, nil)
@@ -58,20 +73,45 @@ func NewSkill(ctx context.Context, form model.NewSkillForm) {
 	if len(files) > 9 {
 		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1036)
 	}
-	imgs := []*db.Img{}
-	conf := config.Public.Pic
+
+	//检查存储空间
+	size := int64(0)
 	for _, file := range files {
-		//取得hash值
-		f, err := file.Open()
+		size += file.Size
+	}
+	ok, err = checkPicQuota(coinName, size)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1058)
+	}
+
+	//先检查所有图片的格式，有不支持的格式时不保存任何图片
+	//焦点按顺序对应files，检查焦点是否在图片范围内
+	uploads := [][]byte{}
+	focuses := []*db.PicFocus{}
+	for i, file := range files {
+		data, err := util.ReadUpload(file)
 		if err != nil {
 			continue
 		}
-		defer f.Close()
-		hash, err := blake2b.New256(nil)
-		if _, err := io.Copy(hash, f); err != nil {
-			continue
+		if msg := checkPicFormat(data); msg != "" {
+			e.ReturnError(ctx, iris.StatusOK, msg)
+		}
+		var focus *db.PicFocus
+		if i < len(form.Focus) {
+			focus, ok = parsePicFocus(form.Focus[i], data)
+			if ok == false {
+				e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1066)
+			}
 		}
-		sum := hex.EncodeToString(hash.Sum(nil))
+		uploads = append(uploads, data)
+		focuses = append(focuses, focus)
+	}
+
+	imgs := []*db.Img{}
+	for i, data := range uploads {
+		//取得hash值
+		sum := util.GetHash256Bytes(data)
 
 		//检查图片hash是否已经存在于数据库
 		img := db.Img{Hash: sum}
@@ -80,20 +120,26 @@ func NewSkill(ctx context.Context, form model.NewSkillForm) {
 			util.LogDebugAll(err)
 			continue
 		}
-		if has == false {
+		if has {
+			//图片已经存在，重新计算回收的宽限期
+			db.TouchImg(pq, sum)
+		} else {
 			//新的client_hash
 			guid := xid.New().String()
 			img.Owner = coinName
 			img.GUID = guid
-			//临时保存原图到路径：./files/udata/鸟币号/pic/鸟币号_guid-original.jpg
-			pid := coinName + "_" + guid
-			meta := db.NewJPGMeta(pid+conf.PicNameSuffixOriginal, 0, 0)
-			dirOriginal := db.GetUserPicDir(coinName, meta)
-			_, err = util.SaveFileTo(file, dirOriginal)
+			img.Focus = focuses[i]
+			//临时保存原图：鸟币号/pic/鸟币号_guid-original.jpg，按EXIF方向旋转并去除GPS等元数据后保存
+			data, err = db.NormalizePic(data)
+			if err != nil {
+				continue
+			}
+			keyOriginal := getOriginalPicKey(coinName, guid)
+			err = db.PicStore.Put(keyOriginal, data)
 			if err != nil {
 				continue
 			}
-			img.OriginalDir = dirOriginal
+			img.OriginalKey = keyOriginal
 		}
 		imgs = append(imgs, &img)
 	}
@@ -101,12 +147,20 @@ func NewSkill(ctx context.Context, form model.NewSkillForm) {
 	//出错时删除原图
 	var delOnErr = func() {
 		for _, img := range imgs {
-			os.Remove(img.OriginalDir)
+			if img.OriginalKey != "" {
+				db.PicStore.Delete(img.OriginalKey)
+			}
 		}
 	}
 
 	//插入数据库
-	skill := db.Skill{Owner: coinName, Title: form.Title, Price: form.Price, Desc: form.Desc, Tags: form.Tags, Pics: []*db.Pic{}, IsOpen: true}
+	skill := db.Skill{Owner: coinName, Title: form.Title, Price: form.Price, Desc: form.Desc, Tags: tags, Tiers: tiers, Pics: []*db.Pic{}, IsOpen: true, ServiceKm: form.ServiceKm, IsRemote: form.IsRemote}
+	skill.SetLocation(form.HasLoc, form.Lat, form.Lng, form.Area, form.Privacy)
+	if form.HasStock {
+		//库存为0时不上架
+		skill.HasStock, skill.Stock, skill.IsOpen = true, form.Stock, form.Stock > 0
+	}
+	skill.SetTerms()
 	affected, err := pq.UseBool().Insert(&skill)
 	if err != nil {
 		delOnErr()
@@ -117,12 +171,24 @@ func NewSkill(ctx context.Context, form model.NewSkillForm) {
 		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1004)
 	}
 
-	ctx.JSON(&skill)
-
-	if len(imgs) == 0 {
-		return
+	//加入图片处理任务，缩略图生成后更新技能的图片，可通过/img/job/{id}查询
+	res := model.SkillJobRes{Skill: &skill}
+	if len(imgs) > 0 {
+		job, err := NewImgJob(pq, config.ImgJobSkill, coinName, skill.ID, imgs)
+		if err != nil {
+			delOnErr()
+			e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		}
+		res.JobID = job.ID
 	}
-	GenThumbnails(pq, imgs, coinName, &skill)
+
+	ctx.JSON(&res)
+
+	//技能保存成功后新建不存在的标签，并更新标签的技能数量
+	go func() {
+		db.CreateTags(pq, skill.Tags)
+		db.UpdateTagSkillNum(pq, skill.Tags)
+	}()
 }
 
 //UpdateSkill 更新技能
@@ -145,11 +211,22 @@ func UpdateSkill(ctx context.Context, form model.UpdateSkillForm) {
 	//检查是否是本人账号更新
 	sid := form.SkillID
 	skill := db.Skill{ID: sid, Owner: coinName}
-	has, err := pq.Cols("version").Get(&skill)
+	has, err := pq.Cols("version", "title", "price", "desc", "tags", "is_open", "has_stock", "stock").Get(&skill)
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 	if has == false {
 		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1037)
 	}
+	oldSkill := skill
+
+	//转换为规范的标签名称
+	tags, err := db.NormalizeTags(pq, form.Tags)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	//价格档位的数量不能重复
+	tiers, ok := model.PriceTiers(form.Tiers)
+	if ok == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1056)
+	}
 
 	pics := []*db.Pic{}
 	if len(form.Pics) > 0 {
@@ -163,14 +240,80 @@ func UpdateSkill(ctx context.Context, form model.UpdateSkillForm) {
 		}
 	}
 
-	skill = db.Skill{Price: form.Price, Desc: form.Desc, Tags: form.Tags, Pics: pics, Version: skill.Version}
-	affected, err := pq.ID(sid).Update(&skill)
+	skill = db.Skill{Price: form.Price, Desc: form.Desc, Tags: tags, Tiers: tiers, Pics: pics, Version: skill.Version}
+	//价格档位为零值时也要更新，以便清除
+	mustCols := []string{"tiers"}
+	//位置、服务半径和远程只在传入时更新，为零值时也要更新，以便清除
+	if form.HasLoc != nil {
+		if *form.HasLoc && form.Lat == 0 && form.Lng == 0 {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1094)
+		}
+		skill.SetLocation(*form.HasLoc, form.Lat, form.Lng, form.Area, form.Privacy)
+		mustCols = append(mustCols, "has_loc", "lat", "lng", "area", "privacy")
+	}
+	if form.ServiceKm != nil {
+		skill.ServiceKm = *form.ServiceKm
+		mustCols = append(mustCols, "service_km")
+	}
+	if form.IsRemote != nil {
+		skill.IsRemote = *form.IsRemote
+		mustCols = append(mustCols, "is_remote")
+	}
+	//库存同样只在传入时更新，只传stock时使用原来的hasStock
+	if form.HasStock != nil || form.Stock != nil {
+		skill.HasStock, skill.Stock = oldSkill.HasStock, oldSkill.Stock
+		if form.HasStock != nil {
+			skill.HasStock = *form.HasStock
+		}
+		if form.Stock != nil {
+			skill.Stock = *form.Stock
+		}
+		if skill.HasStock == false {
+			skill.Stock = 0
+		}
+		mustCols = append(mustCols, "has_stock", "stock")
+	}
+	if skill.HasStock {
+		if skill.Stock == 0 {
+			//库存为0时下架
+			mustCols = append(mustCols, "is_open")
+		} else if oldSkill.HasStock && oldSkill.Stock == 0 && oldSkill.IsOpen == false {
+			//售罄自动下架的技能，补货后自动上架
+			skill.IsOpen = true
+			mustCols = append(mustCols, "is_open")
+		}
+	}
+
+	//更新全文搜索的分词，空字段不会更新到数据库，所以使用原来的值
+	termSkill := db.Skill{Title: oldSkill.Title, Desc: form.Desc, Tags: tags}
+	if termSkill.Desc == "" {
+		termSkill.Desc = oldSkill.Desc
+	}
+	if len(termSkill.Tags) == 0 {
+		termSkill.Tags = oldSkill.Tags
+	}
+	termSkill.SetTerms()
+	skill.Terms = termSkill.Terms
+
+	affected, err := pq.ID(sid).MustCols(mustCols...).Update(&skill)
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 	if affected == 0 {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1039)
 	}
 
+	//降价后套餐的总价可能不再低于技能单价之和，下架这些套餐
+	if skill.Price < oldSkill.Price {
+		err = closeOverpricedBundles(pq, coinName, sid)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	}
+
 	ctx.JSON(&model.UpdateRes{Ok: true})
+
+	//技能保存成功后新建不存在的标签，并更新标签的技能数量，库存变化导致上架或下架时也需要重新统计
+	go func() {
+		db.CreateTags(pq, tags)
+		db.UpdateTagSkillNum(pq, append(oldSkill.Tags, tags...))
+	}()
 }
 
 //OpenSkill 上架下架技能
@@ -194,11 +337,15 @@ func OpenSkill(ctx context.Context) {
 
 	//检查是否是本人账号操作
 	skill := db.Skill{ID: sid, Owner: coinName}
-	has, err := pq.Cols("version").Get(&skill)
+	has, err := pq.Cols("version", "has_stock", "stock").Get(&skill)
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
 	if has == false {
 		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1037)
 	}
+	//库存为0时不能上架，需先补货
+	if open && skill.HasStock && skill.Stock == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1052)
+	}
 
 	//上架下架
 	skill.IsOpen = open
@@ -209,6 +356,11 @@ func OpenSkill(ctx context.Context) {
 	}
 
 	ctx.JSON(&model.UpdateRes{Ok: true})
+
+	//更新标签的技能数量
+	tagSkill := db.Skill{}
+	pq.ID(sid).Cols("tags").Get(&tagSkill)
+	go db.UpdateTagSkillNum(pq, tagSkill.Tags)
 }
 
 //DeleteSkill 删除技能
@@ -236,6 +388,11 @@ func DeleteSkill(ctx context.Context) {
 		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1037)
 	}
 
+	//删除前获取标签，用于更新标签的技能数量
+	tagSkill := db.Skill{}
+	_, err = pq.ID(sid).Cols("tags").Get(&tagSkill)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
 	//删除
 	affected, err := pq.Delete(&skill)
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
@@ -244,4 +401,372 @@ func DeleteSkill(ctx context.Context) {
 	}
 
 	ctx.JSON(&model.UpdateRes{Ok: true})
+
+	//更新标签的技能数量
+	go db.UpdateTagSkillNum(pq, tagSkill.Tags)
+}
+
+//GetSkillList 获取某用户的技能列表
+//别人只能看到上架的技能，本人可以使用参数closed=true、deleted=true同时获取下架和已删除的技能
+func GetSkillList(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	name := ctx.Params().Get("name")
+
+	isOwner := name == coinName
+	withClosed, _ := ctx.URLParamBool("closed")
+	withDeleted, _ := ctx.URLParamBool("deleted")
+
+	session := pq.Where("owner = ?", name)
+	if isOwner == false || withClosed == false {
+		session = session.And("is_open = ?", true)
+	}
+	if isOwner && withDeleted {
+		session = session.Unscoped()
+	}
+	skills := []*db.Skill{}
+	err := session.Desc("id").Find(&skills)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	res, err := getSkillsWithSnaps(pq, skills)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&res)
+}
+
+//GetSkill 获取技能详情
+//别人只能看到上架的技能，本人可以看到下架和已删除的技能
+func GetSkill(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	sid := ctx.Params().GetUint64Default("id", 0)
+
+	skill := db.Skill{}
+	has, err := pq.ID(sid).Unscoped().Get(&skill)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1037)
+	}
+	if skill.Owner != coinName && (skill.IsOpen == false || skill.Deleted.IsZero() == false) {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1037)
+	}
+
+	res, err := getSkillsWithSnaps(pq, []*db.Skill{&skill})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(res[0])
+}
+
+//GetSkillVersions 获取技能的版本历史，以及当前用户持有的鸟币所包含的版本
+func GetSkillVersions(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	sid := ctx.Params().GetUint64Default("id", 0)
+
+	skill, held := getHeldSkill(ctx, pq, sid, coinName)
+
+	snaps := []*db.Snap{}
+	err := pq.Where("skill_id = ?", sid).Desc("version").Find(&snaps)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	res := model.SkillVersionsRes{SkillID: sid, Version: skill.Version, Held: []uint64{}, Versions: snaps}
+	for _, snap := range snaps {
+		if held[snap.ID] {
+			res.Held = append(res.Held, snap.Version)
+		}
+	}
+
+	ctx.JSON(&res)
+}
+
+//GetSkillDiff 比较技能的两个版本：价格、描述、标签、图片
+func GetSkillDiff(ctx context.Context, form model.SkillDiffForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	sid := ctx.Params().GetUint64Default("id", 0)
+
+	skill, _ := getHeldSkill(ctx, pq, sid, coinName)
+	to := form.To
+	if to == 0 {
+		to = skill.Version
+	}
+
+	//获取两个版本的技能快照
+	var getVersion = func(version uint64) *db.Snap {
+		snap := db.Snap{SkillID: sid, Version: version}
+		has, err := pq.Get(&snap)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if has {
+			return &snap
+		}
+		//最新版本的技能可能尚未生成快照（发币时才生成）
+		if version == skill.Version {
+			snap := skill.NewSnap()
+			return &snap
+		}
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1046)
+		return nil
+	}
+	fromSnap := getVersion(form.From)
+	toSnap := getVersion(to)
+
+	res := model.SkillDiffRes{SkillID: sid, From: form.From, To: to}
+	if fromSnap.Price != toSnap.Price {
+		res.Price = &model.PriceDiff{From: fromSnap.Price, To: toSnap.Price}
+	}
+	if fromSnap.Desc != toSnap.Desc {
+		res.Desc = util.DiffText(fromSnap.Desc, toSnap.Desc)
+	}
+	added, removed := util.DiffList(fromSnap.Tags, toSnap.Tags)
+	if len(added) > 0 || len(removed) > 0 {
+		res.Tags = &model.ListDiff{Added: added, Removed: removed}
+	}
+
+	//图片使用原图hash比较
+	guids := []string{}
+	for _, pic := range append(fromSnap.Pics, toSnap.Pics...) {
+		if pic != nil {
+			guids = append(guids, pic.GUID())
+		}
+	}
+	hashes := map[string]string{}
+	if len(guids) > 0 {
+		imgs := []*db.Img{}
+		err := pq.In("guid", guids).Find(&imgs)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		for _, img := range imgs {
+			hashes[img.GUID] = img.Hash
+		}
+	}
+	var picHashes = func(pics []*db.Pic) []string {
+		res := []string{}
+		for _, pic := range pics {
+			if pic == nil {
+				continue
+			}
+			guid := pic.GUID()
+			if hash, ok := hashes[guid]; ok {
+				res = append(res, hash)
+			} else {
+				res = append(res, guid)
+			}
+		}
+		return res
+	}
+	added, removed = util.DiffList(picHashes(fromSnap.Pics), picHashes(toSnap.Pics))
+	if len(added) > 0 || len(removed) > 0 {
+		res.Pics = &model.ListDiff{Added: added, Removed: removed}
+	}
+
+	ctx.JSON(&res)
+}
+
+//getHeldSkill 获取技能，以及当前用户持有的此技能所属鸟币的快照id
+//本人、技能上架中、或者持有此鸟币的用户才可以查看
+func getHeldSkill(ctx context.Context, pq *xorm.Engine, sid uint64, coinName string) (db.Skill, map[uint64]bool) {
+	e := new(model.CommonError)
+
+	skill := db.Skill{}
+	has, err := pq.ID(sid).Unscoped().Get(&skill)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1037)
+	}
+
+	held := map[uint64]bool{}
+	subsums := []*db.SubSum{}
+	err = pq.Where("bearer = ? and coin = ? and sum > ?", coinName, skill.Owner, 0).Find(&subsums)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	for _, subsum := range subsums {
+		for _, id := range subsum.SnapIDs {
+			held[id] = true
+		}
+	}
+
+	isPublic := skill.IsOpen && skill.Deleted.IsZero()
+	if skill.Owner != coinName && isPublic == false && len(held) == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1037)
+	}
+	return skill, held
+}
+
+//getSkillsWithSnaps 查询技能的快照历史
+func getSkillsWithSnaps(pq *xorm.Engine, skills []*db.Skill) ([]*model.SkillRes, error) {
+	res := []*model.SkillRes{}
+	if len(skills) == 0 {
+		return res, nil
+	}
+
+	ids := []uint64{}
+	for _, skill := range skills {
+		ids = append(ids, skill.ID)
+	}
+	snaps := []*db.Snap{}
+	err := pq.In("skill_id", ids).Desc("version").Find(&snaps)
+	if err != nil {
+		return nil, err
+	}
+	skillSnaps := map[uint64][]*db.Snap{}
+	for _, snap := range snaps {
+		skillSnaps[snap.SkillID] = append(skillSnaps[snap.SkillID], snap)
+	}
+
+	for _, skill := range skills {
+		item := model.SkillRes{Skill: skill, IsDeleted: skill.Deleted.IsZero() == false, Snaps: skillSnaps[skill.ID]}
+		if item.Snaps == nil {
+			item.Snaps = []*db.Snap{}
+		}
+		res = append(res, &item)
+	}
+	return res, nil
+}
+
+//SearchSkill 搜索技能，仅搜索上架且未删除的技能
+//关键字使用postgres全文搜索（分词见util.SearchTerms），标签使用jsonb包含查询，分页使用游标
+func SearchSkill(ctx context.Context, form model.SearchSkillForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+
+	//-----参数整理-----
+	query := util.SearchQuery(form.Q)
+	sort := form.Sort
+	if sort == "" || (sort == "relevance" && query == "") {
+		sort = "newest"
+		if query != "" {
+			sort = "relevance"
+		}
+	}
+	limit := form.Limit
+	if limit == 0 {
+		limit = 20
+	}
+	cursor := model.SkillCursor{}
+	if form.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(form.Cursor)
+		e.CheckError(ctx, err, iris.StatusNotAcceptable, config.Public.Err.E1002, nil)
+		err = json.Unmarshal(data, &cursor)
+		e.CheckError(ctx, err, iris.StatusNotAcceptable, config.Public.Err.E1002, nil)
+	}
+
+	//-----查询条件-----
+	tsv := "to_tsvector('simple', coalesce(terms, ''))"
+	rank := "0"
+	rankArgs := []interface{}{}
+	conds := []string{"is_open = true", "(deleted IS NULL OR deleted = '0001-01-01 00:00:00')"}
+	args := []interface{}{}
+	if query != "" {
+		//相关度保留6位小数（numeric），排序和游标比较使用同一个精确值
+		rank = "round(ts_rank(" + tsv + ", plainto_tsquery('simple', ?))::numeric, 6)"
+		rankArgs = append(rankArgs, query)
+		conds = append(conds, tsv+" @@ plainto_tsquery('simple', ?)")
+		args = append(args, query)
+	}
+	if len(form.Tags) > 0 {
+		data, _ := json.Marshal(form.Tags)
+		conds = append(conds, "tags @> ?")
+		args = append(args, exbytes.ToString(data))
+	}
+	if form.Min > 0 {
+		conds = append(conds, "price >= ?")
+		args = append(args, form.Min)
+	}
+	if form.Max > 0 {
+		conds = append(conds, "price <= ?")
+		args = append(args, form.Max)
+	}
+	if form.Owner != "" {
+		conds = append(conds, "owner = ?")
+		args = append(args, form.Owner)
+	}
+
+	//-----排序和游标-----
+	order := "id DESC"
+	switch sort {
+	case "relevance":
+		order = "rank DESC, id DESC"
+		if cursor.ID > 0 {
+			_, err := strconv.ParseFloat(cursor.Rank, 64)
+			e.CheckError(ctx, err, iris.StatusNotAcceptable, config.Public.Err.E1002, nil)
+			conds = append(conds, "("+rank+" < ?::numeric OR ("+rank+" = ?::numeric AND id < ?))")
+			args = append(args, query, cursor.Rank, query, cursor.Rank, cursor.ID)
+		}
+	case "price":
+		order = "price ASC, id ASC"
+		if cursor.ID > 0 {
+			conds = append(conds, "(price > ? OR (price = ? AND id > ?))")
+			args = append(args, cursor.Price, cursor.Price, cursor.ID)
+		}
+	case "-price":
+		order = "price DESC, id DESC"
+		if cursor.ID > 0 {
+			conds = append(conds, "(price < ? OR (price = ? AND id < ?))")
+			args = append(args, cursor.Price, cursor.Price, cursor.ID)
+		}
+	default:
+		if cursor.ID > 0 {
+			conds = append(conds, "id < ?")
+			args = append(args, cursor.ID)
+		}
+	}
+
+	//多取一条，用来判断是否还有下一页
+	sql := fmt.Sprintf("SELECT *, %s AS rank FROM skill WHERE %s ORDER BY %s LIMIT %d", rank, strings.Join(conds, " AND "), order, limit+1)
+	items := []*model.SkillSearchItem{}
+	err := pq.SQL(sql, append(rankArgs, args...)...).Find(&items)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	res := model.SearchSkillRes{Skills: items}
+	if len(items) > limit {
+		res.Skills = items[:limit]
+		last := res.Skills[limit-1]
+		data, _ := json.Marshal(model.SkillCursor{ID: last.ID, Rank: strconv.FormatFloat(last.Rank, 'f', 6, 64), Price: last.Price})
+		res.Next = base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	ctx.JSON(&res)
+}
+
+//NearbySkill 搜索附近的技能，按距离排序
+//先用经纬度范围通过索引过滤，再用haversine公式计算距离，不依赖PostGIS。技能设置了服务半径时，超出服务半径的不返回
+func NearbySkill(ctx context.Context, form model.NearbySkillForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+
+	lat, lng := *form.Lat, *form.Lng
+	km := form.Km
+	if km == 0 {
+		km = 10
+	}
+	limit := form.Limit
+	if limit == 0 {
+		limit = 20
+	}
+
+	conds := []string{"has_loc = true", "is_open = true", "(deleted IS NULL OR deleted = '0001-01-01 00:00:00')"}
+	latMin, latMax, lngMin, lngMax := util.BoundingBox(lat, lng, km)
+	conds = append(conds, "lat BETWEEN ? AND ?")
+	args := []interface{}{latMin, latMax}
+	if lngMin <= lngMax {
+		conds = append(conds, "lng BETWEEN ? AND ?")
+	} else {
+		//跨越±180度经线
+		conds = append(conds, "(lng >= ? OR lng <= ?)")
+	}
+	args = append(args, lngMin, lngMax)
+
+	//haversine公式，least防止浮点误差导致asin参数大于1
+	distance := fmt.Sprintf("%f * 2 * asin(least(1, sqrt(power(sin(radians(lat - ?) / 2), 2) + cos(radians(?)) * cos(radians(lat)) * power(sin(radians(lng - ?) / 2), 2))))", util.EarthRadiusKm)
+	sql := fmt.Sprintf("SELECT * FROM (SELECT *, %s AS distance FROM skill WHERE %s) AS s WHERE distance <= ? AND (service_km = 0 OR distance <= service_km) ORDER BY distance ASC, id DESC LIMIT %d", distance, strings.Join(conds, " AND "), limit)
+	args = append([]interface{}{lat, lat, lng}, args...)
+	args = append(args, km)
+
+	items := []*model.SkillNearbyItem{}
+	err := pq.SQL(sql, args...).Find(&items)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&items)
 }
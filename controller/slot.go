@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+	"reqing.org/niaobi-go/util"
+)
+
+//NewSlots 发布技能的可预约时段，时段不能与本人已发布的时段重叠
+func NewSlots(ctx context.Context, form model.NewSlotsForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	lock := GetTxLocks(ctx)
+
+	//转账和技能不能同时处理，同时也避免并发发布重叠的时段
+	if lock.Locks[coinName] == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1019)
+	}
+	lock.Locks[coinName] = true
+	defer func() {
+		delete(lock.Locks, coinName)
+	}()
+
+	//检查是否是本人的技能
+	has, err := pq.Exist(&db.Skill{ID: form.SkillID, Owner: coinName})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1037)
+	}
+
+	now := time.Now()
+	slots := []*db.Slot{}
+	for i, s := range form.Slots {
+		if s.Start.Before(now) {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1051)
+		}
+		//本次发布的时段之间不能重叠
+		for _, other := range form.Slots[:i] {
+			if s.Start.Before(other.End) && s.End.After(other.Start) {
+				e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1051)
+			}
+		}
+		//不能与已发布的时段重叠
+		has, err := pq.Where("owner = ? AND start_at < ? AND end_at > ?", coinName, s.End, s.Start).Exist(&db.Slot{})
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		if has == true {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1051)
+		}
+		slots = append(slots, &db.Slot{SkillID: form.SkillID, Owner: coinName, Start: s.Start, End: s.End})
+	}
+
+	_, err = pq.Insert(&slots)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&slots)
+}
+
+//GetSlots 获取技能尚未结束的时段，按开始时间排列
+//预约者的鸟币号仅发行者本人和预约者可以看到
+func GetSlots(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	sid := ctx.Params().GetUint64Default("id", 0)
+
+	slots := []*db.Slot{}
+	err := pq.Where("skill_id = ? AND end_at > ?", sid, time.Now()).Asc("start_at").Find(&slots)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	for _, slot := range slots {
+		if slot.Owner != coinName && slot.Bearer != coinName {
+			slot.ReqID = 0
+			slot.Bearer = ""
+		}
+	}
+
+	ctx.JSON(&slots)
+}
+
+//DeleteSlot 删除时段，仅可删除尚未被预约的时段
+func DeleteSlot(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	//条件删除，避免删除时段的同时被预约
+	res, err := pq.Exec("DELETE FROM slot WHERE id = ? AND owner = ? AND state = 0", id, coinName)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	affected, err := res.RowsAffected()
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if affected == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1050)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//GetCalendarURL 获取自己的预约日历订阅地址
+func GetCalendarURL(ctx context.Context) {
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	url := fmt.Sprintf("/cal/%s/%s.ics", coinName, calendarToken(coinName))
+	ctx.JSON(&model.CalendarRes{URL: url})
+}
+
+//GetCalendar 预约日历，iCalendar(.ics)格式，包含尚未结束的已确认预约
+//日历软件订阅时不能携带jwt，所以使用地址中的签名验证
+func GetCalendar(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	name := ctx.Params().Get("name")
+	token := strings.TrimSuffix(ctx.Params().Get("token"), ".ics")
+
+	if hmac.Equal([]byte(token), []byte(calendarToken(name))) == false {
+		e.ReturnError(ctx, iris.StatusUnauthorized, config.Public.Err.E1010)
+	}
+
+	slots := []*db.Slot{}
+	err := pq.Where("state = 2 AND end_at > ? AND (owner = ? OR bearer = ?)", time.Now(), name, name).Asc("start_at").Limit(500).Find(&slots)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	titles, err := getSkillTitles(pq, slots)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	events := []util.ICSEvent{}
+	for _, slot := range slots {
+		buddy := slot.Bearer
+		if slot.Bearer == name {
+			buddy = slot.Owner
+		}
+		events = append(events, util.ICSEvent{
+			UID:     fmt.Sprintf("slot-%d@niaobi.org", slot.ID),
+			Start:   slot.Start,
+			End:     slot.End,
+			Summary: fmt.Sprintf(config.Public.Tips.T1010, titles[slot.SkillID], buddy),
+			Updated: slot.Updated,
+		})
+	}
+
+	ctx.ContentType("text/calendar; charset=utf-8")
+	ctx.WriteString(util.ICalendar(config.Public.Tips.T1009, events))
+}
+
+//calendarToken 预约日历地址的签名
+func calendarToken(coinName string) string {
+	mac := hmac.New(sha256.New, []byte(config.JWTSecret))
+	mac.Write([]byte("calendar:" + coinName))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+//getSkillTitles 获取时段对应的技能名称，包含已删除的技能
+func getSkillTitles(pq *xorm.Engine, slots []*db.Slot) (map[uint64]string, error) {
+	titles := map[uint64]string{}
+	if len(slots) == 0 {
+		return titles, nil
+	}
+	ids := []uint64{}
+	for _, slot := range slots {
+		ids = append(ids, slot.SkillID)
+	}
+	skills := []*db.Skill{}
+	err := pq.Unscoped().In("id", ids).Cols("id", "title").Find(&skills)
+	for _, skill := range skills {
+		titles[skill.ID] = skill.Title
+	}
+	return titles, err
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"github.com/thinkeridea/go-extend/exbytes"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+)
+
+//SuggestTags 标签自动补全，按名称或别名的前缀匹配，上架技能多的标签排在前面
+func SuggestTags(ctx context.Context, form model.TagSuggestForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+
+	//转义like的通配符
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(db.TagNorm(form.Q)) + "%"
+	tags := []*db.Tag{}
+	err := pq.Where("norm LIKE ? OR EXISTS (SELECT 1 FROM jsonb_array_elements_text(aliases) AS a(alias) WHERE a.alias LIKE ?)", prefix, prefix).Desc("skill_num").Asc("norm").Limit(10).Find(&tags)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&tags)
+}
+
+//MergeTags 合并重复的标签（管理员）
+//被合并的标签成为保留标签的别名，并改写已有技能（包括下架和已删除的技能）的标签。技能快照不可修改，保持原样
+func MergeTags(ctx context.Context, form model.MergeTagForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	if IsAdmin(coinName) == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1047)
+	}
+
+	//保留的标签
+	into := db.Tag{}
+	has, err := pq.Where("norm = ?", db.TagNorm(form.Into)).Get(&into)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1048)
+	}
+
+	//被合并的标签
+	norms := []string{}
+	for _, name := range form.From {
+		if norm := db.TagNorm(name); norm != into.Norm {
+			norms = append(norms, norm)
+		}
+	}
+	froms := []*db.Tag{}
+	if len(norms) > 0 {
+		err = pq.In("norm", norms).Find(&froms)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	}
+	if len(froms) == 0 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1048)
+	}
+
+	//合并别名
+	aliases := []string{}
+	exist := map[string]bool{into.Norm: true}
+	var addAlias = func(alias string) {
+		if exist[alias] == false {
+			exist[alias] = true
+			aliases = append(aliases, alias)
+		}
+	}
+	for _, alias := range into.Aliases {
+		addAlias(alias)
+	}
+	fromNames := map[string]bool{}
+	for _, from := range froms {
+		fromNames[from.Name] = true
+		addAlias(from.Norm)
+		for _, alias := range from.Aliases {
+			addAlias(alias)
+		}
+	}
+
+	//需要改写标签的技能
+	skills := map[uint64]*db.Skill{}
+	for _, from := range froms {
+		data, _ := json.Marshal([]string{from.Name})
+		found := []*db.Skill{}
+		err = pq.Unscoped().Where("tags @> ?", exbytes.ToString(data)).Cols("id", "title", "desc", "tags").Find(&found)
+		e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+		for _, skill := range found {
+			skills[skill.ID] = skill
+		}
+	}
+
+	//数据库事务
+	//处理skill表、tag表
+	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		//改写技能标签，直接更新，避免version自增
+		for _, skill := range skills {
+			tags := []string{}
+			added := false
+			for _, tag := range skill.Tags {
+				if fromNames[tag] || tag == into.Name {
+					if added {
+						continue
+					}
+					tag = into.Name
+					added = true
+				}
+				tags = append(tags, tag)
+			}
+			skill.Tags = tags
+			skill.SetTerms()
+			data, _ := json.Marshal(tags)
+			_, err := session.Exec("UPDATE skill SET tags = ?, terms = ? WHERE id = ?", exbytes.ToString(data), skill.Terms, skill.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		//更新别名
+		_, err := session.ID(into.ID).Cols("aliases").Update(&db.Tag{Aliases: aliases})
+		if err != nil {
+			return nil, err
+		}
+
+		//删除被合并的标签
+		for _, from := range froms {
+			_, err = session.ID(from.ID).Delete(new(db.Tag))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+
+	//更新标签的技能数量
+	go db.UpdateTagSkillNum(pq, []string{into.Name})
+}
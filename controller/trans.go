@@ -26,9 +26,34 @@ import (
 
 //NewPay 发行或转手鸟币
 func NewPay(ctx context.Context, form model.NewPayForm) {
-	e := new(model.CommonError)
 	pq := GetPQ(ctx)
 	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	//按收款单付款，由收款单确定收款方、鸟币和数额
+	var invoice *db.Invoice
+	if form.InvoiceID > 0 {
+		invoice = fillInvoicePay(ctx, pq, &form)
+	}
+	txPay(ctx, coinName, &form, paySource{invoice: invoice})
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+
+	//更新coin表的个人统计
+	UpdateInfo(pq, coinName)
+}
+
+//paySource 转账的来源，均为空时为普通转账
+type paySource struct {
+	invoice *db.Invoice  //按收款单付款
+	voucher *db.Voucher  //领取代金券，代金券在创建时签名，转账时不再检查签名
+	gift    *db.GiftCode //领取兑换码，发行者在创建批次时签名，领取时检查批次的签名（见ClaimGift）
+}
+
+//txPay 执行转账：coinName为付款方，form为转账参数，src为转账的来源
+func txPay(ctx context.Context, coinName string, form *model.NewPayForm, src paySource) {
+	e := new(model.CommonError)
+	invoice, voucher, gift := src.invoice, src.voucher, src.gift
+	pq := GetPQ(ctx)
 	lock := GetTxLocks(ctx)
 
 	var checkDBErr = func(err error) {
@@ -116,7 +141,11 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 
 	//2.参数准备，pay表、sum表、subsum表、snap表、snap_set表
 	//---新建pay记录---
-	pay := db.Pay{Amount: form.Amount, TransCoin: txCoinName, Receiver: receiverName, Payer: payerName, IsIssue: isIssue, IsMarker: form.IsMarker, GUID: xid.New().String()}
+	pay := db.Pay{Amount: form.Amount, TransCoin: txCoinName, Receiver: receiverName, Payer: payerName, IsIssue: isIssue, IsMarker: form.IsMarker, GUID: xid.New().String(), InvoiceID: form.InvoiceID, Memo: form.Memo, Sig: form.Sig, SignedAt: form.SignedAt}
+	//已登记公钥的付款方须签名，签名与pay记录一起保存
+	if voucher == nil && gift == nil {
+		pay.KeyID = checkTxSig(ctx, pq, payerName, config.NewsTablePay, pay.Sig, pay.SignedAt, payTxMessage(&pay, pay.Amount))
+	}
 	//payer鸟币数量减少，receiver鸟币数量增加
 	payerAdd := -int64(form.Amount)
 	receiverAdd := int64(form.Amount)
@@ -134,9 +163,13 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 		affected, err := pq.InsertOne(&payerSum)
 		checkInsertErr(affected, err)
 	}
-	//检查转手的鸟币数量是否足够
+	//检查转手的鸟币数量是否足够，代金券预留的鸟币不可使用（领取代金券时可使用此代金券预留的鸟币）
 	if state == 3 || state == 4 {
-		if payerSum.Sum < int64(form.Amount) {
+		reserved := payerSum.Reserved
+		if voucher != nil {
+			reserved -= int64(voucher.Amount)
+		}
+		if payerSum.Sum-reserved < int64(form.Amount) {
 			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1023)
 		}
 	}
@@ -171,6 +204,7 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 		}
 		//拼接snap_ids
 		snapIDs := []uint64{}
+		skillSnapIDs := map[uint64]uint64{} //技能ID对应的快照ID，用于生成套餐快照
 		for i := 0; i < skillNum; i++ {
 			snapSetValue += skills[i].Price
 			//是否需要新建snap记录。若不存在可以提前插入数据库，不用加入到事务
@@ -179,7 +213,37 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 			checkDBErr(err)
 			if has == false {
 				//新建snap
-				snap = db.Snap{Owner: payerName, Title: skills[i].Title, Price: skills[i].Price, Desc: skills[i].Desc, Tags: skills[i].Tags, Pics: skills[i].Pics, SkillID: skills[i].ID, Version: skills[i].Version}
+				snap = skills[i].NewSnap()
+				affected, err := pq.InsertOne(&snap)
+				checkInsertErr(affected, err)
+			}
+			snapIDs = append(snapIDs, snap.ID)
+			skillSnapIDs[skills[i].ID] = snap.ID
+		}
+		//上架的套餐同样加入snap_ids，套餐包含的技能须全部上架
+		bundles := []db.Bundle{}
+		err = pq.Where("owner = ? and is_open = ?", payerName, true).UseBool().Find(&bundles)
+		checkDBErr(err)
+		for i := range bundles {
+			items := []uint64{}
+			for _, sid := range bundles[i].SkillIDs {
+				if snapID, ok := skillSnapIDs[sid]; ok {
+					items = append(items, snapID)
+				}
+			}
+			if len(items) != len(bundles[i].SkillIDs) {
+				continue
+			}
+			snapSetValue += bundles[i].Price
+			//套餐未更新时，所包含的技能也可能已更新，所以需要同时比较items
+			data, err := json.Marshal(items)
+			checkDBErr(err)
+			snap := db.Snap{}
+			has, err := pq.Where("bundle_id = ? and version = ? and items = ?::jsonb", bundles[i].ID, bundles[i].Version, exbytes.ToString(data)).Cols("id").Get(&snap)
+			checkDBErr(err)
+			if has == false {
+				//新建套餐snap
+				snap = bundles[i].NewSnap(items)
 				affected, err := pq.InsertOne(&snap)
 				checkInsertErr(affected, err)
 			}
@@ -202,7 +266,7 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 		has, err = pq.Get(&issuerSS)
 		checkDBErr(err)
 		if has == false {
-			issuerSS = db.SnapSet{Owner: payerName, Md5: strMd5, SnapIDs: snapIDs, Value: snapSetValue, Count: uint32(skillNum)}
+			issuerSS = db.SnapSet{Owner: payerName, Md5: strMd5, SnapIDs: snapIDs, Value: snapSetValue, Count: uint32(len(snapIDs))}
 			affected, err := pq.InsertOne(&issuerSS)
 			checkInsertErr(affected, err)
 		}
@@ -240,7 +304,7 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 		limit := 10 //每次获取10条
 		start := 0
 		breakNow := false
-		guid := xid.New().String()
+		guid := pay.GUID
 		leftAmount := int64(form.Amount)
 	Exit:
 		for {
@@ -307,7 +371,7 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 				if has == false {
 					e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1031)
 				}
-				mutiPay := db.Pay{TransCoin: txCoinName, Receiver: receiverName, Payer: payerName, IsIssue: isIssue, IsMarker: form.IsMarker, GUID: guid, SnapSetID: issuerSS.ID, Amount: uint64(receiverSubSumAdd)}
+				mutiPay := db.Pay{TransCoin: txCoinName, Receiver: receiverName, Payer: payerName, IsIssue: isIssue, IsMarker: form.IsMarker, GUID: guid, SnapSetID: issuerSS.ID, Amount: uint64(receiverSubSumAdd), InvoiceID: form.InvoiceID, Memo: form.Memo, KeyID: pay.KeyID, Sig: pay.Sig, SignedAt: pay.SignedAt}
 				pays = append(pays, &mutiPay)
 				if breakNow {
 					break Exit
@@ -318,8 +382,18 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 	}
 
 	//新的news
-	payerNews := db.News{Owner: payerName, Desc: config.Public.Tips.T1000, Amount: payerAdd, Buddy: receiverName}
-	receiverNews := db.News{Owner: receiverName, Desc: config.Public.Tips.T1001, Amount: receiverAdd, Buddy: payerName}
+	payerNews := db.News{Owner: payerName, Desc: config.Public.Tips.T1000, Amount: payerAdd, Buddy: receiverName, Memo: form.Memo}
+	receiverNews := db.News{Owner: receiverName, Desc: config.Public.Tips.T1001, Amount: receiverAdd, Buddy: payerName, Memo: form.Memo}
+	if invoice != nil {
+		payerNews.Desc, payerNews.Table, payerNews.SourceID = config.Public.Tips.T1011, config.NewsTableInvoice, invoice.ID
+		receiverNews.Desc, receiverNews.Table, receiverNews.SourceID = config.Public.Tips.T1012, config.NewsTableInvoice, invoice.ID
+	} else if voucher != nil {
+		payerNews.Desc, payerNews.Table, payerNews.SourceID = config.Public.Tips.T1013, config.NewsTableVoucher, voucher.ID
+		receiverNews.Desc, receiverNews.Table, receiverNews.SourceID = config.Public.Tips.T1014, config.NewsTableVoucher, voucher.ID
+	} else if gift != nil {
+		payerNews.Desc, payerNews.Table, payerNews.SourceID = config.Public.Tips.T1015, config.NewsTableGift, gift.BatchID
+		receiverNews.Desc, receiverNews.Table, receiverNews.SourceID = config.Public.Tips.T1016, config.NewsTableGift, gift.BatchID
+	}
 
 	//是否需要新建info记录
 	var insertInfo = func(record db.Info) {
@@ -334,8 +408,39 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 	insertInfo(db.Info{Owner: receiverName})
 
 	//数据库事务
-	//处理pay表、sum表/sub_sum表、news表/info表
+	//处理pay表、sum表/sub_sum表、news表/info表、invoice表/voucher表/gift_code表
 	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		//收款单已被并发的付款使用、已作废或已过期时回滚
+		if invoice != nil {
+			ok, err := db.PayInvoice(session, invoice.ID)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1075)
+			}
+		}
+		//代金券已被并发的领取使用、已取消或已过期时回滚，领取后释放预留的鸟币
+		if voucher != nil {
+			ok, err := db.ClaimVoucher(session, voucher, receiverName, pay.GUID)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1089)
+			}
+		}
+		//兑换码已被并发的领取使用、领取者已领取过此批次或批次已过期时回滚
+		if gift != nil {
+			ok, err := db.ClaimGiftCode(session, gift, receiverName, pay.GUID)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1091)
+			}
+		}
+
 		//new pay
 		if len(pays) > 0 {
 			//xorm批量插入一次最多150条左右，所以需要分割成多个，这里分割成每次插入20条
@@ -357,6 +462,11 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 				return nil, err
 			}
 		}
+		//追加到账本
+		err = db.AppendLedger(session, config.NewsTablePay, pay.GUID)
+		if err != nil {
+			return nil, err
+		}
 
 		//update sum
 		_, err = session.Id(payerSum.ID).Cols("sum").Update(&payerSum)
@@ -404,12 +514,10 @@ func NewPay(ctx context.Context, form model.NewPayForm) {
 
 		return nil, nil
 	})
+	if err != nil && (err.Error() == config.Public.Err.E1075 || err.Error() == config.Public.Err.E1089 || err.Error() == config.Public.Err.E1091) {
+		e.ReturnError(ctx, iris.StatusOK, err.Error())
+	}
 	checkDBErr(err)
-
-	ctx.JSON(&model.UpdateRes{Ok: true})
-
-	//更新coin表的个人统计
-	UpdateInfo(pq, coinName)
 }
 
 //NewReq 兑现鸟币请求
@@ -444,7 +552,7 @@ func NewReq(ctx context.Context, form model.NewReqForm) {
 	if has == false {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1004)
 	}
-	if sum.Sum < int64(form.Amount) {
+	if sum.Sum-sum.Reserved < int64(form.Amount) {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1023)
 	}
 
@@ -458,16 +566,84 @@ func NewReq(ctx context.Context, form model.NewReqForm) {
 		}
 	}
 
+	//要兑现的技能快照，血盟时忽略
+	snap := db.Snap{}
+	hasSnap := false
+	if form.IsMarker == false {
+		hasSnap, err = pq.ID(form.SnapID).Cols("skill_id", "price", "tiers", "bundle_id", "items").Get(&snap)
+		checkDBErr(err)
+	}
+	//所兑现的技能，套餐时为所包含的技能
+	skillIDs := []uint64{}
+
+	if hasSnap {
+		//兑现数额须为所选价格档位（或套餐价格）的整数倍
+		units, ok := snap.Units(form.Amount, form.TierQty)
+		if ok == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1053)
+		}
+
+		skillIDs, err = snap.SkillIDs(pq)
+		checkDBErr(err)
+
+		//限制库存的技能，兑现数量不能超过剩余库存（接受请求时扣减库存）。套餐的每个技能都扣减相同数量
+		skills := []*db.Skill{}
+		err = pq.In("id", skillIDs).Cols("has_stock", "stock").Find(&skills)
+		checkDBErr(err)
+		for _, skill := range skills {
+			if skill.HasStock && units > skill.Stock {
+				e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1052)
+			}
+		}
+	}
+
+	//预约时段：须为发行者的时段，非血盟时须为所兑现技能的时段。是否可预约在事务中检查
+	if form.SlotID > 0 {
+		slot := db.Slot{ID: form.SlotID, Owner: form.Issuer}
+		has, err = pq.Get(&slot)
+		checkDBErr(err)
+		if has == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1050)
+		}
+		//套餐时须为所包含的某个技能的时段
+		if form.IsMarker == false {
+			matched := false
+			for _, skillID := range skillIDs {
+				if skillID == slot.SkillID {
+					matched = true
+					break
+				}
+			}
+			if matched == false {
+				e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1050)
+			}
+		}
+	}
+
+	//已登记公钥的持有者须签名，签名与req记录一起保存
+	req := db.Req{State: 10, Bearer: coinName, Issuer: form.Issuer, IsMarker: form.IsMarker, SnapID: form.SnapID, Amount: form.Amount, SlotID: form.SlotID, TierQty: form.TierQty, Memo: form.Memo, Sig: form.Sig, SignedAt: form.SignedAt}
+	req.KeyID = checkTxSig(ctx, pq, coinName, config.NewsTableReq, req.Sig, req.SignedAt, reqTxMessage(&req))
+
 	//数据库事务
 	//处理req表、news表/info表
 	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
 		//req
-		req := db.Req{State: 10, Bearer: coinName, Issuer: form.Issuer, IsMarker: form.IsMarker, SnapID: form.SnapID, Amount: form.Amount}
 		_, err := session.InsertOne(&req)
 		if err != nil {
 			return nil, err
 		}
 
+		//占用预约的时段，已被占用时回滚
+		if req.SlotID > 0 {
+			ok, err := db.HoldSlot(session, req.SlotID, req.ID, coinName)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1049)
+			}
+		}
+
 		//news
 		tip1 := config.Public.Req.B10 //请求方提示
 		tip2 := config.Public.Req.I10 //执行方提示
@@ -475,8 +651,8 @@ func NewReq(ctx context.Context, form model.NewReqForm) {
 			tip1 = config.Public.Req.B11 //请求方提示（血盟）
 			tip2 = config.Public.Req.I11 //执行方提示（血盟）
 		}
-		bearerNews := db.News{Owner: coinName, Desc: tip1, Amount: int64(form.Amount), Buddy: form.Issuer, Table: config.NewsTableReq, SourceID: req.ID}
-		issuerNews := db.News{Owner: form.Issuer, Desc: tip2, Amount: int64(form.Amount), Buddy: coinName, Table: config.NewsTableReq, SourceID: req.ID}
+		bearerNews := db.News{Owner: coinName, Desc: tip1, Amount: int64(form.Amount), Buddy: form.Issuer, Table: config.NewsTableReq, SourceID: req.ID, Memo: req.Memo}
+		issuerNews := db.News{Owner: form.Issuer, Desc: tip2, Amount: int64(form.Amount), Buddy: coinName, Table: config.NewsTableReq, SourceID: req.ID, Memo: req.Memo}
 		_, err = session.Insert(&bearerNews, &issuerNews)
 		if err != nil {
 			return nil, err
@@ -514,6 +690,9 @@ func NewReq(ctx context.Context, form model.NewReqForm) {
 
 		return nil, nil
 	})
+	if err != nil && err.Error() == config.Public.Err.E1049 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1049)
+	}
 	checkDBErr(err)
 
 	ctx.JSON(&model.UpdateRes{Ok: true})
@@ -544,7 +723,8 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 	}
 
 	//检查要兑现的技能快照是否存在
-	exist, err = pq.ID(form.SnapID).Exist(&db.Snap{})
+	snap := db.Snap{}
+	exist, err = pq.ID(form.SnapID).Cols("skill_id", "price", "tiers", "bundle_id", "items").Get(&snap)
 	checkDBErr(err)
 	if exist == false {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1032)
@@ -559,9 +739,37 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 	}
 	if req.SnapID != form.SnapID {
 		pq.ID(form.ReqID).UseBool("closed").Update(&db.Req{Closed: true, State: 31})
+		db.FreeSlot(pq, form.ReqID)
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1035)
 	}
 
+	//兑现数额须为请求时所选价格档位（或套餐价格）的整数倍，血盟时忽略
+	units := uint64(0)
+	if form.IsMarker == false {
+		var ok bool
+		units, ok = snap.Units(form.Amount, req.TierQty)
+		if ok == false {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1053)
+		}
+	}
+
+	//限制库存的技能，在事务中扣减库存（血盟时忽略）。套餐的每个技能都扣减相同数量
+	stockSkills := []*db.Skill{}
+	stockTags := []string{}
+	if form.IsMarker == false {
+		skillIDs, err := snap.SkillIDs(pq)
+		checkDBErr(err)
+		skills := []*db.Skill{}
+		err = pq.In("id", skillIDs).Cols("id", "has_stock", "tags").Find(&skills)
+		checkDBErr(err)
+		for _, skill := range skills {
+			if skill.HasStock {
+				stockSkills = append(stockSkills, skill)
+				stockTags = append(stockTags, skill.Tags...)
+			}
+		}
+	}
+
 	//=====参数整理=====
 	issuer := coinName
 	bearer := form.Bearer
@@ -582,7 +790,9 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 	//---------回收鸟币---------
 	//参数准备，repay表、sum表、subsum表
 	//---新建repay记录---
-	repay := db.Repay{ReqID: form.ReqID, SnapID: form.SnapID, Amount: form.Amount, Bearer: bearer, Issuer: issuer, IsMarker: form.IsMarker}
+	repay := db.Repay{ReqID: form.ReqID, SnapID: form.SnapID, GUID: xid.New().String(), Amount: form.Amount, Bearer: bearer, Issuer: issuer, IsMarker: form.IsMarker, Memo: form.Memo, Sig: form.Sig, SignedAt: form.SignedAt}
+	//已登记公钥的发行者须签名，签名与repay记录一起保存
+	repay.KeyID = checkTxSig(ctx, pq, issuer, config.NewsTableRePay, repay.Sig, repay.SignedAt, repayTxMessage(&repay, repay.Amount))
 	//bearer鸟币数量减少，issuer鸟币数量增加
 	bearerAdd := -int64(form.Amount)
 	issuerAdd := int64(form.Amount)
@@ -594,10 +804,11 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 	if has == false {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1004)
 	}
-	//检查持有人是否持有足够的鸟币
-	if bearerSum.Sum < int64(form.Amount) {
+	//检查持有人是否持有足够的鸟币，代金券预留的鸟币不可兑现
+	if bearerSum.Sum-bearerSum.Reserved < int64(form.Amount) {
 		//关闭交易
 		pq.ID(form.ReqID).UseBool("closed").Update(&db.Req{Closed: true, State: 31})
+		db.FreeSlot(pq, form.ReqID)
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1023)
 	}
 	bearerSum.Sum += bearerAdd
@@ -620,7 +831,7 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 		limit := 10 //每次获取10条
 		breakNow := false
 		useOtherSnaps := false
-		guid := xid.New().String()
+		guid := repay.GUID
 		leftAmount := int64(form.Amount)
 		snapID := []uint64{form.SnapID}
 		data, _ := json.Marshal(snapID)
@@ -677,7 +888,7 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 				bearerSubSumsToUpdate = append(bearerSubSumsToUpdate, &bearerSubSum)
 
 				//每个版本的鸟币都需要新建一个repay
-				mutiRepay := db.Repay{ReqID: form.ReqID, SnapID: form.SnapID, SnapSetID: subsum.SnapSetID, GUID: guid, Bearer: bearer, Issuer: issuer, Amount: uint64(issuerSubSumAdd), IsMarker: false}
+				mutiRepay := db.Repay{ReqID: form.ReqID, SnapID: form.SnapID, SnapSetID: subsum.SnapSetID, GUID: guid, Bearer: bearer, Issuer: issuer, Amount: uint64(issuerSubSumAdd), IsMarker: false, Memo: form.Memo, KeyID: repay.KeyID, Sig: repay.Sig, SignedAt: repay.SignedAt}
 				repays = append(repays, &mutiRepay)
 				if breakNow {
 					goto Exit
@@ -691,8 +902,8 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 	//新的news
 	tip1 := config.Public.Req.B20 //请求方提示
 	tip2 := config.Public.Req.I20 //执行方提示
-	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: bearerAdd, Buddy: issuer, SourceID: form.ReqID, Table: config.NewsTableReq}
-	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: issuerAdd, Buddy: bearer, SourceID: form.ReqID, Table: config.NewsTableReq}
+	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: bearerAdd, Buddy: issuer, SourceID: form.ReqID, Table: config.NewsTableReq, Memo: form.Memo}
+	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: issuerAdd, Buddy: bearer, SourceID: form.ReqID, Table: config.NewsTableReq, Memo: form.Memo}
 
 	//数据库事务
 	//处理pay表、sum表/sub_sum、news表/info表、req表
@@ -718,6 +929,11 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 				return nil, err
 			}
 		}
+		//追加到账本
+		err = db.AppendLedger(session, config.NewsTableRePay, repay.GUID)
+		if err != nil {
+			return nil, err
+		}
 
 		//update sum
 		_, err = session.Id(bearerSum.ID).Cols("sum").Update(&bearerSum)
@@ -769,14 +985,50 @@ func NewRepay(ctx context.Context, form model.NewRepayForm) {
 			return nil, err
 		}
 
+		//扣减库存，任一技能库存不足时回滚，库存为0时自动下架
+		for _, skill := range stockSkills {
+			ok, err := db.TakeStock(session, skill.ID, units)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1052)
+			}
+		}
+
+		//确认预约的时段，时段已被释放（如请求已超时）时回滚
+		if req.SlotID > 0 {
+			ok, err := db.ConfirmSlot(session, form.ReqID)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1049)
+			}
+		}
+
+		//加入兑现中的延时提醒tube，超时未完成的兑现在main/jobRemindCheck()中处理
+		err = PutReqRemind(db.ReqRemind{ReqID: form.ReqID, Stage: 1, RedoNum: req.RedoNum})
+		if err != nil {
+			return nil, err
+		}
+
 		return nil, nil
 	})
+	if err != nil && (err.Error() == config.Public.Err.E1049 || err.Error() == config.Public.Err.E1052) {
+		e.ReturnError(ctx, iris.StatusOK, err.Error())
+	}
 	checkDBErr(err)
 
 	ctx.JSON(&model.UpdateRes{Ok: true})
 
 	//更新coin表的个人统计
 	UpdateInfo(pq, coinName)
+
+	//库存为0时技能已自动下架，更新标签的技能数量
+	if len(stockSkills) > 0 {
+		go db.UpdateTagSkillNum(pq, stockTags)
+	}
 }
 
 //RejectReq 拒绝兑现请求
@@ -817,8 +1069,8 @@ func RejectReq(ctx context.Context) {
 	//数据库事务
 	tip1 := config.Public.Req.B21 //请求方提示
 	tip2 := config.Public.Req.I21 //执行方提示
-	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID}
-	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID}
+	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
+	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
 	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
 		//new news
 		_, err := session.Insert(&bearerNews, &issuerNews)
@@ -845,6 +1097,12 @@ func RejectReq(ctx context.Context) {
 			return nil, errors.New(config.Public.Err.E1004)
 		}
 
+		//释放预约的时段
+		err = db.FreeSlot(session, reqID)
+		if err != nil {
+			return nil, err
+		}
+
 		return nil, nil
 	})
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
@@ -855,6 +1113,91 @@ func RejectReq(ctx context.Context) {
 	UpdateInfo(pq, coinName)
 }
 
+//CancelReq 取消兑现请求（请求方），仅可在对方接受前取消
+func CancelReq(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	lock := GetTxLocks(ctx)
+	reqID := ctx.Params().GetUint64Default("req", 0)
+
+	//检查是否是本人账号操作
+	req := db.Req{ID: reqID, Bearer: coinName}
+	has, err := pq.Get(&req)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusInternalServerError, config.Public.Err.E1033)
+	}
+
+	//只可在状态为10时进行此项操作
+	if req.State != 10 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1044)
+	}
+
+	//========锁住双方的交易事务，避免与接受请求同时进行==========
+	bearer := req.Bearer
+	issuer := req.Issuer
+	if lock.Locks[issuer] == true || lock.Locks[bearer] == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1019)
+		return
+	}
+	lock.Locks[issuer] = true
+	lock.Locks[bearer] = true
+	defer func() {
+		delete(lock.Locks, issuer)
+		delete(lock.Locks, bearer)
+	}()
+
+	//数据库事务
+	tip1 := config.Public.Req.B32 //请求方提示
+	tip2 := config.Public.Req.I32 //执行方提示
+	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
+	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
+	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		//new news
+		_, err := session.Insert(&bearerNews, &issuerNews)
+		if err != nil {
+			return nil, err
+		}
+
+		//update info
+		_, err = session.Where("owner = ?", bearer).Cols("has_news").UseBool().Update(&db.Info{HasNews: true})
+		if err != nil {
+			return nil, err
+		}
+		_, err = session.Where("owner = ?", issuer).Cols("has_news").UseBool().Update(&db.Info{HasNews: true})
+		if err != nil {
+			return nil, err
+		}
+
+		//修改状态，仅在状态仍为10时修改
+		affected, err := session.ID(reqID).Where("state = ?", 10).Update(&db.Req{State: 32})
+		if err != nil {
+			return nil, err
+		}
+		if affected == 0 {
+			return nil, errors.New(config.Public.Err.E1044)
+		}
+
+		//释放预约的时段
+		err = db.FreeSlot(session, reqID)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, nil
+	})
+	if err != nil && err.Error() == config.Public.Err.E1044 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1044)
+	}
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+
+	//更新coin表的个人统计
+	UpdateInfo(pq, coinName)
+}
+
 //UnCash 对方未兑现请求
 func UnCash(ctx context.Context) {
 	e := new(model.CommonError)
@@ -880,8 +1223,8 @@ func UnCash(ctx context.Context) {
 	issuer := req.Issuer
 	tip1 := config.Public.Req.B23 //请求方提示
 	tip2 := config.Public.Req.I23 //执行方提示
-	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID}
-	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID}
+	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
+	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
 	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
 		//new news
 		_, err := session.Insert(&bearerNews, &issuerNews)
@@ -918,7 +1261,7 @@ func UnCash(ctx context.Context) {
 	UpdateInfo(pq, coinName)
 }
 
-//Redo 重新执行请求，两次重做的间隔至少大于3天
+//Redo 重新执行请求，两次重做的间隔至少大于RedoDays天，最多重做MaxRedo次（见config.toml的remind）
 func Redo(ctx context.Context) {
 	e := new(model.CommonError)
 	pq := GetPQ(ctx)
@@ -934,21 +1277,26 @@ func Redo(ctx context.Context) {
 	}
 
 	//仅可在21、22、23情况下执行
-	if req.State <= 20 || req.State >= 30 {
+	if req.CanRedo() == false {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1044)
 	}
-	//两次重做的间隔「至少」大于3天
-	if req.State == 23 && req.Updated.AddDate(0, 0, 3).After(time.Now()) {
+	//两次重做的间隔「至少」大于RedoDays天
+	remind := config.Public.Remind
+	if req.State == 23 && req.Updated.AddDate(0, 0, remind.RedoDays).After(time.Now()) {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1043)
 	}
+	//重做次数不能超过MaxRedo，为0时不限制
+	if remind.MaxRedo > 0 && req.RedoNum >= remind.MaxRedo {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1045)
+	}
 
 	//数据库事务
 	bearer := req.Bearer
 	issuer := req.Issuer
 	tip1 := config.Public.Req.B20 //请求方提示
 	tip2 := config.Public.Req.I20 //执行方提示
-	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID}
-	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID}
+	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
+	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
 	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
 		//new news
 		_, err := session.Insert(&bearerNews, &issuerNews)
@@ -966,8 +1314,8 @@ func Redo(ctx context.Context) {
 			return nil, err
 		}
 
-		//修改状态
-		affected, err := session.ID(reqID).Update(&db.Req{State: 20})
+		//修改状态，并记录重做次数
+		affected, err := session.ID(reqID).Incr("redo_num").Update(&db.Req{State: 20})
 		if err != nil {
 			return nil, err
 		}
@@ -975,6 +1323,12 @@ func Redo(ctx context.Context) {
 			return nil, errors.New(config.Public.Err.E1004)
 		}
 
+		//重新加入兑现中的延时提醒tube
+		err = PutReqRemind(db.ReqRemind{ReqID: reqID, Stage: 1, RedoNum: req.RedoNum + 1})
+		if err != nil {
+			return nil, err
+		}
+
 		return nil, nil
 	})
 	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
@@ -1001,7 +1355,7 @@ func Done(ctx context.Context) {
 	}
 
 	//仅可在20、21、22、23情况下执行
-	if req.State < 20 || req.State >= 30 {
+	if req.CanDone() == false {
 		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1044)
 	}
 
@@ -1010,8 +1364,8 @@ func Done(ctx context.Context) {
 	issuer := req.Issuer
 	tip1 := config.Public.Req.B30 //请求方提示
 	tip2 := config.Public.Req.I30 //执行方提示
-	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID}
-	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID}
+	bearerNews := db.News{Owner: bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: issuer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
+	issuerNews := db.News{Owner: issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: bearer, Table: config.NewsTableReq, SourceID: reqID, Memo: req.Memo}
 	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
 		//new news
 		_, err := session.Insert(&bearerNews, &issuerNews)
@@ -1048,6 +1402,43 @@ func Done(ctx context.Context) {
 	UpdateInfo(pq, coinName)
 }
 
+//PutReqRemind 加入兑现中(state=20)的延时提醒tube，在main/jobRemindCheck()中处理
+//延时时间根据Stage计算：1.RemindDays 2.EscalateDays-RemindDays 3.AutoDays-EscalateDays
+func PutReqRemind(remind db.ReqRemind) error {
+	conf := config.Public.Remind
+	days := 0
+	switch remind.Stage {
+	case 1:
+		days = conf.RemindDays
+	case 2:
+		days = conf.EscalateDays - conf.RemindDays
+	case 3:
+		if conf.AutoDays == 0 {
+			//不自动处理
+			return nil
+		}
+		days = conf.AutoDays - conf.EscalateDays
+	default:
+		return nil
+	}
+	if days < 0 {
+		days = 0
+	}
+
+	byteRemind, err := json.Marshal(remind)
+	if err != nil {
+		return err
+	}
+	conn, err := beanstalk.Dial("tcp", config.BeanstalkURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	tube := &beanstalk.Tube{Conn: conn, Name: config.BeanstalkTubeRemind}
+	_, err = tube.Put(byteRemind, 0, time.Duration(days)*24*time.Hour, 5*time.Second)
+	return err
+}
+
 //UpdateInfo 更新用户数据
 func UpdateInfo(pq *xorm.Engine, coinName string) {
 	go func(pq *xorm.Engine, coinName string) {
@@ -1056,10 +1447,10 @@ func UpdateInfo(pq *xorm.Engine, coinName string) {
 		pq.Where("bearer = ? and coin = ?", sum.Bearer, sum.Coin).UseBool().Get(&sum)
 
 		//Denied 普通鸟币——当前拒绝量
-		denied, _ := pq.Where("state > 20 and state < 30").UseBool().SumInt(&db.Req{Issuer: coinName, Closed: false, IsMarker: false}, "amount")
+		denied, _ := pq.Where(db.ReqRefusedCond).UseBool().SumInt(&db.Req{Issuer: coinName, Closed: false, IsMarker: false}, "amount")
 
 		//BreakNum 超级鸟币——当前拒绝兑现的「次数」
-		breakNum, _ := pq.Where("state > 20 and state < 30").UseBool().Count(&db.Req{Issuer: coinName, Closed: false, IsMarker: true})
+		breakNum, _ := pq.Where(db.ReqRefusedCond).UseBool().Count(&db.Req{Issuer: coinName, Closed: false, IsMarker: true})
 
 		//SkillNum 当前可用的技能数
 		skill := db.Skill{Owner: coinName, IsOpen: false}
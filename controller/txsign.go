@@ -0,0 +1,334 @@
+package controller
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+	"reqing.org/niaobi-go/util"
+)
+
+/**
+交易签名的内容（编码见util.TxMessage），例如付款方alice转账5个bob币给carol：
+niaobi:pay:1
+payer=alice
+receiver=carol
+coin=bob
+amount=5
+marker=0
+invoice=0
+memo=
+ts=1700000000
+
+转账：payer、receiver、coin、amount、marker、invoice、memo、ts，付款方签名
+兑现请求：bearer、issuer、amount、snap、marker、slot、tier、memo、ts，持有者签名
+接受兑现请求：issuer、bearer、req、snap、amount、marker、memo、ts，发行者签名
+代金券：owner、coin、amount、marker、memo、hours、ts，创建者签名
+兑换码批次：owner、amount、marker、count、memo、hours、ts，发行者签名
+登记公钥：owner、pubkey、ts
+其中marker为0或1，memo为去除首尾空格并HTML转义后的备注，ts为签名时间（unix秒）
+*/
+
+//NewCoinKey 登记公钥，已有公钥时撤销旧公钥。须用对应的私钥签名登记内容，证明持有私钥
+func NewCoinKey(ctx context.Context, form model.NewCoinKeyForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	checkSignedAt(ctx, form.SignedAt)
+	if util.VerifyTxSig(form.PubKey, form.Sig, keyTxMessage(coinName, form.PubKey, form.SignedAt)) == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1078)
+	}
+	//撤销的公钥也不能再次登记，否则无法确定旧交易使用的是哪个公钥
+	exist, err := pq.Exist(&db.CoinKey{PubKey: form.PubKey})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if exist {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1079)
+	}
+
+	key := db.CoinKey{Owner: coinName, PubKey: form.PubKey}
+	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		_, err := session.Exec("UPDATE coin_key SET revoked = ? WHERE owner = ? AND revoked IS NULL", time.Now(), coinName)
+		if err != nil {
+			return nil, err
+		}
+		_, err = session.InsertOne(&key)
+		return nil, err
+	})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&key)
+}
+
+//GetCoinKeys 获取某用户登记过的所有公钥，包括已撤销的，供第三方验证交易签名
+func GetCoinKeys(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	name := ctx.Params().Get("name")
+
+	keys := []*db.CoinKey{}
+	err := pq.Where("owner = ?", name).Asc("id").Find(&keys)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&keys)
+}
+
+//GetTxVerify 验证交易记录的签名，仅交易双方和管理员可以查询。table为pay、req或repay，领取代金券、兑换码的pay验证代金券、兑换码批次的签名
+func GetTxVerify(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	table := ctx.Params().Get("table")
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	res, err := VerifyTx(pq, table, id)
+	if err != nil && err.Error() == config.Public.Err.E1085 {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1085)
+	}
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if coinName != res.Signer && coinName != res.Buddy && IsAdmin(coinName) == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1085)
+	}
+
+	ctx.JSON(res)
+}
+
+//VerifyTx 按保存的交易记录重新生成签名内容，验证是否由签名者登记的公钥签名。记录不存在时返回E1085
+func VerifyTx(pq *xorm.Engine, table string, id uint64) (*model.TxVerifyRes, error) {
+	res := model.TxVerifyRes{Table: table, ID: id}
+	notFound := errors.New(config.Public.Err.E1085)
+	sig := ""
+	var msg []byte
+
+	switch table {
+	case config.NewsTablePay:
+		pay := db.Pay{}
+		has, err := pq.ID(id).Get(&pay)
+		if err != nil {
+			return nil, err
+		}
+		if has == false {
+			return nil, notFound
+		}
+		//同一次转账的多个版本的pay共享guid，签名的是总数额
+		amount := pay.Amount
+		if pay.GUID != "" {
+			total, err := pq.Where("guid = ?", pay.GUID).SumInt(&db.Pay{}, "amount")
+			if err != nil {
+				return nil, err
+			}
+			amount = uint64(total)
+		}
+		res.Signer, res.Buddy, res.KeyID, res.SignedAt, sig = pay.Payer, pay.Receiver, pay.KeyID, pay.SignedAt, pay.Sig
+		msg = payTxMessage(&pay, amount)
+		//领取代金券的转账没有付款方的签名，验证的是代金券创建者（即付款方）的签名
+		if pay.KeyID == 0 && pay.GUID != "" {
+			voucher := db.Voucher{}
+			has, err := pq.Where("pay_guid = ?", pay.GUID).Get(&voucher)
+			if err != nil {
+				return nil, err
+			}
+			if has {
+				res.Source, res.SourceID = config.NewsTableVoucher, voucher.ID
+				res.Signer, res.KeyID, res.SignedAt, sig = voucher.Owner, voucher.KeyID, voucher.SignedAt, voucher.Sig
+				msg = voucherTxMessage(&voucher)
+			}
+		}
+		//领取兑换码的发行同样没有付款方的签名，验证的是兑换码批次发行者的签名
+		if pay.KeyID == 0 && pay.GUID != "" && res.Source == "" {
+			code := db.GiftCode{}
+			has, err := pq.Where("pay_guid = ?", pay.GUID).Get(&code)
+			if err != nil {
+				return nil, err
+			}
+			batch := db.GiftBatch{}
+			if has {
+				has, err = pq.ID(code.BatchID).Get(&batch)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if has {
+				res.Source, res.SourceID = config.NewsTableGift, batch.ID
+				res.Signer, res.KeyID, res.SignedAt, sig = batch.Owner, batch.KeyID, batch.SignedAt, batch.Sig
+				msg = giftTxMessage(&batch)
+			}
+		}
+	case config.NewsTableReq:
+		req := db.Req{}
+		has, err := pq.ID(id).Get(&req)
+		if err != nil {
+			return nil, err
+		}
+		if has == false {
+			return nil, notFound
+		}
+		res.Signer, res.Buddy, res.KeyID, res.SignedAt, sig = req.Bearer, req.Issuer, req.KeyID, req.SignedAt, req.Sig
+		msg = reqTxMessage(&req)
+	case config.NewsTableRePay:
+		repay := db.Repay{}
+		has, err := pq.ID(id).Get(&repay)
+		if err != nil {
+			return nil, err
+		}
+		if has == false {
+			return nil, notFound
+		}
+		//同一次兑现的多个版本的repay共享guid
+		amount := repay.Amount
+		if repay.GUID != "" {
+			total, err := pq.Where("guid = ?", repay.GUID).SumInt(&db.Repay{}, "amount")
+			if err != nil {
+				return nil, err
+			}
+			amount = uint64(total)
+		}
+		res.Signer, res.Buddy, res.KeyID, res.SignedAt, sig = repay.Issuer, repay.Bearer, repay.KeyID, repay.SignedAt, repay.Sig
+		msg = repayTxMessage(&repay, amount)
+	default:
+		return nil, notFound
+	}
+
+	res.Signed = res.KeyID > 0
+	if res.Signed == false {
+		return &res, nil
+	}
+	key, valid, err := verifyKeySig(pq, res.KeyID, res.Signer, sig, msg)
+	if err != nil {
+		return nil, err
+	}
+	res.PubKey, res.Valid = key.PubKey, valid
+	if res.Valid == false {
+		res.Err = config.Public.Err.E1082
+	}
+	return &res, nil
+}
+
+//checkTxSig 检查交易签名，返回签名使用的公钥ID，未签名时返回0
+//已登记公钥的用户须签名；config中Required为true时所有用户都须签名。同一签名只能使用一次
+func checkTxSig(ctx context.Context, pq *xorm.Engine, signer string, table string, sig string, signedAt int64, msg []byte) uint64 {
+	e := new(model.CommonError)
+
+	key, err := db.ActiveCoinKey(pq, signer)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if key == nil {
+		if sig != "" || config.Public.Sign.Required {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1080)
+		}
+		return 0
+	}
+	if sig == "" {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1081)
+	}
+	checkSignedAt(ctx, signedAt)
+	if util.VerifyTxSig(key.PubKey, sig, msg) == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1082)
+	}
+	used, err := pq.Table(table).Where("sig = ?", sig).Exist()
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if used {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1084)
+	}
+	return key.ID
+}
+
+//verifyKeySig 验证已保存的签名：公钥须属于签名者（包括已撤销的公钥），公钥不存在时返回空的CoinKey
+func verifyKeySig(engine xorm.Interface, keyID uint64, signer string, sig string, msg []byte) (*db.CoinKey, bool, error) {
+	key := db.CoinKey{}
+	has, err := engine.ID(keyID).Get(&key)
+	if err != nil {
+		return nil, false, err
+	}
+	return &key, has && key.Owner == signer && util.VerifyTxSig(key.PubKey, sig, msg), nil
+}
+
+//checkSignedAt 签名时间与服务器时间相差不能超过MaxSkewSeconds
+func checkSignedAt(ctx context.Context, signedAt int64) {
+	e := new(model.CommonError)
+	skew := time.Now().Unix() - signedAt
+	if skew > config.Public.Sign.MaxSkewSeconds || -skew > config.Public.Sign.MaxSkewSeconds {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1083)
+	}
+}
+
+//keyTxMessage 登记公钥的签名内容，用新的私钥签名以证明持有私钥
+func keyTxMessage(owner string, pubKey string, signedAt int64) []byte {
+	return util.TxMessage(util.TxSignKey, "owner", owner, "pubkey", pubKey, "ts", strconv.FormatInt(signedAt, 10))
+}
+
+//payTxMessage 转账的签名内容，amount为转账的总数额
+func payTxMessage(pay *db.Pay, amount uint64) []byte {
+	return util.TxMessage(util.TxSignPay,
+		"payer", pay.Payer,
+		"receiver", pay.Receiver,
+		"coin", pay.TransCoin,
+		"amount", strconv.FormatUint(amount, 10),
+		"marker", txSignBool(pay.IsMarker),
+		"invoice", strconv.FormatUint(pay.InvoiceID, 10),
+		"memo", pay.Memo,
+		"ts", strconv.FormatInt(pay.SignedAt, 10))
+}
+
+//reqTxMessage 兑现请求的签名内容
+func reqTxMessage(req *db.Req) []byte {
+	return util.TxMessage(util.TxSignReq,
+		"bearer", req.Bearer,
+		"issuer", req.Issuer,
+		"amount", strconv.FormatUint(req.Amount, 10),
+		"snap", strconv.FormatUint(req.SnapID, 10),
+		"marker", txSignBool(req.IsMarker),
+		"slot", strconv.FormatUint(req.SlotID, 10),
+		"tier", strconv.FormatUint(req.TierQty, 10),
+		"memo", req.Memo,
+		"ts", strconv.FormatInt(req.SignedAt, 10))
+}
+
+//repayTxMessage 接受兑现请求的签名内容，amount为兑现的总数额
+func repayTxMessage(repay *db.Repay, amount uint64) []byte {
+	return util.TxMessage(util.TxSignRepay,
+		"issuer", repay.Issuer,
+		"bearer", repay.Bearer,
+		"req", strconv.FormatUint(repay.ReqID, 10),
+		"snap", strconv.FormatUint(repay.SnapID, 10),
+		"amount", strconv.FormatUint(amount, 10),
+		"marker", txSignBool(repay.IsMarker),
+		"memo", repay.Memo,
+		"ts", strconv.FormatInt(repay.SignedAt, 10))
+}
+
+//voucherTxMessage 代金券的签名内容
+func voucherTxMessage(voucher *db.Voucher) []byte {
+	return util.TxMessage(util.TxSignVoucher,
+		"owner", voucher.Owner,
+		"coin", voucher.Coin,
+		"amount", strconv.FormatUint(voucher.Amount, 10),
+		"marker", txSignBool(voucher.IsMarker),
+		"memo", voucher.Memo,
+		"hours", strconv.FormatUint(uint64(voucher.ExpireHours), 10),
+		"ts", strconv.FormatInt(voucher.SignedAt, 10))
+}
+
+//giftTxMessage 兑换码批次的签名内容
+func giftTxMessage(batch *db.GiftBatch) []byte {
+	return util.TxMessage(util.TxSignGift,
+		"owner", batch.Owner,
+		"amount", strconv.FormatUint(batch.Amount, 10),
+		"marker", txSignBool(batch.IsMarker),
+		"count", strconv.FormatUint(uint64(batch.Count), 10),
+		"memo", batch.Memo,
+		"hours", strconv.FormatUint(uint64(batch.ExpireHours), 10),
+		"ts", strconv.FormatInt(batch.SignedAt, 10))
+}
+
+func txSignBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
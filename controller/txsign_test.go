@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/util"
+)
+
+//客户端须逐字节生成相同的签名内容。密钥为RFC 8032 TEST 1的私钥，ed25519签名是确定的，所以签名也固定
+const (
+	txSignTestSeed = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	txSignTestPub  = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	//备注包含反斜杠、换行和HTML
+	txSignTestMemo = "a\\b\n<b>&\"x\"</b>"
+)
+
+func txSignTestKey(t *testing.T) ed25519.PrivateKey {
+	seed, err := hex.DecodeString(txSignTestSeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
+func TestTxMessageGoldenVectors(t *testing.T) {
+	key := txSignTestKey(t)
+	cases := []struct {
+		name string
+		msg  []byte
+		want string
+		sig  string
+	}{
+		{
+			"key",
+			keyTxMessage("alice", txSignTestPub, 1600000000),
+			"niaobi:key:1\nowner=alice\npubkey=" + txSignTestPub + "\nts=1600000000\n",
+			"7c52a92088d0ebb1dce3c125cbf99c4d510ee067b35858fb4eca78650960140f05c6b8c491e95c81844237a9b95e2ff18c6a34ff99e901ec0fe5fc67478de60c",
+		},
+		{
+			"pay",
+			payTxMessage(&db.Pay{Payer: "alice", Receiver: "bob", TransCoin: "carol", IsMarker: true, InvoiceID: 12, Memo: txSignTestMemo, SignedAt: 1600000001}, 30),
+			"niaobi:pay:1\npayer=alice\nreceiver=bob\ncoin=carol\namount=30\nmarker=1\ninvoice=12\nmemo=a\\\\b\\n<b>&\"x\"</b>\nts=1600000001\n",
+			"8caac8ee11edf3ea429ae6142f27e78f317a8914d01bcaa9803bd4106355663efd78eeda6d2da6c4bec70c7099859a388b8e2bb8ddb298dfb5250135ed7bdf0e",
+		},
+		{
+			"req",
+			reqTxMessage(&db.Req{Bearer: "bob", Issuer: "alice", Amount: 60, SnapID: 7, SlotID: 3, TierQty: 10, Memo: txSignTestMemo, SignedAt: 1600000002}),
+			"niaobi:req:1\nbearer=bob\nissuer=alice\namount=60\nsnap=7\nmarker=0\nslot=3\ntier=10\nmemo=a\\\\b\\n<b>&\"x\"</b>\nts=1600000002\n",
+			"a8a3c83a50e4d9312e16fe59b46a3f4d647bf6379ab65404c83a036f0f668dc66f662dcf78708e1707c06dcce4242cc56072ba517fb06776afa76c32a09b6708",
+		},
+		{
+			"repay",
+			repayTxMessage(&db.Repay{Issuer: "alice", Bearer: "bob", ReqID: 9, SnapID: 7, Memo: txSignTestMemo, SignedAt: 1600000003}, 60),
+			"niaobi:repay:1\nissuer=alice\nbearer=bob\nreq=9\nsnap=7\namount=60\nmarker=0\nmemo=a\\\\b\\n<b>&\"x\"</b>\nts=1600000003\n",
+			"6e8dfe8fc109e1bdb77491c10ef5a083d6c9dc035564853ab5b441e6caaffaacbd6dd5e340c84a948925c4907555bca5cdf0dae68401a3966357a9f9facc1d07",
+		},
+		{
+			"voucher",
+			voucherTxMessage(&db.Voucher{Owner: "alice", Coin: "alice", Amount: 5, Memo: txSignTestMemo, ExpireHours: 48, SignedAt: 1600000004}),
+			"niaobi:voucher:1\nowner=alice\ncoin=alice\namount=5\nmarker=0\nmemo=a\\\\b\\n<b>&\"x\"</b>\nhours=48\nts=1600000004\n",
+			"eb8b662960fe9a2a804ddd6eb6ba08fde0ef0d72a73f5e63fd9c1f49ea139d9c2bee3c350eb1eb25776c2fccc619f70414eb2283c3a7870b3f49f8c69203de07",
+		},
+		{
+			"gift",
+			giftTxMessage(&db.GiftBatch{Owner: "alice", Amount: 3, IsMarker: true, Count: 100, Memo: txSignTestMemo, ExpireHours: 720, SignedAt: 1600000005}),
+			"niaobi:gift:1\nowner=alice\namount=3\nmarker=1\ncount=100\nmemo=a\\\\b\\n<b>&\"x\"</b>\nhours=720\nts=1600000005\n",
+			"cdb61888a604437ba3ca5e132157e9031d7a4da295a2109601964b9d6045e9ec935117d7823b0b363ec52dc74afa75e6d56087a4c194e88b48de8209f012290c",
+		},
+	}
+	for _, c := range cases {
+		if string(c.msg) != c.want {
+			t.Errorf("%s message:\n got %q\nwant %q", c.name, c.msg, c.want)
+		}
+		sig := hex.EncodeToString(ed25519.Sign(key, c.msg))
+		if sig != c.sig {
+			t.Errorf("%s signature:\n got %s\nwant %s", c.name, sig, c.sig)
+		}
+		if util.VerifyTxSig(txSignTestPub, c.sig, c.msg) == false {
+			t.Errorf("%s: golden signature does not verify", c.name)
+		}
+	}
+}
+
+//一次转账拆分为多个版本的pay记录（共享guid），付款方签名的是总数额，验证时按guid求和
+func TestPayTxMessageMultiVersion(t *testing.T) {
+	key := txSignTestKey(t)
+	versions := []*db.Pay{
+		{ID: 1, Payer: "alice", Receiver: "bob", TransCoin: "carol", Amount: 20, SnapSetID: 4, GUID: "g1", Memo: txSignTestMemo, SignedAt: 1600000001},
+		{ID: 2, Payer: "alice", Receiver: "bob", TransCoin: "carol", Amount: 10, SnapSetID: 5, GUID: "g1", Memo: txSignTestMemo, SignedAt: 1600000001},
+	}
+	//客户端只知道总数额
+	sig := hex.EncodeToString(ed25519.Sign(key, payTxMessage(&db.Pay{Payer: "alice", Receiver: "bob", TransCoin: "carol", Memo: txSignTestMemo, SignedAt: 1600000001}, 30)))
+
+	total := uint64(0)
+	for _, pay := range versions {
+		total += pay.Amount
+	}
+	for _, pay := range versions {
+		if util.VerifyTxSig(txSignTestPub, sig, payTxMessage(pay, total)) == false {
+			t.Errorf("pay %d does not verify with the summed amount", pay.ID)
+		}
+		if util.VerifyTxSig(txSignTestPub, sig, payTxMessage(pay, pay.Amount)) {
+			t.Errorf("pay %d verifies with its own amount", pay.ID)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/kataras/iris/v12"
+	"github.com/kataras/iris/v12/context"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/model"
+	"reqing.org/niaobi-go/util"
+)
+
+//NewVoucher 新建代金券：转手的鸟币从持有量中预留，发行自己的鸟币不须预留。返回领取码和二维码的内容
+func NewVoucher(ctx context.Context, form model.NewVoucherForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	lock := GetTxLocks(ctx)
+
+	exist, err := pq.Exist(&db.Coin{Name: form.TransCoin})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if exist == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1020)
+	}
+
+	code, err := newVoucherCode()
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	voucher := db.Voucher{Code: code, Owner: coinName, Coin: form.TransCoin, Amount: form.Amount, IsMarker: form.IsMarker, Memo: form.Memo, ExpireHours: form.ExpireHours, Sig: form.Sig, SignedAt: form.SignedAt}
+	voucher.Expires = time.Now().Add(time.Duration(form.ExpireHours) * time.Hour)
+	//已登记公钥的创建者须签名，签名与voucher记录一起保存
+	voucher.KeyID = checkTxSig(ctx, pq, coinName, config.NewsTableVoucher, voucher.Sig, voucher.SignedAt, voucherTxMessage(&voucher))
+
+	//与转账相同，锁住创建者的交易直到预留结束
+	if lock.Locks[coinName] == true {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1019)
+	}
+	lock.Locks[coinName] = true
+	defer delete(lock.Locks, coinName)
+
+	_, err = pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		if voucher.IsReserved() {
+			sum := db.Sum{Bearer: coinName, Coin: voucher.Coin, IsMarker: voucher.IsMarker}
+			has, err := session.UseBool().Get(&sum)
+			if err != nil {
+				return nil, err
+			}
+			if has == false {
+				return nil, errors.New(config.Public.Err.E1025)
+			}
+			ok, err := db.ReserveSum(session, sum.ID, voucher.Amount)
+			if err != nil {
+				return nil, err
+			}
+			if ok == false {
+				return nil, errors.New(config.Public.Err.E1023)
+			}
+		}
+		_, err := session.InsertOne(&voucher)
+		return nil, err
+	})
+	if err != nil && (err.Error() == config.Public.Err.E1025 || err.Error() == config.Public.Err.E1023) {
+		e.ReturnError(ctx, iris.StatusOK, err.Error())
+	}
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&model.VoucherRes{Voucher: &voucher, URI: voucherURI(&voucher)})
+}
+
+//GetVoucherList 获取自己创建的代金券列表，按创建时间倒序
+func GetVoucherList(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	vouchers := []*db.Voucher{}
+	err := pq.Where("owner = ?", coinName).Desc("id").Find(&vouchers)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+
+	ctx.JSON(&vouchers)
+}
+
+//GetVoucherQRC 获取自己创建的代金券的二维码（jpg），内容见util.VoucherURI
+func GetVoucherQRC(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	voucher := db.Voucher{}
+	has, err := pq.Where("id = ? AND owner = ?", id, coinName).Get(&voucher)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1088)
+	}
+
+	buffer, err := encodeQRC(voucherURI(&voucher))
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+	buffer, err = db.ResizePic(buffer, config.Public.Pic.QRSizeMiddle, config.Public.Pic.QRSizeMiddle)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1015, nil)
+
+	ctx.ContentType("image/jpeg")
+	ctx.Write(buffer)
+}
+
+//CancelVoucher 取消自己创建的待领取的代金券，释放预留的鸟币
+func CancelVoucher(ctx context.Context) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+	id := ctx.Params().GetUint64Default("id", 0)
+
+	voucher := db.Voucher{}
+	has, err := pq.Where("id = ? AND owner = ?", id, coinName).Get(&voucher)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1088)
+	}
+
+	res, err := pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+		return db.CloseVoucher(session, &voucher, 2)
+	})
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if res.(bool) == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1089)
+	}
+
+	ctx.JSON(&model.UpdateRes{Ok: true})
+}
+
+//ClaimVoucher 领取代金券：由创建者转账给领取者，同一代金券只能领取一次
+func ClaimVoucher(ctx context.Context, form model.ClaimVoucherForm) {
+	e := new(model.CommonError)
+	pq := GetPQ(ctx)
+	coinName := GetJwtUser(ctx)[config.JwtNameKey].(string)
+
+	//扫描二维码得到的内容
+	code := form.Code
+	if strings.Contains(code, ":") {
+		uri, err := util.ParseVoucherURI(code)
+		if err == util.ErrPayURIVersion {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1073)
+		}
+		if err != nil {
+			e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1088)
+		}
+		code = uri.Code
+	}
+
+	voucher := db.Voucher{}
+	has, err := pq.Where("code = ?", code).Get(&voucher)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1004, nil)
+	if has == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1088)
+	}
+	if voucher.IsClaimable() == false {
+		e.ReturnError(ctx, iris.StatusOK, config.Public.Err.E1089)
+	}
+
+	payForm := model.NewPayForm{TransCoin: voucher.Coin, Receiver: coinName, Amount: voucher.Amount, IsMarker: voucher.IsMarker, Memo: voucher.Memo}
+	txPay(ctx, voucher.Owner, &payForm, paySource{voucher: &voucher})
+
+	voucher.Code, voucher.State, voucher.Claimer = "", 1, coinName
+	ctx.JSON(&voucher)
+
+	//更新coin表的个人统计
+	UpdateInfo(pq, voucher.Owner)
+}
+
+//ExpireVouchers 将过期未领取的代金券标记为已过期，释放预留的鸟币，返回处理的数量
+func ExpireVouchers(pq *xorm.Engine) (int, error) {
+	vouchers := []*db.Voucher{}
+	err := pq.Where("state = 0 AND expires <= ?", time.Now()).Asc("id").Limit(1000).Find(&vouchers)
+	if err != nil {
+		return 0, err
+	}
+	expired := 0
+	for _, voucher := range vouchers {
+		res, err := pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+			return db.CloseVoucher(session, voucher, 3)
+		})
+		if err != nil {
+			return expired, err
+		}
+		if res.(bool) {
+			expired++
+		}
+	}
+	return expired, nil
+}
+
+//voucherURI 代金券二维码的内容
+func voucherURI(voucher *db.Voucher) string {
+	uri := util.VoucherURI{Code: voucher.Code, From: voucher.Owner, Coin: voucher.Coin, Amount: voucher.Amount, IsMarker: voucher.IsMarker, Memo: voucher.Memo, Hours: voucher.ExpireHours, SignedAt: voucher.SignedAt, KeyID: voucher.KeyID, Sig: voucher.Sig}
+	return uri.String()
+}
+
+//newVoucherCode 随机生成32位的领取码
+func newVoucherCode() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
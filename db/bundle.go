@@ -0,0 +1,38 @@
+package db
+
+import (
+	"time"
+)
+
+//Bundle 技能套餐，对应bundle表。由同一用户的多个技能组成，以优惠的总价兑现
+//发币时与技能一样生成快照（见Snap），套餐快照记录了所包含技能的快照
+type Bundle struct {
+	ID      uint64    `json:"bundleID" xorm:"not null default nextval('bundle_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Created time.Time `json:"created" xorm:"not null created"`
+	Updated time.Time `json:"updated" xorm:"updated"`
+	Deleted time.Time `json:"-" xorm:"deleted"`
+
+	Owner    string   `json:"owner" xorm:"not null index(bundle_owner_is_open_idx) VARCHAR(20)"` //鸟币号，必填
+	Title    string   `json:"title" xorm:"not null VARCHAR(100)"`                                //套餐名称，不可修改，同一用户下不能输入重复标题
+	Price    uint64   `json:"price" xorm:"not null BIGINT"`                                      //套餐总价（鸟币数），须低于所包含技能的单价之和
+	Desc     string   `json:"desc,omitempty" xorm:"VARCHAR(5000)"`                               //套餐描述
+	SkillIDs []uint64 `json:"skillIDs" xorm:"not null JSONB 'skill_ids'"`                        //所包含的技能
+	Version  uint64   `json:"version" xorm:"not null version"`                                   //更新时自动加1
+
+	IsOpen bool `json:"isOpen" xorm:"not null default true index(bundle_owner_is_open_idx) BOOL"` //上架或下架
+}
+
+//NewSnap 根据最新套餐生成套餐快照，items为所包含技能的快照ID
+func (bundle *Bundle) NewSnap(items []uint64) Snap {
+	return Snap{
+		Owner:    bundle.Owner,
+		Title:    bundle.Title,
+		Price:    bundle.Price,
+		Desc:     bundle.Desc,
+		Tags:     []string{},
+		Pics:     []*Pic{},
+		BundleID: bundle.ID,
+		Version:  bundle.Version,
+		Items:    items,
+	}
+}
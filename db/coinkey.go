@@ -0,0 +1,34 @@
+package db
+
+import (
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+//CoinKey 用户登记的ed25519公钥，对应coin_key表。用户用私钥签名交易，服务器验证后将签名与交易记录一起保存
+//每个用户同时只有一个正在使用的公钥，更换公钥时旧公钥标记为已撤销但不删除，仍可用于验证之前的交易
+type CoinKey struct {
+	ID      uint64    `json:"keyID" xorm:"not null default nextval('coin_key_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Owner   string    `json:"owner" xorm:"not null index VARCHAR(20)"`   //鸟币号
+	PubKey  string    `json:"pubKey" xorm:"not null unique VARCHAR(64)"` //公钥，hex编码（小写）
+	Revoked time.Time `json:"revoked" xorm:"index"`                      //撤销时间，为零值表示正在使用
+	Created time.Time `json:"created" xorm:"not null created"`
+}
+
+//ActiveCoinKey 获取用户正在使用的公钥，未登记时返回nil
+func ActiveCoinKey(engine xorm.Interface, owner string) (*CoinKey, error) {
+	key := CoinKey{}
+	has, err := engine.Where("owner = ? AND revoked IS NULL", owner).Get(&key)
+	if err != nil || has == false {
+		return nil, err
+	}
+	return &key, nil
+}
+
+//SignedTxIDs 按id顺序获取已签名的交易记录id，table为pay、req或repay
+func SignedTxIDs(engine xorm.Interface, table string, afterID uint64, limit int) ([]uint64, error) {
+	ids := []uint64{}
+	err := engine.Table(table).Where("key_id > 0 AND id > ?", afterID).Asc("id").Limit(limit).Cols("id").Find(&ids)
+	return ids, err
+}
@@ -1,11 +1,16 @@
 package db
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
 	"log"
-	"os"
+	"strings"
+	"time"
 
 	"github.com/go-xorm/xorm"
 	"gopkg.in/h2non/bimg.v1"
@@ -15,10 +20,19 @@ import (
 
 //PicMeta 图片信息
 type PicMeta struct {
-	PID    string `json:"pid,omitempty"`
-	W      uint   `json:"w,omitempty"`
-	H      uint   `json:"h,omitempty"`
-	Format string `json:"f,omitempty"`
+	PID    string   `json:"pid,omitempty"`
+	W      uint     `json:"w,omitempty"`
+	H      uint     `json:"h,omitempty"`
+	Format string   `json:"f,omitempty"`
+	Extra  []string `json:"fs,omitempty"` //另外生成的格式（如webp），文件名与Format相同，仅后缀不同
+}
+
+//PicTypes 图片格式对应的bimg类型
+var PicTypes = map[string]bimg.ImageType{
+	"jpg":  bimg.JPEG,
+	"png":  bimg.PNG,
+	"gif":  bimg.GIF,
+	"webp": bimg.WEBP,
 }
 
 //Pic 图片
@@ -29,6 +43,24 @@ type Pic struct {
 	Biggest *PicMeta `json:"biggest,omitempty" xorm:"extends"`
 }
 
+//GUID 从缩略图的pid中解析出图片guid，pid格式如：鸟币号_guid-biggest
+func (pic *Pic) GUID() string {
+	for _, meta := range []*PicMeta{pic.Biggest, pic.Large, pic.Middle, pic.Small} {
+		if meta == nil {
+			continue
+		}
+		pid := meta.PID
+		if i := strings.LastIndex(pid, "_"); i >= 0 {
+			pid = pid[i+1:]
+		}
+		if i := strings.Index(pid, "-"); i >= 0 {
+			pid = pid[:i]
+		}
+		return pid
+	}
+	return ""
+}
+
 //NewSquareJPGMeta 正方形jpg pic meta
 func NewSquareJPGMeta(pid string, wh uint) *PicMeta {
 	meta := PicMeta{
@@ -73,18 +105,60 @@ func NewPicMeta(pid string, w int, h int, f string) *PicMeta {
 	return &meta
 }
 
-//GetUserPicDir 用户图片dir
-func GetUserPicDir(userName string, meta *PicMeta) string {
+//UserPicKey 用户图片在存储中的key，如：鸟币号/pic/鸟币号_guid-biggest.jpg
+func UserPicKey(userName string, meta *PicMeta) string {
 	if meta == nil {
 		return ""
 	}
-	//如果用户的pic目录不存在则新建
-	picDir := fmt.Sprintf("%s%s/%s/pic", config.Public.Dir.RootDir, config.Public.Dir.DataDir, userName)
-	os.MkdirAll(picDir, os.ModePerm)
-	os.Chmod(picDir, os.ModePerm)
-	//文件全路径
-	fullPath := fmt.Sprintf("%s/%s.%s", picDir, meta.PID, meta.Format)
-	return fullPath
+	return fmt.Sprintf("%s%s.%s", UserPicPrefix(userName), meta.PID, meta.Format)
+}
+
+//PutUserPic 保存用户图片
+func PutUserPic(userName string, meta *PicMeta, data []byte) error {
+	if meta == nil {
+		return errors.New("null pic meta")
+	}
+	return PicStore.Put(UserPicKey(userName, meta), data)
+}
+
+//GetUserPic 读取用户图片
+func GetUserPic(userName string, meta *PicMeta) ([]byte, error) {
+	if meta == nil {
+		return nil, errors.New("null pic meta")
+	}
+	return PicStore.Get(UserPicKey(userName, meta))
+}
+
+//RemoveUserPics 删除用户图片，包括另外生成的格式，忽略nil
+func RemoveUserPics(userName string, metas ...*PicMeta) {
+	for _, meta := range metas {
+		if meta == nil {
+			continue
+		}
+		PicStore.Delete(UserPicKey(userName, meta))
+		for _, f := range meta.Extra {
+			PicStore.Delete(UserPicKey(userName, &PicMeta{PID: meta.PID, Format: f}))
+		}
+	}
+}
+
+//NormalizePic 按EXIF方向旋转图片，并去除所有元数据（EXIF、GPS定位等）
+//jpg和webp保持原格式，其他格式转换为无损的png
+func NormalizePic(buffer []byte) ([]byte, error) {
+	image := bimg.NewImage(buffer)
+	options := bimg.Options{StripMetadata: true, Quality: 100, Type: bimg.PNG}
+	switch image.Type() {
+	case "jpeg":
+		options.Type = bimg.JPEG
+	case "webp":
+		options.Type = bimg.WEBP
+	}
+	return image.Process(options)
+}
+
+//ResizePic 调整图片大小，不足的部分补边，不保留元数据
+func ResizePic(buffer []byte, w uint, h uint) ([]byte, error) {
+	return bimg.NewImage(buffer).Process(bimg.Options{Width: int(w), Height: int(h), Embed: true, StripMetadata: true})
 }
 
 //ResizeUserPic 生成用户图片的缩略图
@@ -92,59 +166,130 @@ func ResizeUserPic(userName string, buffer []byte, meta *PicMeta) error {
 	if meta == nil {
 		return errors.New("null pic meta")
 	}
-	newImage, err := bimg.NewImage(buffer).Resize(int(meta.W), int(meta.H))
+	newImage, err := ResizePic(buffer, meta.W, meta.H)
 	if err != nil {
 		return err
 	}
-	dir := GetUserPicDir(userName, meta)
-	err = bimg.Write(dir, newImage)
-	if err != nil {
-		return err
-	}
-	return nil
+	return PutUserPic(userName, meta, newImage)
 }
 
-//CompressUserJPG 压缩用户图片，并且转换成jpeg格式
+//CompressUserJPG 压缩用户图片，并且转换成jpeg格式，同时生成config中ExtraFormats的格式
+//图片按EXIF方向旋转，不保留元数据
 func CompressUserJPG(userName string, buffer []byte, meta *PicMeta, isResize bool) error {
-	//统一转换成jpeg
+	//统一转换成jpeg，转换时已按EXIF方向旋转，去除元数据避免再次旋转
 	image := bimg.NewImage(buffer)
-	if image.Type() != "JPEG" {
-		buf, err := image.Convert(bimg.JPEG)
+	if image.Type() != "jpeg" {
+		_, err := image.Process(bimg.Options{Type: bimg.JPEG, Quality: 100, StripMetadata: true})
 		if err != nil {
 			return err
 		}
-		buffer = buf
 	}
 
 	options := bimg.Options{}
 	if isResize {
 		//压缩并且调整大小
 		options = bimg.Options{
-			Width:   int(meta.W),
-			Height:  int(meta.H),
-			Quality: config.Public.Pic.QualityOfPic,
-			Embed:   true,
+			Width:         int(meta.W),
+			Height:        int(meta.H),
+			Quality:       config.Public.Pic.QualityOfPic,
+			Embed:         true,
+			StripMetadata: true,
 		}
 	} else {
 		//仅压缩
 		options = bimg.Options{
-			Quality: config.Public.Pic.QualityOfPic,
-			Embed:   true,
+			Quality:       config.Public.Pic.QualityOfPic,
+			Embed:         true,
+			StripMetadata: true,
 		}
 	}
 
+	//Process会替换image中的数据，另外生成的格式使用处理前的图片
+	source := image.Image()
 	newImage, err := image.Process(options)
 	if err != nil {
 		return err
 	}
-	dir := GetUserPicDir(userName, meta)
-	err = bimg.Write(dir, newImage)
+	err = PutUserPic(userName, meta, newImage)
 	if err != nil {
 		return err
 	}
+
+	//另外生成的格式，当前的libvips不支持的格式跳过
+	meta.Extra = nil
+	for _, f := range config.Public.Pic.ExtraFormats {
+		t, ok := PicTypes[f]
+		if ok == false || f == meta.Format || bimg.IsTypeSupportedSave(t) == false {
+			continue
+		}
+		options.Type = t
+		extra, err := bimg.NewImage(source).Process(options)
+		if err != nil {
+			return err
+		}
+		err = PicStore.Put(UserPicKey(userName, &PicMeta{PID: meta.PID, Format: f}), extra)
+		if err != nil {
+			return err
+		}
+		meta.Extra = append(meta.Extra, f)
+	}
 	return nil
 }
 
+//CropPic 裁剪图片，rect为按EXIF方向旋转后的像素坐标，保持原格式
+func CropPic(buffer []byte, rect image.Rectangle) ([]byte, error) {
+	options := bimg.Options{
+		Top:           rect.Min.Y,
+		Left:          rect.Min.X,
+		AreaWidth:     rect.Dx(),
+		AreaHeight:    rect.Dy(),
+		Quality:       100,
+		StripMetadata: true,
+	}
+	//bimg中Top和Left都为0时不裁剪，与bimg的Extract一样设置Top为-1
+	if options.Top == 0 && options.Left == 0 {
+		options.Top = -1
+	}
+	return bimg.NewImage(buffer).Process(options)
+}
+
+//PicDHash 计算图片的感知哈希（dHash）：缩小为9x8的灰度图，每行比较相邻像素的亮度得到64位
+//重新保存、压缩、缩放后的图片哈希值基本不变，汉明距离越小越相似
+func PicDHash(buffer []byte) (int64, error) {
+	small, err := bimg.NewImage(buffer).Process(bimg.Options{
+		Width:          9,
+		Height:         8,
+		Force:          true,
+		Interpretation: bimg.InterpretationBW,
+		Type:           bimg.PNG,
+		StripMetadata:  true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	img, err := png.Decode(bytes.NewReader(small))
+	if err != nil {
+		return 0, err
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != 9 || bounds.Dy() != 8 {
+		return 0, fmt.Errorf("dhash: unexpected size %dx%d", bounds.Dx(), bounds.Dy())
+	}
+	var gray = func(x int, y int) uint8 {
+		return color.GrayModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray).Y
+	}
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray(x, y) > gray(x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return int64(hash), nil
+}
+
 //TestDB 测试数据库连接
 func TestDB() {
 	//========连接测试====PostgreSQL数据库===========
@@ -171,9 +316,103 @@ func SyncDB(engine *xorm.Engine) {
 		engine.ShowExecTime(true)
 	}
 
-	err := engine.Sync2(new(Coin), new(Skill), new(Snap), new(SnapSet), new(Pay), new(Repay), new(Info), new(News), new(Req), new(Img), new(Sum))
+	err := engine.Sync2(new(Coin), new(Skill), new(Snap), new(SnapSet), new(Pay), new(Repay), new(Info), new(News), new(Req), new(Img), new(Sum), new(Tag), new(Slot), new(Bundle), new(ImgJob), new(ImgUpload), new(Invoice), new(CoinKey), new(Ledger), new(LedgerCheckpoint), new(Voucher), new(GiftBatch), new(GiftCode))
 	if err != nil {
 		log.Fatal("sync db err:", err)
 		panic(err.Error())
 	}
+
+	//xorm无法通过tag建立的索引
+	for _, sql := range indexSQL {
+		_, err = engine.Exec(sql)
+		if err != nil {
+			log.Fatal("sync index err:", err)
+			panic(err.Error())
+		}
+	}
+
+	//只可新建的表，禁止修改和删除
+	for _, sql := range appendOnlySQL() {
+		_, err = engine.Exec(sql)
+		if err != nil {
+			log.Fatal("sync trigger err:", err)
+			panic(err.Error())
+		}
+	}
+
+	syncSkillTerms(engine)
+	syncTags(engine)
+	syncImgCreated(engine)
+	syncReqCancelled(engine)
+}
+
+//indexSQL 全文搜索、jsonb等索引
+var indexSQL = []string{
+	//技能全文搜索
+	"CREATE INDEX IF NOT EXISTS skill_terms_fts_idx ON skill USING GIN (to_tsvector('simple', coalesce(terms, '')))",
+	//技能标签包含查询 tags @> '["xx"]'
+	"CREATE INDEX IF NOT EXISTS skill_tags_gin_idx ON skill USING GIN (tags jsonb_path_ops)",
+	//标签别名包含查询，以及标签前缀查询 norm LIKE 'xx%'
+	"CREATE INDEX IF NOT EXISTS tag_aliases_gin_idx ON tag USING GIN (aliases jsonb_path_ops)",
+	"CREATE INDEX IF NOT EXISTS tag_norm_pattern_idx ON tag (norm varchar_pattern_ops)",
+	//每个用户每个批次只能领取一个兑换码
+	"CREATE UNIQUE INDEX IF NOT EXISTS gift_code_batch_claimer_idx ON gift_code (batch_id, claimer) WHERE claimer <> ''",
+}
+
+//syncTags 标签表为空时，根据已有的技能生成标签
+func syncTags(engine *xorm.Engine) {
+	count, err := engine.Count(new(Tag))
+	if err != nil || count > 0 {
+		return
+	}
+	skills := []*Skill{}
+	err = engine.Cols("tags").Find(&skills)
+	if err != nil {
+		log.Println("sync tags err:", err)
+		return
+	}
+	tags := []string{}
+	for _, skill := range skills {
+		tags = append(tags, skill.Tags...)
+	}
+	names, err := NormalizeTags(engine, tags)
+	if err == nil {
+		err = CreateTags(engine, names)
+	}
+	if err != nil {
+		log.Println("sync tags err:", err)
+		return
+	}
+	UpdateTagSkillNum(engine, names)
+}
+
+//syncSkillTerms 为旧的技能数据生成全文搜索的分词
+func syncSkillTerms(engine *xorm.Engine) {
+	skills := []*Skill{}
+	err := engine.Unscoped().Where("terms IS NULL").Find(&skills)
+	if err != nil {
+		log.Println("sync skill terms err:", err)
+		return
+	}
+	for _, skill := range skills {
+		//直接更新，避免version自增
+		skill.SetTerms()
+		engine.Exec("UPDATE skill SET terms = ? WHERE id = ?", skill.Terms, skill.ID)
+	}
+}
+
+//syncImgCreated 为旧的图片数据补上上传时间，避免图片回收时因上传时间为空而被立即删除
+func syncImgCreated(engine *xorm.Engine) {
+	_, err := engine.Exec("UPDATE img SET created = ? WHERE created IS NULL", time.Now())
+	if err != nil {
+		log.Println("sync img created err:", err)
+	}
+}
+
+//syncReqCancelled 旧的取消状态24在21-29（拒绝）区间内，会计入执行方的拒绝量，改为32
+func syncReqCancelled(engine *xorm.Engine) {
+	_, err := engine.Exec("UPDATE req SET state = 32 WHERE state = 24")
+	if err != nil {
+		log.Println("sync req cancelled err:", err)
+	}
 }
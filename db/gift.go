@@ -0,0 +1,64 @@
+package db
+
+import (
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+//GiftBatch 兑换码批次，对应gift_batch表。发行者为推广创建一批一次性的兑换码，领取者领取时发行者向其发行鸟币
+//每个用户每个批次只能领取一个兑换码，过期后不可领取
+type GiftBatch struct {
+	ID          uint64    `json:"batchID" xorm:"not null default nextval('gift_batch_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Owner       string    `json:"owner" xorm:"not null index VARCHAR(20)"`                     //发行者鸟币号，发行的即此鸟币
+	Amount      uint64    `json:"amount" xorm:"not null BIGINT"`                               //每个兑换码发行的数额
+	IsMarker    bool      `json:"isMarker" xorm:"not null BOOL"`                               //是否是血盟
+	Memo        string    `json:"memo,omitempty" xorm:"not null default '' TEXT"`              //备注，领取时作为转账的备注
+	Count       uint32    `json:"count" xorm:"not null INTEGER"`                               //兑换码的数量
+	Claimed     uint32    `json:"claimed" xorm:"not null default 0 INTEGER"`                   //已领取的数量
+	ExpireHours uint32    `json:"expireHours" xorm:"not null default 0 INTEGER"`               //多少小时后过期，签名内容的一部分
+	KeyID       uint64    `json:"keyID,omitempty" xorm:"not null default 0 BIGINT 'key_id'"`   //签名使用的公钥ID，0表示未签名
+	Sig         string    `json:"sig,omitempty" xorm:"not null default '' index VARCHAR(128)"` //发行者对批次的ed25519签名（hex），签名内容见controller/txsign.go
+	SignedAt    int64     `json:"signedAt,omitempty" xorm:"not null default 0 BIGINT"`         //签名时间（unix秒）
+	Expires     time.Time `json:"expires" xorm:"not null index"`                               //过期时间
+	Created     time.Time `json:"created" xorm:"not null created"`
+}
+
+//GiftCode 兑换码，对应gift_code表
+type GiftCode struct {
+	ID        uint64    `json:"-" xorm:"not null default nextval('gift_code_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	BatchID   uint64    `json:"-" xorm:"not null index BIGINT 'batch_id'"`                                 //兑换码批次ID
+	Code      string    `json:"code" xorm:"not null unique VARCHAR(16)"`                                   //兑换码
+	Claimer   string    `json:"claimer,omitempty" xorm:"not null default '' index VARCHAR(20)"`            //领取者鸟币号，为空表示未领取
+	PayGUID   string    `json:"payGUID,omitempty" xorm:"not null default '' index VARCHAR(36) 'pay_guid'"` //领取时发行的pay记录的guid
+	ClaimedAt time.Time `json:"claimedAt,omitempty" xorm:"index"`                                          //领取时间
+}
+
+//IsClaimable 兑换码批次是否可以领取：未过期并且未领取完
+func (batch *GiftBatch) IsClaimable() bool {
+	return batch.Claimed < batch.Count && batch.Expires.After(time.Now())
+}
+
+//ClaimGiftCode 领取兑换码，返回是否领取成功。须在发行的事务中调用
+//使用条件更新，兑换码已被领取、领取者已领取过此批次的兑换码或批次已过期时返回false
+func ClaimGiftCode(engine xorm.Interface, code *GiftCode, claimer string, payGUID string) (bool, error) {
+	now := time.Now()
+	res, err := engine.Exec("UPDATE gift_code SET claimer = ?, pay_guid = ?, claimed_at = ? WHERE id = ? AND claimer = '' "+
+		"AND NOT EXISTS (SELECT 1 FROM gift_code WHERE batch_id = ? AND claimer = ?) "+
+		"AND EXISTS (SELECT 1 FROM gift_batch WHERE id = ? AND expires > ?)",
+		claimer, payGUID, now, code.ID, code.BatchID, claimer, code.BatchID, now)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected != 1 {
+		return false, err
+	}
+	_, err = engine.Exec("UPDATE gift_batch SET claimed = claimed + 1 WHERE id = ?", code.BatchID)
+	return err == nil, err
+}
+
+//CountGiftClaims 用户自since以来领取的兑换码数量，用于限制领取频率
+func CountGiftClaims(engine xorm.Interface, claimer string, since time.Time) (int64, error) {
+	return engine.Where("claimer = ? AND claimed_at > ?", claimer, since).Count(new(GiftCode))
+}
@@ -1,11 +1,83 @@
 package db
 
+import (
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
 // Img 对应img表，所有新的原图都要生成一个hash保存，用来检查是否有相同的图片存在。
-// 知道name和guid就可以拼接得到服务器存放图片的路径，如： ./files/udata/鸟币号/pic/鸟币号_guid-biggest.jpg
+// 知道name和guid就可以拼接得到服务器存放图片的路径，如： 鸟币号/pic/鸟币号_guid-biggest.jpg
 type Img struct {
-	Hash        string `xorm:"not null pk VARCHAR(64)"`                  //客户端上传的原图的hash值，BLAKE2算法，注意是原图。
-	Owner       string `xorm:"not null index VARCHAR(20)"`               //鸟币号
-	GUID        string `xorm:"not null index unique VARCHAR(36) 'guid'"` //图片唯一id
-	Thumb       *Pic   `json:"thumb,omitempty" xorm:"not null JSONB"`    //缩略图属性
-	OriginalDir string `json:"-" xorm:"-"`                               //上传时临时存放新的原图的路径
+	Hash        string    `xorm:"not null pk VARCHAR(64)"`                          //客户端上传的原图的hash值，BLAKE2算法，注意是原图。
+	Owner       string    `xorm:"not null index VARCHAR(20)"`                       //鸟币号
+	GUID        string    `xorm:"not null index unique VARCHAR(36) 'guid'"`         //图片唯一id
+	Thumb       *Pic      `json:"thumb,omitempty" xorm:"not null JSONB"`            //缩略图属性
+	PHash       int64     `json:"-" xorm:"not null default 0 index BIGINT 'phash'"` //感知哈希（dHash），0表示未计算
+	DupOf       string    `json:"-" xorm:"VARCHAR(64) 'dup_of'"`                    //近似图片合并时，使用了哪张图片（hash）的缩略图
+	Created     time.Time `json:"-" xorm:"created"`                                 //上传时间，图片回收时未被引用的图片超过宽限期才删除
+	OriginalKey string    `json:"-" xorm:"-"`                                       //上传时临时存放新的原图的key
+	Focus       *PicFocus `json:"-" xorm:"-"`                                       //上传时指定的焦点，加入图片处理任务
+}
+
+//PIDs 图片所有缩略图的pid
+func (pic *Pic) PIDs() []string {
+	pids := []string{}
+	if pic == nil {
+		return pids
+	}
+	for _, meta := range []*PicMeta{pic.Biggest, pic.Large, pic.Middle, pic.Small} {
+		if meta != nil && meta.PID != "" {
+			pids = append(pids, meta.PID)
+		}
+	}
+	return pids
+}
+
+//TouchImg 已上传过的图片被再次使用（重复上传或按hash引用）时更新上传时间，重新计算图片回收的宽限期
+func TouchImg(engine xorm.Interface, hash string) error {
+	_, err := engine.Exec("UPDATE img SET created = ? WHERE hash = ?", time.Now(), hash)
+	return err
+}
+
+//UserPicPrefix 用户图片在存储中的key前缀，如：鸟币号/pic/
+func UserPicPrefix(userName string) string {
+	return userName + "/pic/"
+}
+
+//GetUserPicUsage 用户图片已使用的空间（字节）
+func GetUserPicUsage(userName string) (int64, error) {
+	var used int64
+	infos, err := PicStore.List(UserPicPrefix(userName))
+	for _, info := range infos {
+		used += info.Size
+	}
+	return used, err
+}
+
+//phashDistanceSQL 数据库中phash与参数的汉明距离
+const phashDistanceSQL = "length(replace(((phash # ?)::bit(64))::text, '0', ''))"
+
+//PHashDistance 两个感知哈希的汉明距离，即不同的位数
+func PHashDistance(a int64, b int64) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+//FindSimilarImg 查找owner上传的、感知哈希的汉明距离不超过distance的图片，优先距离最近、最早上传的，没有时返回nil
+//phash为0的图片（未计算或纯色图片）不参与查找。只查找本人的图片：不同的照片也可能距离很近，
+//而且其他用户的缩略图不计入本人的存储空间，开启SignedOnly时也无法访问。不同用户的近似图片见管理员的报表
+func FindSimilarImg(engine xorm.Interface, owner string, phash int64, distance int) (*Img, error) {
+	if phash == 0 {
+		return nil, nil
+	}
+	img := new(Img)
+	order := strings.Replace(phashDistanceSQL, "?", "("+strconv.FormatInt(phash, 10)+")", 1) + ", created"
+	has, err := engine.Where("owner = ? AND phash <> 0 AND "+phashDistanceSQL+" <= ?", owner, phash, distance).OrderBy(order).Get(img)
+	if err != nil || has == false {
+		return nil, err
+	}
+	return img, nil
 }
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"time"
+)
+
+//ImgJob 图片处理任务，对应img_job表。生成缩略图、二维码、默认头像等耗时操作保存为任务，由main/jobImgProcess()的worker处理
+//任务保存在数据库中，服务重启后继续处理，失败时按config的JobRetrySeconds延时重试，最多JobMaxTries次
+/**
+任务状态 state：
+0.	等待处理（包括等待重试）
+1.	处理中（服务重启时恢复为0）
+2.	已完成
+3.	已失败（超过最大重试次数）
+*/
+type ImgJob struct {
+	ID      uint64        `json:"jobID" xorm:"not null default nextval('img_job_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Owner   string        `json:"owner" xorm:"not null index VARCHAR(20)"`                                  //鸟币号
+	Kind    string        `json:"kind" xorm:"not null VARCHAR(10)"`                                         //任务类型，见config的ImgJobKind
+	State   uint8         `json:"state" xorm:"not null default 0 index(img_job_state_run_at_idx) SMALLINT"` //任务状态
+	Tries   uint32        `json:"tries" xorm:"not null default 0 INTEGER"`                                  //已执行的次数
+	RunAt   time.Time     `json:"-" xorm:"not null index(img_job_state_run_at_idx)"`                        //下次执行的时间
+	SkillID uint64        `json:"skillID,omitempty" xorm:"not null default 0 BIGINT 'skill_id'"`            //完成后更新图片的技能
+	Items   []*ImgJobItem `json:"items,omitempty" xorm:"JSONB"`                                             //要处理的图片
+	Pics    []*Pic        `json:"pics,omitempty" xorm:"JSONB"`                                              //处理结果，即生成的缩略图
+	Err     string        `json:"err,omitempty" xorm:"TEXT"`                                                //最近一次失败的原因
+	Created time.Time     `json:"created" xorm:"not null created"`
+	Updated time.Time     `json:"updated" xorm:"updated"`
+}
+
+//ImgJobItem 图片处理任务中的一张图片
+//新上传的图片原图临时保存在：./files/udata/鸟币号/pic/鸟币号_guid-original.jpg，处理完成后删除
+type ImgJobItem struct {
+	Hash  string    `json:"hash"`            //原图的hash值
+	GUID  string    `json:"guid"`            //图片唯一id
+	Focus *PicFocus `json:"focus,omitempty"` //焦点，Middle和Small缩略图以焦点为中心裁剪为正方形
+}
+
+//PicFocus 图片的焦点，按EXIF方向旋转后的原图像素坐标
+type PicFocus struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
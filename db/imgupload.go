@@ -0,0 +1,28 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+//ImgUpload 断点续传的图片上传，对应img_upload表。协议参考tus：创建上传后用PATCH按偏移量分块上传，全部上传后完成上传
+//已上传的分块保存在存储中：鸟币号/upload/上传id/偏移量，完成或过期后删除
+type ImgUpload struct {
+	ID       string    `json:"id" xorm:"not null pk VARCHAR(20) 'id'"`                 //上传id，xid
+	Owner    string    `json:"-" xorm:"not null index VARCHAR(20)"`                    //鸟币号
+	Size     int64     `json:"size" xorm:"not null BIGINT"`                            //图片的总大小（字节）
+	Received int64     `json:"offset" xorm:"not null default 0 BIGINT"`                //已上传的大小，即下一个分块的偏移量
+	Focus    string    `json:"focus,omitempty" xorm:"not null default '' VARCHAR(30)"` //图片的焦点"x,y"，完成上传时检查
+	Expires  time.Time `json:"expires" xorm:"not null index"`                          //过期时间，过期后由图片回收删除
+	Created  time.Time `json:"-" xorm:"created"`
+}
+
+//UserUploadPrefix 上传的分块在存储中的key前缀，如：鸟币号/upload/上传id/
+func UserUploadPrefix(userName string, id string) string {
+	return userName + "/upload/" + id + "/"
+}
+
+//UserUploadChunkKey 分块的key，偏移量补0到12位，按key排序即按偏移量排序
+func UserUploadChunkKey(userName string, id string, offset int64) string {
+	return fmt.Sprintf("%s%012d", UserUploadPrefix(userName, id), offset)
+}
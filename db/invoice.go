@@ -0,0 +1,54 @@
+package db
+
+import (
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+//Invoice 收款单，对应invoice表。收款方创建收款单，付款方转账时只需填写收款单ID，收款方、鸟币和数额由收款单确定
+/**
+收款单状态 state：
+0.	待付款（可多次使用的收款单付款后仍为0）
+1.	已付款（仅可使用一次的收款单）
+2.	已作废
+*/
+type Invoice struct {
+	ID       uint64    `json:"invoiceID" xorm:"not null default nextval('invoice_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Owner    string    `json:"owner" xorm:"not null index VARCHAR(20)"`        //收款方鸟币号，即创建者
+	Coins    []string  `json:"coins" xorm:"not null JSONB"`                    //接受的鸟币，自己发行的鸟币或其他鸟币
+	Amount   uint64    `json:"amount" xorm:"not null BIGINT"`                  //收款数额
+	Memo     string    `json:"memo,omitempty" xorm:"not null default '' TEXT"` //备注
+	MultiUse bool      `json:"multiUse" xorm:"not null default false BOOL"`    //是否可以多次付款
+	State    uint8     `json:"state" xorm:"not null default 0 SMALLINT"`       //收款单状态
+	Paid     uint32    `json:"paid" xorm:"not null default 0 INTEGER"`         //已付款的次数
+	Expires  time.Time `json:"expires" xorm:"index"`                           //过期时间，为零值表示不过期
+	Created  time.Time `json:"created" xorm:"not null created"`
+	Updated  time.Time `json:"updated" xorm:"updated"`
+}
+
+//AcceptCoin 收款单是否接受此鸟币
+func (invoice *Invoice) AcceptCoin(coinName string) bool {
+	for _, coin := range invoice.Coins {
+		if coin == coinName {
+			return true
+		}
+	}
+	return false
+}
+
+//IsPayable 收款单是否可以付款：待付款并且未过期
+func (invoice *Invoice) IsPayable() bool {
+	return invoice.State == 0 && (invoice.Expires.IsZero() || invoice.Expires.After(time.Now()))
+}
+
+//PayInvoice 付款时更新收款单，仅可使用一次的收款单标记为已付款，返回是否更新成功
+//使用条件更新，并发付款同一收款单时只有一个可以成功
+func PayInvoice(engine xorm.Interface, invoiceID uint64) (bool, error) {
+	res, err := engine.Exec("UPDATE invoice SET paid = paid + 1, state = CASE WHEN multi_use THEN 0 ELSE 1 END, updated = ? WHERE id = ? AND state = 0 AND (expires IS NULL OR expires > ?)", time.Now(), invoiceID, time.Now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/util"
+)
+
+//Ledger 账本，对应ledger表。pay、repay记录插入时在同一事务中按顺序追加，每条账本记录的hash链接上一条：
+//hash = sha256(上一条的hash + 记录内容的规范编码)，第一条的上一条hash为空。此表只可新建，不可删改。
+//启用账本之前的pay、repay记录不在账本中
+type Ledger struct {
+	ID       uint64    `json:"seq" xorm:"not null default nextval('ledger_id_seq'::regclass) pk BIGINT autoincr 'id'"` //账本序号，即追加的顺序
+	Tbl      string    `json:"table" xorm:"not null unique(ledger_record_idx) VARCHAR(10) 'tbl'"`                      //pay或repay
+	RecordID uint64    `json:"recordID" xorm:"not null unique(ledger_record_idx) BIGINT 'record_id'"`                  //pay或repay记录的id
+	Prev     string    `json:"prev" xorm:"not null default '' VARCHAR(64)"`                                            //上一条账本记录的hash
+	Hash     string    `json:"hash" xorm:"not null unique VARCHAR(64)"`                                                //hex编码
+	Created  time.Time `json:"created" xorm:"not null created"`
+}
+
+//LedgerCheckpoint 账本的Merkle检查点，对应ledger_checkpoint表。定时为上一个检查点之后追加的账本记录生成Merkle树并公开根哈希，
+//叶子依次为账本记录的hash（解码后的32字节），计算方式见util.MerkleRoot。此表只可新建，不可删改
+type LedgerCheckpoint struct {
+	ID      uint64    `json:"checkpointID" xorm:"not null default nextval('ledger_checkpoint_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	FromSeq uint64    `json:"fromSeq" xorm:"not null BIGINT"`        //包含的第一条账本记录的序号
+	ToSeq   uint64    `json:"toSeq" xorm:"not null unique BIGINT"`   //包含的最后一条账本记录的序号
+	Count   uint32    `json:"count" xorm:"not null INTEGER"`         //包含的账本记录数
+	Root    string    `json:"root" xorm:"not null VARCHAR(64)"`      //Merkle根哈希
+	Head    string    `json:"head" xorm:"not null VARCHAR(64)"`      //最后一条账本记录的hash，即此时哈希链的头
+	Created time.Time `json:"created" xorm:"not null created index"` //生成时间
+}
+
+const (
+	//ledgerVersion 记录内容编码的版本，修改字段时增加版本号
+	ledgerVersion = 1
+	//ledgerLockKey 追加账本和生成检查点时的advisory lock，保证账本按顺序追加
+	ledgerLockKey = 0x6c6467
+)
+
+//LedgerHash 账本记录的hash = sha256(上一条的hash + 记录内容)
+func LedgerHash(prev string, content []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//LedgerContent pay记录内容的规范编码，见util.CanonicalMessage
+func (pay *Pay) LedgerContent() []byte {
+	return util.CanonicalMessage(ledgerHeader(config.NewsTablePay),
+		"id", strconv.FormatUint(pay.ID, 10),
+		"payer", pay.Payer,
+		"receiver", pay.Receiver,
+		"coin", pay.TransCoin,
+		"amount", strconv.FormatUint(pay.Amount, 10),
+		"snapSet", strconv.FormatUint(pay.SnapSetID, 10),
+		"issue", strconv.FormatBool(pay.IsIssue),
+		"marker", strconv.FormatBool(pay.IsMarker),
+		"guid", pay.GUID,
+		"invoice", strconv.FormatUint(pay.InvoiceID, 10),
+		"memo", pay.Memo,
+		"key", strconv.FormatUint(pay.KeyID, 10),
+		"sig", pay.Sig,
+		"signedAt", strconv.FormatInt(pay.SignedAt, 10),
+		"created", strconv.FormatInt(pay.Created.Unix(), 10))
+}
+
+//LedgerContent repay记录内容的规范编码，见util.CanonicalMessage
+func (repay *Repay) LedgerContent() []byte {
+	return util.CanonicalMessage(ledgerHeader(config.NewsTableRePay),
+		"id", strconv.FormatUint(repay.ID, 10),
+		"req", strconv.FormatUint(repay.ReqID, 10),
+		"snap", strconv.FormatUint(repay.SnapID, 10),
+		"snapSet", strconv.FormatUint(repay.SnapSetID, 10),
+		"guid", repay.GUID,
+		"bearer", repay.Bearer,
+		"issuer", repay.Issuer,
+		"marker", strconv.FormatBool(repay.IsMarker),
+		"amount", strconv.FormatUint(repay.Amount, 10),
+		"memo", repay.Memo,
+		"key", strconv.FormatUint(repay.KeyID, 10),
+		"sig", repay.Sig,
+		"signedAt", strconv.FormatInt(repay.SignedAt, 10),
+		"created", strconv.FormatInt(repay.Created.Unix(), 10))
+}
+
+func ledgerHeader(table string) string {
+	return "niaobi:ledger:" + table + ":" + strconv.Itoa(ledgerVersion)
+}
+
+//LedgerRecordContent 读取账本记录对应的pay或repay记录的内容，记录不存在时返回nil
+func LedgerRecordContent(engine xorm.Interface, table string, id uint64) ([]byte, error) {
+	switch table {
+	case config.NewsTablePay:
+		pay := Pay{}
+		has, err := engine.ID(id).Get(&pay)
+		if err != nil || has == false {
+			return nil, err
+		}
+		return pay.LedgerContent(), nil
+	case config.NewsTableRePay:
+		repay := Repay{}
+		has, err := engine.ID(id).Get(&repay)
+		if err != nil || has == false {
+			return nil, err
+		}
+		return repay.LedgerContent(), nil
+	}
+	return nil, nil
+}
+
+//LockLedger 锁住账本直到事务结束，须在事务中调用
+func LockLedger(session *xorm.Session) error {
+	_, err := session.Exec("SELECT pg_advisory_xact_lock(?)", ledgerLockKey)
+	return err
+}
+
+//AppendLedger 将guid相同的pay或repay记录按id顺序追加到账本，须在插入记录的事务中调用
+//追加时锁住账本，并发的交易依次追加，账本序号的顺序即提交的顺序
+func AppendLedger(session *xorm.Session, table string, guid string) error {
+	err := LockLedger(session)
+	if err != nil {
+		return err
+	}
+
+	ids := []uint64{}
+	contents := [][]byte{}
+	switch table {
+	case config.NewsTablePay:
+		pays := []*Pay{}
+		err = session.Where("guid = ?", guid).Asc("id").Find(&pays)
+		for _, pay := range pays {
+			ids = append(ids, pay.ID)
+			contents = append(contents, pay.LedgerContent())
+		}
+	case config.NewsTableRePay:
+		repays := []*Repay{}
+		err = session.Where("guid = ?", guid).Asc("id").Find(&repays)
+		for _, repay := range repays {
+			ids = append(ids, repay.ID)
+			contents = append(contents, repay.LedgerContent())
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	last := Ledger{}
+	_, err = session.Desc("id").Cols("hash").Get(&last)
+	if err != nil {
+		return err
+	}
+	prev := last.Hash
+	for i := range ids {
+		entry := Ledger{Tbl: table, RecordID: ids[i], Prev: prev, Hash: LedgerHash(prev, contents[i])}
+		_, err = session.InsertOne(&entry)
+		if err != nil {
+			return err
+		}
+		prev = entry.Hash
+	}
+	return nil
+}
+
+//appendOnlySQL 禁止修改和删除只可新建的表：pay、repay、snap、snap_set和账本
+//需要修复数据时，管理员可先执行 ALTER TABLE 表名 DISABLE TRIGGER 表名_append_only
+func appendOnlySQL() []string {
+	sqls := []string{`CREATE OR REPLACE FUNCTION append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql`}
+	for _, table := range []string{"pay", "repay", "snap", "snap_set", "ledger", "ledger_checkpoint"} {
+		sqls = append(sqls,
+			"DROP TRIGGER IF EXISTS "+table+"_append_only ON "+table,
+			"CREATE TRIGGER "+table+"_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON "+table+" FOR EACH STATEMENT EXECUTE PROCEDURE append_only()")
+	}
+	return sqls
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedgerHashTamper(t *testing.T) {
+	pay := Pay{ID: 7, Payer: "alice", Receiver: "bob", TransCoin: "alice", Amount: 30, SnapSetID: 3, IsIssue: true, GUID: "c0ffee", Memo: "午饭", Created: time.Unix(1600000000, 0)}
+	prev := LedgerHash("", []byte("genesis"))
+	hash := LedgerHash(prev, pay.LedgerContent())
+	if len(hash) != 64 || hash != LedgerHash(prev, pay.LedgerContent()) {
+		t.Fatalf("hash = %q is not stable", hash)
+	}
+
+	//修改记录的任一字段或上一条的hash，hash都会改变
+	tampers := map[string]func(p *Pay){
+		"amount":   func(p *Pay) { p.Amount++ },
+		"payer":    func(p *Pay) { p.Payer = "mallory" },
+		"receiver": func(p *Pay) { p.Receiver = "mallory" },
+		"coin":     func(p *Pay) { p.TransCoin = "bob" },
+		"issue":    func(p *Pay) { p.IsIssue = false },
+		"marker":   func(p *Pay) { p.IsMarker = true },
+		"memo":     func(p *Pay) { p.Memo = "晚饭" },
+		"sig":      func(p *Pay) { p.Sig = "00" },
+		"created":  func(p *Pay) { p.Created = p.Created.Add(time.Second) },
+		//备注中伪造字段：换行被转义，不能与真实字段混淆
+		"memo injection": func(p *Pay) { p.Memo = "午饭\nkey=1" },
+	}
+	for name, tamper := range tampers {
+		tampered := pay
+		tamper(&tampered)
+		if LedgerHash(prev, tampered.LedgerContent()) == hash {
+			t.Errorf("tampering %s does not change the hash", name)
+		}
+	}
+	if LedgerHash(LedgerHash("", []byte("other")), pay.LedgerContent()) == hash {
+		t.Error("changing prev does not change the hash")
+	}
+
+	//pay和repay使用不同的头，相同字段值不会得到相同的内容
+	repay := Repay{ID: 7, GUID: "c0ffee", Bearer: "alice", Issuer: "bob", Amount: 30, Created: pay.Created}
+	if string(repay.LedgerContent()) == string(pay.LedgerContent()) {
+		t.Error("pay and repay share the same content")
+	}
+}
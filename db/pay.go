@@ -17,5 +17,10 @@ type Pay struct {
 	IsIssue   bool      `json:"isIssue" xorm:"not null BOOL"`                                                                                   //标记是发行还是转手
 	IsMarker  bool      `json:"isMarker" xorm:"not null BOOL"`                                                                                  //是否是血盟，血盟为true时，忽略技能快照组snap_set_id
 	GUID      string    `json:"guid" xorm:"index VARCHAR(36) 'guid'"`                                                                           //转手时可能用到多个版本的鸟币，每个版本都需要新建一个pay，但这些pay都共享同一个guid
+	InvoiceID uint64    `json:"invoiceID,omitempty" xorm:"not null default 0 index BIGINT 'invoice_id'"`                                        //按收款单付款时的收款单ID
+	Memo      string    `json:"memo,omitempty" xorm:"not null default '' TEXT"`                                                                 //备注，付款方填写
+	KeyID     uint64    `json:"keyID,omitempty" xorm:"not null default 0 BIGINT 'key_id'"`                                                      //签名使用的公钥ID，0表示未签名
+	Sig       string    `json:"sig,omitempty" xorm:"not null default '' index VARCHAR(128)"`                                                    //付款方对交易的ed25519签名（hex），签名内容见controller/txsign.go
+	SignedAt  int64     `json:"signedAt,omitempty" xorm:"not null default 0 BIGINT"`                                                            //签名时间（unix秒），签名内容的一部分
 	Created   time.Time `json:"created" xorm:"not null created"`                                                                                //交易时间
 }
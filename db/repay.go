@@ -18,5 +18,9 @@ type Repay struct {
 	Issuer    string    `json:"issuer" xorm:"not null index index(repay_bearer_issuer_idx) VARCHAR(20)"` //发币者的鸟币号
 	IsMarker  bool      `json:"isMarker" xorm:"not null BOOL"`                                           //是否是血盟，是则忽略技能ID
 	Amount    uint64    `json:"amount" xorm:"not null BIGINT"`                                           //兑现的鸟币数量，大于0的整数
+	Memo      string    `json:"memo,omitempty" xorm:"not null default '' TEXT"`                          //备注，发行者接受兑现请求时填写
+	KeyID     uint64    `json:"keyID,omitempty" xorm:"not null default 0 BIGINT 'key_id'"`               //签名使用的公钥ID，0表示未签名
+	Sig       string    `json:"sig,omitempty" xorm:"not null default '' index VARCHAR(128)"`             //发行者对交易的ed25519签名（hex），签名内容见controller/txsign.go
+	SignedAt  int64     `json:"signedAt,omitempty" xorm:"not null default 0 BIGINT"`                     //签名时间（unix秒），签名内容的一部分
 	Created   time.Time `json:"created" xorm:"not null created"`                                         //交易时间
 }
@@ -13,16 +13,21 @@ import (
 	执行方提示—血盟：收到新的血盟兑现请求（请在2小时内确认）
 20.	请求方提示：鸟币已被成功回收，等待兑现中（请求方显示2个按钮："已兑现"、"未兑现"按钮）
    	执行方提示：鸟币已回收，尚未完成兑现（兑现中）
+	兑现中超过RemindDays天、EscalateDays天时分别提醒双方，超过AutoDays天时自动修改为AutoState状态（见config.toml的remind）
 21.	请求方提示：对方拒绝了兑现请求
 	执行方提示：已拒绝了对方的请求
 22. 请求方提示：兑现请求超时未接受
 	执行方提示：由于超时，系统自动拒绝了对方的请求
+	（21、22时释放预约的时段）
 23.	请求方提示：对方未兑现技能(请求方点击了"未兑现"按钮)
-   	执行方提示：未兑现，可选择"重新兑现"(兑现方点击"重新兑现"按钮后状态改为20"兑现中"，两次重做的间隔至少大于3天)
+   	执行方提示：未兑现，可选择"重新兑现"(兑现方点击"重新兑现"按钮后状态改为20"兑现中"，两次重做的间隔至少大于RedoDays天，最多重做MaxRedo次)
 30.	请求方提示：交易完成
 	执行方提示：交易完成
 31.	请求方提示：由于鸟币不足等原因，交易自动关闭
-	执行方提示：由于对方鸟币不足等原因，交易自动关闭
+	执行方提示：由于对方鸟币不足等原因，交易自动关闭（释放预约的时段）
+32.	请求方提示：已取消兑现请求
+	执行方提示：对方取消了兑现请求（释放预约的时段）
+	（21-29表示执行方拒绝或未兑现，计入执行方的拒绝量，取消是请求方的操作，因此不能放在此区间）
 */
 type Req struct {
 	ID       uint64    `json:"reqID" xorm:"not null default nextval('req_id_seq'::regclass) pk BIGINT autoincr 'id'"`
@@ -33,6 +38,40 @@ type Req struct {
 	Amount   uint64    `json:"amount" xorm:"not null BIGINT"`                                                                                                        //兑现的鸟币数量，大于0的整数
 	State    uint8     `json:"state" xorm:"not null default 1 index(req_bearer_issuer_state_idx) index(req_bearer_state_idx) index(req_issuer_state_idx) SMALLINT"`  //兑现状态（兑现时需要发行者确认，默认2小时响应，超时自动视为拒绝)
 	Closed   bool      `json:"closed" xorm:"not null default false BOOL"`                                                                                            //系统是否已自动关闭交易
+	RedoNum  uint32    `json:"redoNum" xorm:"not null default 0 INTEGER"`                                                                                            //已重做的次数
+	SlotID   uint64    `json:"slotID,omitempty" xorm:"not null default 0 BIGINT 'slot_id'"`                                                                          //预约的时段，0表示未预约
+	TierQty  uint64    `json:"tierQty,omitempty" xorm:"not null default 0 BIGINT"`                                                                                   //所选价格档位的数量，0表示按单价兑现
+	Memo     string    `json:"memo,omitempty" xorm:"not null default '' TEXT"`                                                                                       //备注，持有者发送兑现请求时填写
+	KeyID    uint64    `json:"keyID,omitempty" xorm:"not null default 0 BIGINT 'key_id'"`                                                                            //签名使用的公钥ID，0表示未签名
+	Sig      string    `json:"sig,omitempty" xorm:"not null default '' index VARCHAR(128)"`                                                                          //持有者对交易的ed25519签名（hex），签名内容见controller/txsign.go
+	SignedAt int64     `json:"signedAt,omitempty" xorm:"not null default 0 BIGINT"`                                                                                  //签名时间（unix秒），签名内容的一部分
 	Created  time.Time `json:"created" xorm:"not null created"`
 	Updated  time.Time `json:"updated" xorm:"updated"`
 }
+
+//ReqRefusedCond 执行方拒绝或未兑现（21-29）的查询条件，与IsRefused一致
+const ReqRefusedCond = "state > 20 and state < 30"
+
+//IsRefused 执行方是否拒绝或未兑现（21-29），计入执行方的拒绝量
+func (req *Req) IsRefused() bool {
+	return req.State > 20 && req.State < 30
+}
+
+//CanRedo 执行方是否可以重新兑现：仅在21、22、23时
+func (req *Req) CanRedo() bool {
+	return req.IsRefused()
+}
+
+//CanDone 请求方是否可以标记交易完成：仅在20、21、22、23时
+func (req *Req) CanDone() bool {
+	return req.State == 20 || req.IsRefused()
+}
+
+//ReqRemind 兑现中(state=20)的延时提醒任务，放入beanstalk的remind tube
+//Stage：1.提醒 2.再次提醒 3.自动处理
+//RedoNum与req表不一致时，说明请求已重做过，此任务已过时
+type ReqRemind struct {
+	ReqID   uint64 `json:"reqID"`
+	Stage   uint8  `json:"stage"`
+	RedoNum uint32 `json:"redoNum"`
+}
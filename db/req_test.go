@@ -0,0 +1,45 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+//TestReqStates 取消（32）是请求方的操作，不能计入执行方的拒绝量，也不能重新兑现或标记完成
+func TestReqStates(t *testing.T) {
+	cases := []struct {
+		state   uint8
+		refused bool
+		redo    bool
+		done    bool
+	}{
+		{10, false, false, false},
+		{20, false, false, true},
+		{21, true, true, true},
+		{22, true, true, true},
+		{23, true, true, true},
+		{30, false, false, false},
+		{31, false, false, false},
+		{32, false, false, false},
+	}
+	var min, max uint8
+	if _, err := fmt.Sscanf(ReqRefusedCond, "state > %d and state < %d", &min, &max); err != nil {
+		t.Fatalf("ReqRefusedCond %q: %v", ReqRefusedCond, err)
+	}
+	for _, c := range cases {
+		req := Req{State: c.state}
+		if got := req.IsRefused(); got != c.refused {
+			t.Errorf("state %d: IsRefused = %v, want %v", c.state, got, c.refused)
+		}
+		//UpdateInfo用ReqRefusedCond统计拒绝量
+		if got := c.state > min && c.state < max; got != c.refused {
+			t.Errorf("state %d: ReqRefusedCond matches = %v, want %v", c.state, got, c.refused)
+		}
+		if got := req.CanRedo(); got != c.redo {
+			t.Errorf("state %d: CanRedo = %v, want %v", c.state, got, c.redo)
+		}
+		if got := req.CanDone(); got != c.done {
+			t.Errorf("state %d: CanDone = %v, want %v", c.state, got, c.done)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//S3Storage S3兼容的对象存储（AWS S3、MinIO等），请求使用AWS Signature V4签名
+type S3Storage struct {
+	Endpoint  string //如：http://127.0.0.1:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool   //使用endpoint/bucket/key形式的地址，MinIO需要
+	Prefix    string //key的前缀
+	client    *http.Client
+}
+
+//NewS3Storage 新建S3存储
+func NewS3Storage(endpoint string, region string, bucket string, accessKey string, secretKey string, pathStyle bool, prefix string) *S3Storage {
+	return &S3Storage{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PathStyle: pathStyle,
+		Prefix:    prefix,
+		client:    &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+//Put 上传文件
+func (s *S3Storage) Put(key string, data []byte) error {
+	res, err := s.do(http.MethodPut, key, nil, data)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return s3Error(res)
+}
+
+//Get 下载文件
+func (s *S3Storage) Get(key string) ([]byte, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	err = s3Error(res)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+//Delete 删除文件，S3删除不存在的文件时也返回成功
+func (s *S3Storage) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return s3Error(res)
+}
+
+//Stat 文件信息
+func (s *S3Storage) Stat(key string) (*ObjectInfo, error) {
+	res, err := s.do(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	err = s3Error(res)
+	if err != nil {
+		return nil, err
+	}
+	modTime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &ObjectInfo{Key: key, Size: res.ContentLength, ModTime: modTime}, nil
+}
+
+//s3ListResult ListObjectsV2的响应
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+//List 使用ListObjectsV2分页列出文件
+func (s *S3Storage) List(prefix string) ([]*ObjectInfo, error) {
+	infos := []*ObjectInfo{}
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s.Prefix+prefix)
+	for {
+		res, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return infos, err
+		}
+		result := s3ListResult{}
+		err = s3Error(res)
+		if err == nil {
+			err = xml.NewDecoder(res.Body).Decode(&result)
+		}
+		res.Body.Close()
+		if err != nil {
+			return infos, err
+		}
+		for _, obj := range result.Contents {
+			infos = append(infos, &ObjectInfo{Key: strings.TrimPrefix(obj.Key, s.Prefix), Size: obj.Size, ModTime: obj.LastModified})
+		}
+		if result.IsTruncated == false || result.NextContinuationToken == "" {
+			return infos, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+//do 发送签名后的请求，key为空时请求bucket
+func (s *S3Storage) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := s.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, body, time.Now())
+	return s.client.Do(req)
+}
+
+//newRequest 新建未签名的请求，key为空时请求bucket
+func (s *S3Storage) newRequest(method string, key string, query url.Values, body []byte) (*http.Request, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	p := "/"
+	if s.PathStyle {
+		p += s.Bucket
+		if key != "" {
+			p += "/"
+		}
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	if key != "" {
+		p += s.Prefix + key
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	req.Host = u.Host
+	return req, nil
+}
+
+//sign AWS Signature V4签名，now为签名时间
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKey, scope, signedHeaders, signature))
+}
+
+//s3Error 检查响应状态，404返回ErrNotExist
+func s3Error(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotExist
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3: %s %s", res.Status, strings.TrimSpace(string(msg)))
+}
+
+//s3Escape 按S3签名的规则编码，只保留A-Za-z0-9-_.~，encodeSlash为false时保留/
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && encodeSlash == false) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+//s3CanonicalQuery 按参数名排序并编码的查询字符串
+func s3CanonicalQuery(query url.Values) string {
+	keys := []string{}
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -1,7 +1,12 @@
 package db
 
 import (
+	"sort"
 	"time"
+
+	"github.com/go-xorm/xorm"
+	"reqing.org/niaobi-go/config"
+	"reqing.org/niaobi-go/util"
 )
 
 //Skill 最新技能（指自身天赋和任何对他人有用的东西），此表不可删除
@@ -20,5 +25,95 @@ type Skill struct {
 	Tags    []string `json:"tags,omitempty" xorm:"index JSONB"`                                      //类型如：技能、实物、服务、数字商品等，或者其他自定义标签
 	Version uint64   `json:"version" xorm:"not null version"`                                        //更新时自动加1
 
+	Tiers []PriceTier `json:"tiers,omitempty" xorm:"JSONB"` //价格档位，如：10次=25鸟币，按qty正序排列。不在档位中的数量按单价计算
+
 	IsOpen bool `json:"isOpen" xorm:"not null default true index(skill_owner_is_open_idx) BOOL"` //上架或下架
+
+	//库存，实物等数量有限的技能可选填。接受兑现请求时扣减，库存为0时自动下架
+	HasStock bool   `json:"hasStock" xorm:"not null default false BOOL"`      //是否限制库存
+	Stock    uint64 `json:"stock,omitempty" xorm:"not null default 0 BIGINT"` //剩余库存
+
+	//位置，线下技能可选填（理发、家教、维修等）。注意：保存的经纬度已按隐私半径模糊处理，不保存精确位置
+	HasLoc    bool    `json:"hasLoc" xorm:"not null default false index(skill_has_loc_lat_lng_idx) BOOL"` //是否设置了位置
+	Lat       float64 `json:"lat,omitempty" xorm:"index(skill_has_loc_lat_lng_idx) DOUBLE"`               //纬度（模糊处理后）
+	Lng       float64 `json:"lng,omitempty" xorm:"index(skill_has_loc_lat_lng_idx) DOUBLE"`               //经度（模糊处理后）
+	Area      string  `json:"area,omitempty" xorm:"VARCHAR(50)"`                                          //大致区域，如：北京市朝阳区
+	Privacy   uint32  `json:"privacy,omitempty" xorm:"not null default 0 INTEGER"`                        //隐私半径（米）
+	ServiceKm uint32  `json:"serviceKm,omitempty" xorm:"not null default 0 INTEGER"`                      //服务半径（公里），0表示不限制
+	IsRemote  bool    `json:"isRemote" xorm:"not null default false BOOL"`                                //是否可以远程提供
+
+	Terms string `json:"-" xorm:"TEXT"` //全文搜索的分词，由标题、描述和标签生成，gin索引见SyncDB
+}
+
+//SetLocation 设置位置，按隐私半径模糊处理经纬度，隐私半径不小于config的MinPrivacy
+func (skill *Skill) SetLocation(hasLoc bool, lat float64, lng float64, area string, privacy uint32) {
+	if hasLoc == false {
+		skill.HasLoc, skill.Lat, skill.Lng, skill.Area, skill.Privacy = false, 0, 0, "", 0
+		return
+	}
+	if privacy < config.Public.Loc.MinPrivacy {
+		privacy = config.Public.Loc.MinPrivacy
+	}
+	skill.HasLoc = true
+	skill.Lat, skill.Lng = util.BlurLocation(lat, lng, privacy)
+	skill.Area = area
+	skill.Privacy = privacy
+}
+
+//PriceTier 价格档位：Qty单位的技能总价为Price鸟币
+type PriceTier struct {
+	Qty   uint64 `json:"qty"`   //数量（单位），大于1
+	Price uint64 `json:"price"` //此数量的总价（鸟币数）
+}
+
+//SortTiers 按数量正序排列价格档位，数量重复时返回false
+func SortTiers(tiers []PriceTier) ([]PriceTier, bool) {
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].Qty < tiers[j].Qty
+	})
+	for i := 1; i < len(tiers); i++ {
+		if tiers[i].Qty == tiers[i-1].Qty {
+			return tiers, false
+		}
+	}
+	return tiers, true
+}
+
+//TakeStock 扣减库存，库存为0时自动下架，返回是否扣减成功（库存不足时失败）
+//使用条件更新保证并发时库存不会超卖，不修改version，库存变化不产生新的技能版本
+func TakeStock(engine xorm.Interface, skillID uint64, units uint64) (bool, error) {
+	res, err := engine.Exec("UPDATE skill SET stock = stock - ?, is_open = (is_open AND stock - ? > 0), updated = ? WHERE id = ? AND has_stock = true AND stock >= ?", units, units, time.Now(), skillID, units)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+//NewSnap 根据最新技能生成技能快照
+func (skill *Skill) NewSnap() Snap {
+	return Snap{
+		Owner:     skill.Owner,
+		Title:     skill.Title,
+		Price:     skill.Price,
+		Desc:      skill.Desc,
+		Tags:      skill.Tags,
+		Pics:      skill.Pics,
+		SkillID:   skill.ID,
+		Version:   skill.Version,
+		Tiers:     skill.Tiers,
+		HasLoc:    skill.HasLoc,
+		Lat:       skill.Lat,
+		Lng:       skill.Lng,
+		Area:      skill.Area,
+		Privacy:   skill.Privacy,
+		ServiceKm: skill.ServiceKm,
+		IsRemote:  skill.IsRemote,
+	}
+}
+
+//SetTerms 根据标题、描述和标签生成全文搜索的分词，新建或更新技能时调用
+func (skill *Skill) SetTerms() {
+	texts := append([]string{skill.Title, skill.Desc}, skill.Tags...)
+	skill.Terms = util.SearchTerms(texts...)
 }
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+//Slot 技能的可预约时段，对应slot表。发行者发布时段，持有者发送兑现请求时预约
+/**
+预约状态 state：
+0.	可预约
+1.	已被兑现请求占用，等待发行者接受（请求被拒绝、超时或取消时恢复为0）
+2.	发行者已接受兑现请求，预约已确认
+*/
+type Slot struct {
+	ID      uint64    `json:"slotID" xorm:"not null default nextval('slot_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	SkillID uint64    `json:"skillID" xorm:"not null index BIGINT 'skill_id'"`                 //技能ID
+	Owner   string    `json:"owner" xorm:"not null index(slot_owner_start_idx) VARCHAR(20)"`   //发行者的鸟币号，即技能的owner
+	Start   time.Time `json:"start" xorm:"not null index(slot_owner_start_idx) 'start_at'"`    //开始时间
+	End     time.Time `json:"end" xorm:"not null 'end_at'"`                                    //结束时间
+	State   uint8     `json:"state" xorm:"not null default 0 SMALLINT"`                        //预约状态
+	ReqID   uint64    `json:"reqID,omitempty" xorm:"not null default 0 index BIGINT 'req_id'"` //预约此时段的兑现请求
+	Bearer  string    `json:"bearer,omitempty" xorm:"VARCHAR(20)"`                             //预约者的鸟币号
+	Created time.Time `json:"created" xorm:"not null created"`
+	Updated time.Time `json:"updated" xorm:"updated"`
+}
+
+//HoldSlot 兑现请求占用可预约的时段，返回是否占用成功
+//使用条件更新，并发请求同一时段时只有一个可以成功
+func HoldSlot(engine xorm.Interface, slotID uint64, reqID uint64, bearer string) (bool, error) {
+	res, err := engine.Exec("UPDATE slot SET state = 1, req_id = ?, bearer = ?, updated = ? WHERE id = ? AND state = 0 AND start_at > ?", reqID, bearer, time.Now(), slotID, time.Now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+//ConfirmSlot 发行者接受兑现请求时确认预约，返回是否确认成功（时段已被释放时失败）
+func ConfirmSlot(engine xorm.Interface, reqID uint64) (bool, error) {
+	res, err := engine.Exec("UPDATE slot SET state = 2, updated = ? WHERE req_id = ? AND state = 1", time.Now(), reqID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+//FreeSlot 兑现请求被拒绝、超时、取消或关闭时，释放其占用的时段
+func FreeSlot(engine xorm.Interface, reqID uint64) error {
+	_, err := engine.Exec("UPDATE slot SET state = 0, req_id = 0, bearer = NULL, updated = ? WHERE req_id = ? AND state = 1", time.Now(), reqID)
+	return err
+}
@@ -2,9 +2,12 @@ package db
 
 import (
 	"time"
+
+	"github.com/go-xorm/xorm"
 )
 
 //Snap 技能快照，对应snap表。此表只可新建，不可删改。
+//套餐的快照同样保存在此表：BundleID不为0，SkillID为0，Items为套餐所包含技能的快照
 type Snap struct {
 	ID      uint64    `json:"snapID" xorm:"not null default nextval('snap_id_seq'::regclass) pk BIGINT autoincr 'id'"`
 	Created time.Time `json:"created" xorm:"not null created"`
@@ -17,6 +20,19 @@ type Snap struct {
 	Tags    []string `json:"tags,omitempty" xorm:"index JSONB"`               //类型如：技能、实物、服务、数字商品等，或者其他自定义标签
 	SkillID uint64   `json:"skillID" xorm:"not null index BIGINT 'skill_id'"` //不同备份版本的技能的共同ID
 	Version uint64   `json:"version" xorm:"not null default 1 BIGINT"`        //同技能表的version
+
+	Tiers    []PriceTier `json:"tiers,omitempty" xorm:"JSONB"`                                          //价格档位，同技能表
+	BundleID uint64      `json:"bundleID,omitempty" xorm:"not null default 0 index BIGINT 'bundle_id'"` //套餐ID，不为0时表示此快照为套餐快照
+	Items    []uint64    `json:"items,omitempty" xorm:"JSONB"`                                          //套餐所包含技能的快照ID
+
+	//位置，同技能表
+	HasLoc    bool    `json:"hasLoc" xorm:"not null default false BOOL"`
+	Lat       float64 `json:"lat,omitempty" xorm:"DOUBLE"`
+	Lng       float64 `json:"lng,omitempty" xorm:"DOUBLE"`
+	Area      string  `json:"area,omitempty" xorm:"VARCHAR(50)"`
+	Privacy   uint32  `json:"privacy,omitempty" xorm:"not null default 0 INTEGER"`
+	ServiceKm uint32  `json:"serviceKm,omitempty" xorm:"not null default 0 INTEGER"`
+	IsRemote  bool    `json:"isRemote" xorm:"not null default false BOOL"`
 }
 
 //SnapSet 技能快照组，对应snap_set表，标识了鸟币不同版本。此表只可新建，不可删改。
@@ -27,6 +43,46 @@ type SnapSet struct {
 	Owner   string   `json:"owner" xorm:"not null index VARCHAR(20)"`      //鸟币号，必填
 	SnapIDs []uint64 `json:"snapIDs" xorm:"not null JSONB 'snap_ids'"`     //技能快照snap_id的集合，倒序排列(snap_id为自增id)
 	Md5     string   `json:"md5" xorm:"not null index unique VARCHAR(32)"` //snap_ids的snap按照version倒序排列后，生成的md5 hash。用于检查是否已经存在此技能快照组
-	Value   uint64   `json:"value" xorm:"not null BIGINT"`                 //此鸟币版本的技能总价值，正整数
-	Count   uint32   `json:"count" xorm:"not null INTEGER"`                //此鸟币版本的技能总数量，正整数
+	Value   uint64   `json:"value" xorm:"not null BIGINT"`                 //此鸟币版本的技能总价值（技能单价和套餐价格之和），正整数
+	Count   uint32   `json:"count" xorm:"not null INTEGER"`                //此鸟币版本的技能总数量（包含套餐），正整数
+}
+
+//Units 按所选价格档位计算兑现数额对应的技能数量，数额不是价格的整数倍或档位不存在时返回false
+//tierQty为0时按单价计算，套餐按套餐价格计算
+func (snap *Snap) Units(amount uint64, tierQty uint64) (uint64, bool) {
+	price, qty := snap.Price, uint64(1)
+	if tierQty > 0 {
+		found := false
+		for _, tier := range snap.Tiers {
+			if tier.Qty == tierQty {
+				price, qty, found = tier.Price, tier.Qty, true
+				break
+			}
+		}
+		if found == false {
+			return 0, false
+		}
+	}
+	if price == 0 || amount == 0 || amount%price != 0 {
+		return 0, false
+	}
+	return amount / price * qty, true
+}
+
+//SkillIDs 快照对应的技能ID：技能快照为其技能，套餐快照为所包含的技能（查询Items中的技能快照）
+//须已读取skill_id、bundle_id和items列
+func (snap *Snap) SkillIDs(engine xorm.Interface) ([]uint64, error) {
+	if snap.BundleID == 0 {
+		return []uint64{snap.SkillID}, nil
+	}
+	items := []*Snap{}
+	err := engine.In("id", snap.Items).Cols("skill_id").Find(&items)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, len(items))
+	for i, item := range items {
+		ids[i] = item.SkillID
+	}
+	return ids, nil
 }
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+
+	"reqing.org/niaobi-go/config"
+)
+
+//Storage 图片存储后端，key为相对路径，如：鸟币号/pic/鸟币号_guid-biggest.jpg
+type Storage interface {
+	Put(key string, data []byte) error         //写入，已存在时覆盖
+	Get(key string) ([]byte, error)            //读取，不存在时返回ErrNotExist
+	Delete(key string) error                   //删除，不存在时不报错
+	Stat(key string) (*ObjectInfo, error)      //文件信息，不存在时返回ErrNotExist
+	List(prefix string) ([]*ObjectInfo, error) //列出key以prefix开头的所有文件
+}
+
+//ObjectInfo 存储中的文件信息
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+//ErrNotExist 文件不存在
+var ErrNotExist = errors.New("storage: object not exist")
+
+var (
+	//PicStore 用户图片的存储
+	PicStore Storage
+	//PicCacheStore 按需生成的图片尺寸和格式的缓存
+	PicCacheStore Storage
+)
+
+//InitStorage 根据config初始化图片存储
+func InitStorage() {
+	var err error
+	PicStore, err = NewPicStorage(config.Public.Storage.Backend, false)
+	if err != nil {
+		log.Fatal("init storage err:", err)
+	}
+	PicCacheStore, err = NewPicStorage(config.Public.Storage.Backend, true)
+	if err != nil {
+		log.Fatal("init storage err:", err)
+	}
+}
+
+//NewPicStorage 新建图片存储，cache为true时为图片缓存的存储
+//本地存储的目录为RootDir+DataDir（缓存为RootDir+CacheDir），S3存储使用DataDir（CacheDir）作为key的前缀，目录结构相同
+func NewPicStorage(backend string, cache bool) (Storage, error) {
+	dir := config.Public.Dir.DataDir
+	if cache {
+		dir = config.Public.Dir.CacheDir
+	}
+	switch backend {
+	case config.StorageLocal:
+		return NewLocalStorage(config.Public.Dir.RootDir + dir), nil
+	case config.StorageS3:
+		conf := config.Public.Storage
+		prefix := strings.Trim(dir, "/") + "/"
+		return NewS3Storage(conf.S3Endpoint, conf.S3Region, conf.S3Bucket, conf.S3AccessKey, conf.S3SecretKey, conf.S3PathStyle, prefix), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend: %s", backend)
+}
+
+//CopyStorage 把from中的所有文件复制到to，to中已存在且大小相同的文件跳过，用于迁移存储后端
+func CopyStorage(from Storage, to Storage) (copied int, skipped int, err error) {
+	infos, err := from.List("")
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, info := range infos {
+		dst, err := to.Stat(info.Key)
+		if err == nil && dst.Size == info.Size {
+			skipped++
+			continue
+		}
+		if err != nil && err != ErrNotExist {
+			return copied, skipped, err
+		}
+		data, err := from.Get(info.Key)
+		if err != nil {
+			return copied, skipped, err
+		}
+		err = to.Put(info.Key, data)
+		if err != nil {
+			return copied, skipped, err
+		}
+		copied++
+	}
+	return copied, skipped, nil
+}
+
+//LocalStorage 本地磁盘存储，目录权限0755，文件权限0644
+type LocalStorage struct {
+	Root string //根目录
+}
+
+//NewLocalStorage 新建本地磁盘存储
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+//path key对应的文件路径，key中的..不能跳出根目录
+func (s *LocalStorage) path(key string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+//Put 先写入临时文件再重命名，避免并发读取时读到不完整的文件
+func (s *LocalStorage) Put(key string, data []byte) error {
+	file := s.path(key)
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp-" + xid.New().String()
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+//Get 读取文件
+func (s *LocalStorage) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+	return data, err
+}
+
+//Delete 删除文件
+func (s *LocalStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//Stat 文件信息
+func (s *LocalStorage) Stat(key string) (*ObjectInfo, error) {
+	info, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+//List 从prefix所在的目录开始遍历，不包括写入中的临时文件
+func (s *LocalStorage) List(prefix string) ([]*ObjectInfo, error) {
+	infos := []*ObjectInfo{}
+	start := s.path(path.Dir(prefix))
+	err := filepath.Walk(start, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.Contains(info.Name(), ".tmp-") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Root, file)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, &ObjectInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		return nil
+	})
+	return infos, err
+}
@@ -11,6 +11,7 @@ type Sum struct {
 	Coin     string    `json:"coin" xorm:"not null index unique(sum_bearer_coin_is_marker_idx) VARCHAR(20)"`   //持有的鸟币名称
 	IsMarker bool      `json:"isMarker" xorm:"not null index unique(sum_bearer_coin_is_marker_idx) BOOL"`      //是否为血盟
 	Sum      int64     `json:"sum" xorm:"not null default 0 index BIGINT"`                                     //持有量，收入者sum+正数，支出者sum+负数
+	Reserved int64     `json:"reserved" xorm:"not null default 0 BIGINT"`                                      //代金券预留的数量，可用的数量为sum - reserved
 	Updated  time.Time `json:"updated" xorm:"not null updated"`
 }
 
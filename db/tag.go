@@ -0,0 +1,98 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/go-xorm/xorm"
+	"github.com/thinkeridea/go-extend/exbytes"
+)
+
+//Tag 标签，对应tag表。技能的标签统一使用标签的规范名称name
+//"摄影"、"拍照"、"Photography"等同一概念的标签，由管理员合并后，后两者成为"摄影"的别名
+type Tag struct {
+	ID       uint64    `json:"tagID" xorm:"not null default nextval('tag_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Name     string    `json:"name" xorm:"not null unique VARCHAR(30)"`          //规范名称
+	Norm     string    `json:"-" xorm:"not null unique VARCHAR(30)"`             //用于比较的名称：小写、合并空格
+	Aliases  []string  `json:"aliases,omitempty" xorm:"JSONB"`                   //别名（同样为norm格式），gin索引见SyncDB
+	SkillNum uint32    `json:"skillNum" xorm:"not null default 0 index INTEGER"` //上架中的技能数量
+	Created  time.Time `json:"created" xorm:"not null created"`
+	Updated  time.Time `json:"updated" xorm:"updated"`
+}
+
+//TagNorm 标签用于比较的格式：去除首尾空格、合并中间空格、转为小写
+func TagNorm(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+//NormalizeTags 把标签转换为规范名称并去重，只查询不写入：不存在的标签使用合并空格后的名称
+//不存在的标签须在技能写入成功后由CreateTags新建，避免技能保存失败时留下无人使用的标签
+func NormalizeTags(engine xorm.Interface, tags []string) ([]string, error) {
+	res := []string{}
+	exist := map[string]bool{}
+	for _, name := range tags {
+		norm := TagNorm(name)
+		if norm == "" {
+			continue
+		}
+
+		//先查规范名称，再查别名
+		tag := Tag{}
+		has, err := engine.Where("norm = ?", norm).Get(&tag)
+		if err != nil {
+			return nil, err
+		}
+		if has == false {
+			data, _ := json.Marshal([]string{norm})
+			has, err = engine.Where("aliases @> ?", exbytes.ToString(data)).Get(&tag)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if has == false {
+			tag.Name, tag.Norm = strings.Join(strings.Fields(name), " "), norm
+		}
+
+		//按norm去重，"Go"和"go"等同一新标签的不同写法只保留第一个，否则第二个写法没有对应的标签
+		if exist[tag.Norm] == false {
+			exist[tag.Norm] = true
+			res = append(res, tag.Name)
+		}
+	}
+	return res, nil
+}
+
+//CreateTags 新建不存在的标签，names为NormalizeTags返回的规范名称。同时新建相同标签时忽略冲突
+func CreateTags(engine xorm.Interface, names []string) error {
+	for _, name := range names {
+		norm := TagNorm(name)
+		has, err := engine.Where("norm = ?", norm).Exist(new(Tag))
+		if err != nil {
+			return err
+		}
+		if has {
+			continue
+		}
+		_, err = engine.InsertOne(&Tag{Name: name, Norm: norm, Aliases: []string{}})
+		if err != nil {
+			has, errExist := engine.Where("norm = ?", norm).Exist(new(Tag))
+			if errExist != nil || has == false {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//UpdateTagSkillNum 重新统计标签下上架中的技能数量
+func UpdateTagSkillNum(engine *xorm.Engine, names []string) {
+	for _, name := range names {
+		data, _ := json.Marshal([]string{name})
+		count, err := engine.Where("is_open = ? and tags @> ?", true, exbytes.ToString(data)).Count(new(Skill))
+		if err != nil {
+			continue
+		}
+		engine.Where("name = ?", name).Cols("skill_num").Update(&Tag{SkillNum: uint32(count)})
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+//Voucher 代金券，对应voucher表。用于没有网络的场合：创建者预先授权一笔转账，把领取码（二维码）交给对方，对方之后领取时执行转账
+//转手的鸟币在创建时从sum中预留（sum.reserved），领取、取消或过期后释放；发行自己的鸟币不须预留
+/**
+代金券状态 state：
+0.	待领取
+1.	已领取
+2.	已取消
+3.	已过期
+*/
+type Voucher struct {
+	ID          uint64    `json:"voucherID" xorm:"not null default nextval('voucher_id_seq'::regclass) pk BIGINT autoincr 'id'"`
+	Code        string    `json:"code,omitempty" xorm:"not null unique VARCHAR(32)"`                         //领取码，持有领取码即可领取，只返回给创建者
+	Owner       string    `json:"owner" xorm:"not null index VARCHAR(20)"`                                   //创建者鸟币号，即付款方
+	Coin        string    `json:"coin" xorm:"not null VARCHAR(20)"`                                          //鸟币名
+	Amount      uint64    `json:"amount" xorm:"not null BIGINT"`                                             //数额
+	IsMarker    bool      `json:"isMarker" xorm:"not null BOOL"`                                             //是否是血盟
+	Memo        string    `json:"memo,omitempty" xorm:"not null default '' TEXT"`                            //备注
+	State       uint8     `json:"state" xorm:"not null default 0 index SMALLINT"`                            //代金券状态
+	Claimer     string    `json:"claimer,omitempty" xorm:"not null default '' VARCHAR(20)"`                  //领取者鸟币号
+	PayGUID     string    `json:"payGUID,omitempty" xorm:"not null default '' index VARCHAR(36) 'pay_guid'"` //领取时转账的pay记录的guid
+	ExpireHours uint32    `json:"expireHours" xorm:"not null INTEGER"`                                       //有效期（小时），签名内容的一部分
+	KeyID       uint64    `json:"keyID,omitempty" xorm:"not null default 0 BIGINT 'key_id'"`                 //签名使用的公钥ID，0表示未签名
+	Sig         string    `json:"sig,omitempty" xorm:"not null default '' index VARCHAR(128)"`               //创建者对代金券的ed25519签名（hex），签名内容见controller/txsign.go
+	SignedAt    int64     `json:"signedAt,omitempty" xorm:"not null default 0 BIGINT"`                       //签名时间（unix秒）
+	Expires     time.Time `json:"expires" xorm:"not null index"`                                             //过期时间
+	Created     time.Time `json:"created" xorm:"not null created"`
+	Updated     time.Time `json:"updated" xorm:"updated"`
+}
+
+//IsReserved 代金券是否预留了鸟币：转手的鸟币须预留，发行自己的鸟币不须预留
+func (voucher *Voucher) IsReserved() bool {
+	return voucher.Coin != voucher.Owner
+}
+
+//IsClaimable 代金券是否可以领取：待领取并且未过期
+func (voucher *Voucher) IsClaimable() bool {
+	return voucher.State == 0 && voucher.Expires.After(time.Now())
+}
+
+//ReserveSum 预留持有的鸟币，可用的鸟币（sum - reserved）不足时返回false
+func ReserveSum(engine xorm.Interface, sumID int64, amount uint64) (bool, error) {
+	res, err := engine.Exec("UPDATE sum SET reserved = reserved + ? WHERE id = ? AND sum - reserved >= ?", amount, sumID, amount)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected == 1, err
+}
+
+//ClaimVoucher 领取代金券并释放预留的鸟币，返回是否领取成功。须在转账的事务中调用
+//使用条件更新，并发领取同一代金券时只有一个可以成功
+func ClaimVoucher(engine xorm.Interface, voucher *Voucher, claimer string, payGUID string) (bool, error) {
+	res, err := engine.Exec("UPDATE voucher SET state = 1, claimer = ?, pay_guid = ?, updated = ? WHERE id = ? AND state = 0 AND expires > ?", claimer, payGUID, time.Now(), voucher.ID, time.Now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected != 1 {
+		return false, err
+	}
+	return true, releaseVoucher(engine, voucher)
+}
+
+//CloseVoucher 取消（state=2）或过期（state=3）待领取的代金券并释放预留的鸟币，返回是否更新成功
+func CloseVoucher(engine xorm.Interface, voucher *Voucher, state uint8) (bool, error) {
+	res, err := engine.Exec("UPDATE voucher SET state = ?, updated = ? WHERE id = ? AND state = 0", state, time.Now(), voucher.ID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil || affected != 1 {
+		return false, err
+	}
+	return true, releaseVoucher(engine, voucher)
+}
+
+func releaseVoucher(engine xorm.Interface, voucher *Voucher) error {
+	if voucher.IsReserved() == false {
+		return nil
+	}
+	_, err := engine.Exec("UPDATE sum SET reserved = reserved - ? WHERE bearer = ? AND coin = ? AND is_marker = ?", voucher.Amount, voucher.Owner, voucher.Coin, voucher.IsMarker)
+	return err
+}
@@ -32,7 +32,7 @@ require (
 	github.com/moul/http2curl v1.0.0 // indirect
 	github.com/robfig/cron v1.2.0
 	github.com/rs/xid v1.2.1
-	github.com/sergi/go-diff v1.1.0 // indirect
+	github.com/sergi/go-diff v1.1.0
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/thinkeridea/go-extend v1.1.1
 	github.com/ttacon/builder v0.0.0-20170518171403-c099f663e1c2 // indirect
@@ -2,7 +2,10 @@ package main //niaobi.org by 鸟神
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
+	"log"
+	"os"
 	"time"
 
 	"github.com/beanstalkd/go-beanstalk"
@@ -38,6 +41,26 @@ func main() {
 	//-----初始化配置-----
 	config.Load()
 	rmbExr = config.Public.Exr.RmbExr
+
+	//-----命令-----
+	//迁移图片存储后端，如：./niaobi-go migrate-pics -from local -to s3
+	if len(os.Args) > 1 && os.Args[1] == "migrate-pics" {
+		migratePics(os.Args[2:])
+		return
+	}
+	//验证所有已签名的交易记录，如：./niaobi-go verify-tx -table pay
+	if len(os.Args) > 1 && os.Args[1] == "verify-tx" {
+		verifyTxs(os.Args[2:])
+		return
+	}
+	//验证整个账本的哈希链和检查点，如：./niaobi-go verify-ledger
+	if len(os.Args) > 1 && os.Args[1] == "verify-ledger" {
+		verifyLedger()
+		return
+	}
+
+	//-----初始化图片存储-----
+	db.InitStorage()
 	//init locks
 	txLocks = new(db.TransLocks)
 	txLocks.Locks = make(map[string]bool)
@@ -74,6 +97,8 @@ func main() {
 	//-----定时任务-----
 	startTimer()
 	jobReqCheck()
+	jobRemindCheck()
+	jobImgProcess()
 
 	//-----路由-----
 	app := iris.New()
@@ -99,6 +124,14 @@ func main() {
 	app.Post("/login", crs, hero.Handler(controller.Login))       //登录
 	app.Post("/register", crs, hero.Handler(controller.Register)) //注册
 
+	//预约日历（.ics），供日历软件订阅，使用地址中的签名验证而非jwt
+	app.Get("/cal/{name:string range(1,20) else 400}/{token:string}", controller.GetCalendar)
+	//访问图片，参数w、f为宽度和格式，exp、sig为签名链接的过期时间和签名
+	app.Get("/img/{pid:string range(1,128) else 400}", hero.Handler(controller.ServeImg))
+	//账本检查点，公开供任何人保存和比对
+	app.Get("/ledger/checkpoints", crs, controller.GetLedgerCheckpoints)
+	app.Get("/ledger/checkpoint/{id:uint64 else 400}", crs, controller.GetLedgerCheckpoint)
+
 	coin := app.Party("coin", crs)
 	{
 		coin.Use(jwt.Serve)
@@ -108,6 +141,9 @@ func main() {
 			coin.Put("/updateAvatar", picSizeHandler, controller.UpdateAvatar)             //修改头像
 			coin.Get("/profile/{name:string range(1,20) else 400}", controller.GetProfile) //获取某用户资料
 			coin.Get("/info", exrHandler, controller.GetMyActivity)                        //获取自己的动态
+			coin.Get("/calendar", controller.GetCalendarURL)                               //获取自己的预约日历订阅地址
+			coin.Post("/key", hero.Handler(controller.NewCoinKey))                         //登记公钥，用于签名交易
+			coin.Get("/keys/{name:string range(1,20) else 400}", controller.GetCoinKeys)   //获取某用户登记过的公钥
 			//todo 找回密码
 			//todo dashboard控制台，展示交易和鸟币等信息
 		}
@@ -121,7 +157,36 @@ func main() {
 			skill.Put("/update", transHandler, hero.Handler(controller.UpdateSkill))                //更新技能
 			skill.Put("/open/{id:uint64 else 400}/{open:bool}", transHandler, controller.OpenSkill) //上架或下架技能。open参数：1、t、true等表示上架技能，0、f、false等表示下架技能
 			skill.Delete("/delete/{id:uint64 else 400}", transHandler, controller.DeleteSkill)      //删除技能，软删除
-			//todo 搜索技能
+			skill.Get("/search", hero.Handler(controller.SearchSkill))                              //搜索技能
+			skill.Get("/nearby", hero.Handler(controller.NearbySkill))                              //搜索附近的技能，参数lat、lng为经纬度，km为搜索半径（公里）
+			skill.Get("/list/{name:string range(1,20) else 400}", controller.GetSkillList)          //获取某用户的技能列表。本人可用closed=true、deleted=true参数获取下架和已删除的技能
+			skill.Get("/{id:uint64 else 400}", controller.GetSkill)                                 //获取技能详情，包含技能快照历史
+			skill.Get("/{id:uint64 else 400}/versions", controller.GetSkillVersions)                //获取技能的版本历史，以及自己持有的版本
+			skill.Get("/{id:uint64 else 400}/diff", hero.Handler(controller.GetSkillDiff))          //比较技能的两个版本，参数from、to为version
+			skill.Get("/{id:uint64 else 400}/slots", controller.GetSlots)                           //获取技能尚未结束的可预约时段
+			skill.Post("/slots", transHandler, hero.Handler(controller.NewSlots))                   //发布技能的可预约时段
+			skill.Delete("/slot/{id:uint64 else 400}", controller.DeleteSlot)                       //删除尚未被预约的时段
+		}
+	}
+
+	bundle := app.Party("bundle", crs)
+	{
+		bundle.Use(jwt.Serve)
+		{
+			bundle.Post("/new", transHandler, hero.Handler(controller.NewBundle))                     //添加套餐
+			bundle.Put("/update", transHandler, hero.Handler(controller.UpdateBundle))                //更新套餐
+			bundle.Put("/open/{id:uint64 else 400}/{open:bool}", transHandler, controller.OpenBundle) //上架或下架套餐
+			bundle.Delete("/delete/{id:uint64 else 400}", controller.DeleteBundle)                    //删除套餐，软删除
+			bundle.Get("/list/{name:string range(1,20) else 400}", controller.GetBundleList)          //获取某用户的套餐列表
+		}
+	}
+
+	tags := app.Party("tags", crs)
+	{
+		tags.Use(jwt.Serve)
+		{
+			tags.Get("/suggest", hero.Handler(controller.SuggestTags)) //标签自动补全，参数q为标签前缀
+			tags.Post("/merge", hero.Handler(controller.MergeTags))    //合并重复的标签（管理员）
 		}
 	}
 
@@ -129,13 +194,31 @@ func main() {
 	{
 		trans.Use(jwt.Serve)
 		{
-			trans.Post("/pay", transHandler, hero.Handler(controller.NewPay))              //支付
-			trans.Post("/req", hero.Handler(controller.NewReq))                            //发送兑现请求
-			trans.Post("/repay", transHandler, hero.Handler(controller.NewRepay))          //接受兑现请求
-			trans.Put("/reject/{req:uint64 else 400}", transHandler, controller.RejectReq) //拒绝兑现请求
-			trans.Put("/uncash/{req:uint64 else 400}", controller.UnCash)                  //标记未兑现请求
-			trans.Put("/redo/{req:uint64 else 400}", controller.Redo)                      //重新执行请求（拒绝后）
-			trans.Put("/done/{req:uint64 else 400}", controller.Done)                      //标记完成交易
+			trans.Post("/pay", transHandler, hero.Handler(controller.NewPay))                  //支付
+			trans.Get("/qr", hero.Handler(controller.PayQRC))                                  //生成付款码二维码
+			trans.Post("/uri", hero.Handler(controller.ParsePayURI))                           //解析付款码
+			trans.Post("/invoice", hero.Handler(controller.NewInvoice))                        //新建收款单
+			trans.Get("/invoice/{id:uint64 else 400}", controller.GetInvoice)                  //获取收款单
+			trans.Get("/invoices", controller.GetInvoiceList)                                  //获取自己的收款单列表
+			trans.Put("/invoice/void/{id:uint64 else 400}", controller.VoidInvoice)            //作废收款单
+			trans.Post("/voucher", transHandler, hero.Handler(controller.NewVoucher))          //新建代金券
+			trans.Get("/vouchers", controller.GetVoucherList)                                  //获取自己创建的代金券列表
+			trans.Get("/voucher/qr/{id:uint64 else 400}", controller.GetVoucherQRC)            //获取代金券的二维码
+			trans.Put("/voucher/cancel/{id:uint64 else 400}", controller.CancelVoucher)        //取消代金券
+			trans.Post("/voucher/claim", transHandler, hero.Handler(controller.ClaimVoucher))  //领取代金券
+			trans.Post("/gift", hero.Handler(controller.NewGiftBatch))                         //新建兑换码批次
+			trans.Get("/gifts", controller.GetGiftBatchList)                                   //获取自己创建的兑换码批次列表
+			trans.Get("/gift/{id:uint64 else 400}", controller.GetGiftBatch)                   //获取兑换码批次的领取情况
+			trans.Post("/gift/claim", transHandler, hero.Handler(controller.ClaimGift))        //领取兑换码
+			trans.Post("/req", hero.Handler(controller.NewReq))                                //发送兑现请求
+			trans.Post("/repay", transHandler, hero.Handler(controller.NewRepay))              //接受兑现请求
+			trans.Put("/reject/{req:uint64 else 400}", transHandler, controller.RejectReq)     //拒绝兑现请求
+			trans.Put("/cancel/{req:uint64 else 400}", transHandler, controller.CancelReq)     //取消兑现请求（请求方）
+			trans.Put("/uncash/{req:uint64 else 400}", controller.UnCash)                      //标记未兑现请求
+			trans.Put("/redo/{req:uint64 else 400}", controller.Redo)                          //重新执行请求（拒绝后）
+			trans.Put("/done/{req:uint64 else 400}", controller.Done)                          //标记完成交易
+			trans.Get("/verify/{table:string}/{id:uint64 else 400}", controller.GetTxVerify)   //验证交易记录的签名，table为pay、req或repay
+			trans.Get("/proof/{table:string}/{id:uint64 else 400}", controller.GetLedgerProof) //获取交易记录在账本中的证明，table为pay或repay
 		}
 	}
 
@@ -143,8 +226,19 @@ func main() {
 	{
 		img.Use(jwt.Serve)
 		{
-			img.Get("/exist/{hash:string range(64,64) else 400}", controller.CheckPicHash) //检查图片是否存在
-			img.Post("/new", picSizeHandler, controller.NewPic)                            //上传图片
+			img.Get("/exist/{hash:string range(64,64) else 400}", controller.CheckPicHash)                    //检查图片是否存在
+			img.Post("/new", picSizeHandler, controller.NewPic)                                               //上传图片
+			img.Get("/quota", controller.GetImgQuota)                                                         //获取自己的图片存储空间
+			img.Post("/gc", controller.ImgGC)                                                                 //立即执行图片回收（管理员）
+			img.Get("/dups", hero.Handler(controller.ImgDupReport))                                           //近似图片报告（管理员）
+			img.Get("/job/{id:uint64 else 400}", controller.GetImgJob)                                        //查询图片处理任务
+			img.Get("/sign/{pid:string range(1,128) else 400}", controller.GetImgURL)                         //获取自己图片的签名链接
+			img.Post("/upload", hero.Handler(controller.NewImgUpload))                                        //创建断点续传的图片上传
+			img.Head("/upload/{id:string range(20,20) else 400}", controller.GetImgUpload)                    //查询已上传的大小
+			img.Get("/upload/{id:string range(20,20) else 400}", controller.GetImgUpload)                     //查询已上传的大小
+			img.Patch("/upload/{id:string range(20,20) else 400}", picSizeHandler, controller.PatchImgUpload) //分块上传
+			img.Post("/upload/{id:string range(20,20) else 400}/finish", controller.FinishImgUpload)          //完成上传
+			img.Delete("/upload/{id:string range(20,20) else 400}", controller.DeleteImgUpload)               //取消上传
 		}
 	}
 
@@ -169,6 +263,105 @@ func main() {
 	app.Run(iris.Addr("localhost:3001"))
 }
 
+//-----命令-----
+//迁移图片存储后端，把from中的图片复制到to，已存在且大小相同的文件跳过，可重复执行
+func migratePics(args []string) {
+	flags := flag.NewFlagSet("migrate-pics", flag.ExitOnError)
+	from := flags.String("from", config.StorageLocal, "源存储：local、s3")
+	to := flags.String("to", config.StorageS3, "目标存储：local、s3")
+	cache := flags.Bool("cache", false, "同时迁移按需生成的图片缓存")
+	flags.Parse(args)
+	if *from == *to {
+		log.Fatal("migrate pics: from and to are the same backend")
+	}
+
+	caches := []bool{false}
+	if *cache {
+		caches = append(caches, true)
+	}
+	for _, isCache := range caches {
+		src, err := db.NewPicStorage(*from, isCache)
+		if err != nil {
+			log.Fatal("migrate pics: ", err)
+		}
+		dst, err := db.NewPicStorage(*to, isCache)
+		if err != nil {
+			log.Fatal("migrate pics: ", err)
+		}
+		copied, skipped, err := db.CopyStorage(src, dst)
+		fmt.Printf("migrate pics (cache=%v): copied %d, skipped %d\n", isCache, copied, skipped)
+		if err != nil {
+			log.Fatal("migrate pics: ", err)
+		}
+	}
+}
+
+//verifyLedger 验证整个账本，输出发现的问题，有问题时退出码为1
+func verifyLedger() {
+	engine, err := xorm.NewEngine("postgres", config.PQInfo)
+	if err != nil {
+		log.Fatal("verify ledger: ", err)
+	}
+	res, err := controller.VerifyLedger(engine)
+	if err != nil {
+		log.Fatal("verify ledger: ", err)
+	}
+	for _, problem := range res.Problems {
+		fmt.Println("problem:", problem)
+	}
+	fmt.Printf("verify ledger: checked %d entries, %d checkpoints, %d problems\n", res.Entries, res.Checkpoints, len(res.Problems))
+	if len(res.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+//verifyTxs 验证已签名的交易记录是否由签名者登记的公钥签名，输出签名不正确的记录，有不正确的记录时退出码为1
+func verifyTxs(args []string) {
+	flags := flag.NewFlagSet("verify-tx", flag.ExitOnError)
+	table := flags.String("table", "", "只验证此表：pay、req、repay，为空时验证全部")
+	flags.Parse(args)
+
+	tables := []string{config.NewsTablePay, config.NewsTableReq, config.NewsTableRePay}
+	if *table != "" {
+		tables = []string{*table}
+	}
+	engine, err := xorm.NewEngine("postgres", config.PQInfo)
+	if err != nil {
+		log.Fatal("verify tx: ", err)
+	}
+	invalid := 0
+	for _, t := range tables {
+		checked := 0
+		afterID := uint64(0)
+		for {
+			ids, err := db.SignedTxIDs(engine, t, afterID, 100)
+			if err != nil {
+				log.Fatal("verify tx: ", err)
+			}
+			if len(ids) == 0 {
+				break
+			}
+			for _, id := range ids {
+				res, err := controller.VerifyTx(engine, t, id)
+				if err != nil {
+					log.Fatal("verify tx: ", err)
+				}
+				if res.Valid == false {
+					invalid++
+					fmt.Printf("invalid: %s %d signer=%s key=%d\n", t, id, res.Signer, res.KeyID)
+				}
+				checked++
+			}
+			afterID = ids[len(ids)-1]
+		}
+		fmt.Printf("verify tx (%s): checked %d signed records\n", t, checked)
+	}
+	if invalid > 0 {
+		fmt.Printf("verify tx: %d invalid\n", invalid)
+		os.Exit(1)
+	}
+}
+
 //-----中间件-----
 func dbHandler(ctx context.Context) {
 	ctx.Values().Set(config.PQIrisIDKey, pq)
@@ -213,6 +406,12 @@ func startTimer() {
 	job1 := jobRMBExr{}
 	job1.Run()
 	c.AddJob("@every 5h", job1)
+	//图片回收
+	c.AddJob(fmt.Sprintf("@every %dh", config.Public.Pic.GCEveryHours), jobImgGC{})
+	//账本检查点
+	c.AddJob(fmt.Sprintf("@every %dm", config.Public.Ledger.CheckpointMinutes), jobLedgerCheckpoint{})
+	//过期的代金券
+	c.AddJob("@every 10m", jobVoucherExpire{})
 	// job2 := jobReqCheck{}
 	// job2.Run()
 	// c.AddJob("@every 5s", job2)
@@ -223,6 +422,47 @@ func startTimer() {
 type jobRMBExr struct {
 }
 
+type jobImgGC struct {
+}
+
+type jobLedgerCheckpoint struct {
+}
+
+type jobVoucherExpire struct {
+}
+
+func (jobImgGC) Run() {
+	fmt.Println("[timer]Running ImgGCJob...")
+	res, err := controller.GCImgs(pq)
+	if err != nil {
+		fmt.Println("[timer]ImgGCJob error:", err)
+		return
+	}
+	fmt.Printf("[timer]ImgGCJob reclaimed %d bytes, %d files, %d imgs\n", res.Bytes, res.Files, res.Imgs)
+}
+
+func (jobLedgerCheckpoint) Run() {
+	checkpoint, err := controller.NewLedgerCheckpoint(pq)
+	if err != nil {
+		fmt.Println("[timer]LedgerCheckpointJob error:", err)
+		return
+	}
+	if checkpoint != nil {
+		fmt.Printf("[timer]LedgerCheckpointJob checkpoint %d: ledger %d-%d root %s\n", checkpoint.ID, checkpoint.FromSeq, checkpoint.ToSeq, checkpoint.Root)
+	}
+}
+
+func (jobVoucherExpire) Run() {
+	expired, err := controller.ExpireVouchers(pq)
+	if err != nil {
+		fmt.Println("[timer]VoucherExpireJob error:", err)
+		return
+	}
+	if expired > 0 {
+		fmt.Printf("[timer]VoucherExpireJob expired %d vouchers\n", expired)
+	}
+}
+
 func (jobRMBExr) Run() {
 	fmt.Println("[timer]Running RmbExrJob...")
 
@@ -312,10 +552,112 @@ func jobReqCheck() {
 		}
 
 		//数据库
-		news1 := db.News{Owner: req.Bearer, Desc: config.Public.Req.B22, Amount: int64(req.Amount), Buddy: req.Issuer, Table: config.NewsTableReq, SourceID: req.ID}
-		news2 := db.News{Owner: req.Issuer, Desc: config.Public.Req.I22, Amount: int64(req.Amount), Buddy: req.Bearer, Table: config.NewsTableReq, SourceID: req.ID}
+		news1 := db.News{Owner: req.Bearer, Desc: config.Public.Req.B22, Amount: int64(req.Amount), Buddy: req.Issuer, Table: config.NewsTableReq, SourceID: req.ID, Memo: req.Memo}
+		news2 := db.News{Owner: req.Issuer, Desc: config.Public.Req.I22, Amount: int64(req.Amount), Buddy: req.Bearer, Table: config.NewsTableReq, SourceID: req.ID, Memo: req.Memo}
 		pq.Insert(&news1, &news2)
 		pq.ID(req.ID).Update(&db.Req{State: 22})
+		db.FreeSlot(pq, req.ID)
+
+		conn.Delete(jobID)
+		defer conn.Close()
+	})
+}
+
+//图片处理任务，任务保存在img_job表中，服务重启后继续处理
+func jobImgProcess() {
+	//上次服务停止时处理中的任务重新处理
+	controller.ResetImgJobs(pq)
+	for i := 0; i < config.Public.Pic.JobWorkers; i++ {
+		go func() {
+			for {
+				job, err := controller.ClaimImgJob(pq)
+				if err != nil || job == nil {
+					time.Sleep(time.Second)
+					continue
+				}
+				controller.RunImgJob(pq, job)
+			}
+		}()
+	}
+}
+
+//兑现中(state=20)超时未完成的提醒和自动处理
+func jobRemindCheck() {
+	//同jobReqCheck，每隔20毫秒循环一次，记录读取超时时间为200毫秒
+	interval := 20 * time.Millisecond
+	timeOut := 200 * time.Millisecond
+	gtimer.Add(interval, func() {
+		conn, _ := beanstalk.Dial("tcp", config.BeanstalkURI)
+		tubeSet := beanstalk.NewTubeSet(conn, config.BeanstalkTubeRemind)
+		jobID, body, err := tubeSet.Reserve(timeOut)
+		if err != nil {
+			defer conn.Close()
+			return
+		}
+
+		remind := db.ReqRemind{}
+		err = json.Unmarshal(body, &remind)
+		if err != nil {
+			conn.Delete(jobID)
+			defer conn.Close()
+			return
+		}
+
+		//已完成兑现、已标记未兑现或已重做过的请求，忽略此任务
+		req := db.Req{}
+		has, err := pq.ID(remind.ReqID).Get(&req)
+		//已关闭自动处理（AutoDays为0，此时不检查AutoState）时，之前加入的自动处理任务同样忽略
+		if err != nil || has == false || req.State != 20 || req.RedoNum != remind.RedoNum || (remind.Stage >= 3 && config.Public.Remind.AutoDays == 0) {
+			conn.Delete(jobID)
+			defer conn.Close()
+			return
+		}
+
+		//数据库
+		tips := config.Public.Req
+		tip1 := tips.B20Remind //请求方提示
+		tip2 := tips.I20Remind //执行方提示
+		if remind.Stage == 2 {
+			tip1 = tips.B20Escalate
+			tip2 = tips.I20Escalate
+		} else if remind.Stage == 3 {
+			tip1 = tips.B20Auto
+			tip2 = tips.I20Auto
+		}
+		news1 := db.News{Owner: req.Bearer, Desc: tip1, Amount: int64(req.Amount), Buddy: req.Issuer, Table: config.NewsTableReq, SourceID: req.ID, Memo: req.Memo}
+		news2 := db.News{Owner: req.Issuer, Desc: tip2, Amount: int64(req.Amount), Buddy: req.Bearer, Table: config.NewsTableReq, SourceID: req.ID, Memo: req.Memo}
+		res, err := pq.Transaction(func(session *xorm.Session) (interface{}, error) {
+			if remind.Stage >= 3 {
+				//自动处理：23视为未兑现，30视为交易完成
+				//使用条件更新，期间已完成兑现、已标记未兑现或已重做的请求不再修改，也不发送消息
+				affected, err := session.Where("id = ? AND state = 20 AND redo_num = ?", req.ID, remind.RedoNum).Cols("state").Update(&db.Req{State: config.Public.Remind.AutoState})
+				if err != nil || affected == 0 {
+					return false, err
+				}
+			}
+			_, err := session.Insert(&news1, &news2)
+			if err != nil {
+				return false, err
+			}
+			_, err = session.Where("owner = ? OR owner = ?", req.Bearer, req.Issuer).Cols("has_news").UseBool().Update(&db.Info{HasNews: true})
+			return true, err
+		})
+		if err != nil {
+			//稍后重试
+			conn.Release(jobID, 0, time.Minute)
+			defer conn.Close()
+			return
+		}
+
+		if remind.Stage >= 3 {
+			if res.(bool) {
+				controller.UpdateInfo(pq, req.Issuer)
+			}
+		} else {
+			//下一阶段的提醒
+			remind.Stage++
+			controller.PutReqRemind(remind)
+		}
 
 		conn.Delete(jobID)
 		defer conn.Close()
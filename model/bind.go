@@ -34,11 +34,34 @@ func BindForm() {
 	login()
 	newPwd()
 	newProfie()
+	newCoinKey()
 	//skill
 	newSkill()
 	updateSkill()
+	searchSkill()
+	nearbySkill()
+	skillDiff()
+	//tag
+	tagSuggest()
+	mergeTag()
+	//img
+	imgVariant()
+	imgDup()
+	newImgUpload()
+	//slot
+	newSlots()
+	//bundle
+	newBundle()
+	updateBundle()
 	//trans
 	newPay()
+	payQRC()
+	payURI()
+	newInvoice()
+	newVoucher()
+	claimVoucher()
+	newGift()
+	claimGift()
 	newReq()
 	newRepay()
 }
@@ -71,6 +94,13 @@ func newProfie() {
 	})
 }
 
+func newCoinKey() {
+	hero.Register(func(ctx context.Context) (form NewCoinKeyForm) {
+		handleJSON(ctx, &form, form.NewCoinKeyFieldTrans())
+		return
+	})
+}
+
 func newSkill() {
 	hero.Register(func(ctx context.Context) (form NewSkillForm) {
 		handleForm(ctx, &form, form.NewSkillFieldTrans())
@@ -85,6 +115,83 @@ func updateSkill() {
 	})
 }
 
+func searchSkill() {
+	hero.Register(func(ctx context.Context) (form SearchSkillForm) {
+		handleQuery(ctx, &form, form.SearchSkillFieldTrans())
+		return
+	})
+}
+
+func nearbySkill() {
+	hero.Register(func(ctx context.Context) (form NearbySkillForm) {
+		handleQuery(ctx, &form, form.NearbySkillFieldTrans())
+		return
+	})
+}
+
+func skillDiff() {
+	hero.Register(func(ctx context.Context) (form SkillDiffForm) {
+		handleQuery(ctx, &form, form.SkillDiffFieldTrans())
+		return
+	})
+}
+
+func tagSuggest() {
+	hero.Register(func(ctx context.Context) (form TagSuggestForm) {
+		handleQuery(ctx, &form, form.TagSuggestFieldTrans())
+		return
+	})
+}
+
+func mergeTag() {
+	hero.Register(func(ctx context.Context) (form MergeTagForm) {
+		handleJSON(ctx, &form, form.MergeTagFieldTrans())
+		return
+	})
+}
+
+func imgVariant() {
+	hero.Register(func(ctx context.Context) (form ImgVariantForm) {
+		handleQuery(ctx, &form, form.ImgVariantFieldTrans())
+		return
+	})
+}
+
+func imgDup() {
+	hero.Register(func(ctx context.Context) (form ImgDupForm) {
+		handleQuery(ctx, &form, form.ImgDupFieldTrans())
+		return
+	})
+}
+
+func newImgUpload() {
+	hero.Register(func(ctx context.Context) (form NewImgUploadForm) {
+		handleJSON(ctx, &form, form.NewImgUploadFieldTrans())
+		return
+	})
+}
+
+func newSlots() {
+	hero.Register(func(ctx context.Context) (form NewSlotsForm) {
+		handleJSON(ctx, &form, form.NewSlotsFieldTrans())
+		return
+	})
+}
+
+func newBundle() {
+	hero.Register(func(ctx context.Context) (form NewBundleForm) {
+		handleJSON(ctx, &form, form.NewBundleFieldTrans())
+		return
+	})
+}
+
+func updateBundle() {
+	hero.Register(func(ctx context.Context) (form UpdateBundleForm) {
+		handleJSON(ctx, &form, form.UpdateBundleFieldTrans())
+		return
+	})
+}
+
 func newPay() {
 	hero.Register(func(ctx context.Context) (form NewPayForm) {
 		handleJSON(ctx, &form, form.NewPayFieldTrans())
@@ -92,6 +199,55 @@ func newPay() {
 	})
 }
 
+func payQRC() {
+	hero.Register(func(ctx context.Context) (form PayQRCForm) {
+		handleQuery(ctx, &form, form.PayQRCFieldTrans())
+		return
+	})
+}
+
+func payURI() {
+	hero.Register(func(ctx context.Context) (form PayURIForm) {
+		handleJSON(ctx, &form, form.PayURIFieldTrans())
+		return
+	})
+}
+
+func newInvoice() {
+	hero.Register(func(ctx context.Context) (form NewInvoiceForm) {
+		handleJSON(ctx, &form, form.NewInvoiceFieldTrans())
+		return
+	})
+}
+
+func newVoucher() {
+	hero.Register(func(ctx context.Context) (form NewVoucherForm) {
+		handleJSON(ctx, &form, form.NewVoucherFieldTrans())
+		return
+	})
+}
+
+func claimVoucher() {
+	hero.Register(func(ctx context.Context) (form ClaimVoucherForm) {
+		handleJSON(ctx, &form, form.ClaimVoucherFieldTrans())
+		return
+	})
+}
+
+func newGift() {
+	hero.Register(func(ctx context.Context) (form NewGiftForm) {
+		handleJSON(ctx, &form, form.NewGiftFieldTrans())
+		return
+	})
+}
+
+func claimGift() {
+	hero.Register(func(ctx context.Context) (form ClaimGiftForm) {
+		handleJSON(ctx, &form, form.ClaimGiftFieldTrans())
+		return
+	})
+}
+
 func newReq() {
 	hero.Register(func(ctx context.Context) (form NewReqForm) {
 		handleJSON(ctx, &form, form.NewReqFieldTrans())
@@ -139,3 +295,19 @@ func handleForm(ctx context.Context, form interface{}, fieldTrans FieldTrans) {
 	err = util.Strings(form)
 	e.CheckError(ctx, err, iris.StatusNotAcceptable, config.Public.Err.E1002, nil)
 }
+
+func handleQuery(ctx context.Context, form interface{}, fieldTrans FieldTrans) {
+	e := new(CommonError)
+	// ---bind form---
+	err := ctx.ReadQuery(form)
+	e.CheckError(ctx, err, iris.StatusInternalServerError, config.Public.Err.E1000, nil)
+
+	//---check struct---
+	err = validate.Struct(form)
+	errComine := NewValidatorErrorDetail(trans, err, fieldTrans)
+	e.CheckError(ctx, errComine.Err, iris.StatusNotAcceptable, config.Public.Err.E1001, errComine.Detail)
+
+	//------format------
+	err = util.Strings(form)
+	e.CheckError(ctx, err, iris.StatusNotAcceptable, config.Public.Err.E1002, nil)
+}
@@ -0,0 +1,39 @@
+package model
+
+//NewBundleForm 新建套餐
+type NewBundleForm struct {
+	Title    string   `json:"title" validate:"required,lte=100" format:"title,trim"`      //套餐名称，不可修改，同一用户下不能输入重复标题，必填
+	Price    uint64   `json:"price" validate:"required,numeric,gte=1"`                    //套餐总价（鸟币数），须低于所包含技能的单价之和，必填
+	Desc     string   `json:"desc,omitempty" validate:"lte=1000" format:"ucfirst,trim"`   //套餐描述，少于1000个字符
+	SkillIDs []uint64 `json:"skillIDs" validate:"required,gte=2,lte=20,unique,dive,gt=0"` //所包含的技能，须为本人的技能，2至20个
+}
+
+//UpdateBundleForm 更新套餐
+type UpdateBundleForm struct {
+	BundleID uint64   `json:"bundleID" validate:"required,numeric"`                       //套餐ID
+	Price    uint64   `json:"price" validate:"required,numeric,gte=1"`                    //套餐总价（鸟币数），须低于所包含技能的单价之和，必填
+	Desc     string   `json:"desc,omitempty" validate:"lte=1000" format:"ucfirst,trim"`   //套餐描述，少于1000个字符
+	SkillIDs []uint64 `json:"skillIDs" validate:"required,gte=2,lte=20,unique,dive,gt=0"` //所包含的技能，须为本人的技能，2至20个
+}
+
+//===========err trans=============
+
+//NewBundleFieldTrans 字段本地化，供validator使用
+func (form NewBundleForm) NewBundleFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Title"] = "套餐名称"
+	m["Price"] = "价格"
+	m["Desc"] = "描述"
+	m["SkillIDs"] = "技能"
+	return m
+}
+
+//UpdateBundleFieldTrans 字段本地化，供validator使用
+func (form UpdateBundleForm) UpdateBundleFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["BundleID"] = "套餐ID"
+	m["Price"] = "价格"
+	m["Desc"] = "描述"
+	m["SkillIDs"] = "技能"
+	return m
+}
@@ -44,6 +44,13 @@ type ProfileForm struct {
 	Email string `json:"email,omitempty" validate:"email" format:"email"` //邮箱
 }
 
+//NewCoinKeyForm 登记公钥，更换公钥时旧公钥撤销
+type NewCoinKeyForm struct {
+	PubKey   string `json:"pubKey" validate:"required,hexadecimal,len=64" format:"trim,lower"` //ed25519公钥（hex）
+	Sig      string `json:"sig" validate:"required,hexadecimal,len=128" format:"trim,lower"`   //用对应私钥对登记内容的签名（hex），证明持有私钥。签名内容见controller/txsign.go
+	SignedAt int64  `json:"signedAt" validate:"required"`                                      //签名时间（unix秒）
+}
+
 //ProfileRes 返回别人的鸟币资料，剔除隐私信息！
 type ProfileRes struct {
 	ID uint64 `json:"coinID"` //鸟币ID
@@ -95,3 +102,12 @@ func (form ProfileForm) ProfileFieldTrans() FieldTrans {
 	m["Email"] = "电子邮箱"
 	return m
 }
+
+//NewCoinKeyFieldTrans 字段本地化，供validator使用
+func (form NewCoinKeyForm) NewCoinKeyFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["PubKey"] = "公钥"
+	m["Sig"] = "签名"
+	m["SignedAt"] = "签名时间"
+	return m
+}
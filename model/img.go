@@ -1,6 +1,101 @@
 package model
 
+import "reqing.org/niaobi-go/db"
+
 //ImgExistRes 检查图片是否存在的响应
 type ImgExistRes struct {
 	Exist bool `json:"exist"`
 }
+
+//ImgJobRes 上传图片的响应，新图片的缩略图由图片处理任务异步生成
+type ImgJobRes struct {
+	*db.Img
+	JobID uint64 `json:"jobID,omitempty"` //图片处理任务ID，图片已经上传过时为0
+}
+
+//ImgQuotaRes 图片存储空间
+type ImgQuotaRes struct {
+	Used  int64 `json:"used"`  //已使用（字节）
+	Quota int64 `json:"quota"` //总空间（字节），0表示不限制
+}
+
+//ImgGCRes 图片回收结果
+type ImgGCRes struct {
+	Files int   `json:"files"` //删除的文件数
+	Imgs  int   `json:"imgs"`  //删除的img记录数
+	Bytes int64 `json:"bytes"` //回收的空间（字节）
+}
+
+//ImgVariantForm 访问图片时的尺寸、格式和签名，url参数
+type ImgVariantForm struct {
+	W   uint   `url:"w" validate:"numeric"`                        //宽度，须为config中允许的值，0表示原图大小
+	F   string `url:"f" validate:"omitempty,oneof=jpg png webp"`   //格式，为空时使用原图格式
+	Exp int64  `url:"exp" validate:"numeric"`                      //签名链接的过期时间（unix秒）
+	Sig string `url:"sig" validate:"omitempty,hexadecimal,len=32"` //签名
+}
+
+//ImgDupForm 近似图片报告的参数，url参数
+type ImgDupForm struct {
+	D int `url:"d" validate:"numeric,min=0,max=7"` //感知哈希的最大汉明距离，0表示使用config中的PHashDistance
+}
+
+//ImgDupRes 近似图片报告，只列出包含多个用户图片的分组
+type ImgDupRes struct {
+	Distance int            `json:"distance"`
+	Clusters []*ImgDupGroup `json:"clusters"`
+}
+
+//ImgDupGroup 一组近似图片
+type ImgDupGroup struct {
+	Owners []string     `json:"owners"` //分组中图片的所有者
+	Imgs   []*ImgDupImg `json:"imgs"`
+}
+
+//ImgDupImg 近似图片报告中的一张图片
+type ImgDupImg struct {
+	Hash    string  `json:"hash"`
+	Owner   string  `json:"owner"`
+	PHash   string  `json:"phash"`           //感知哈希，16位十六进制
+	DupOf   string  `json:"dupOf,omitempty"` //上传时已合并到哪张图片
+	Thumb   *db.Pic `json:"thumb,omitempty"`
+	Created int64   `json:"created"` //上传时间（unix秒）
+}
+
+//NewImgUploadForm 创建断点续传的图片上传
+type NewImgUploadForm struct {
+	Size  int64  `json:"size" validate:"required,numeric,gte=1"`          //图片的总大小（字节），不超过MaxUploadPic
+	Focus string `json:"focus,omitempty" validate:"lte=30" format:"trim"` //图片的焦点"x,y"，完成上传时检查是否在图片范围内
+}
+
+//ImgURLRes 图片的签名链接
+type ImgURLRes struct {
+	URL string `json:"url"`
+	Exp int64  `json:"exp"` //过期时间（unix秒）
+}
+
+//===========err trans=============
+
+//ImgVariantFieldTrans 字段本地化，供validator使用
+func (form ImgVariantForm) ImgVariantFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["W"] = "宽度"
+	m["F"] = "格式"
+	m["Exp"] = "过期时间"
+	m["Sig"] = "签名"
+	return m
+}
+
+//ImgDupFieldTrans 字段名称翻译
+func (form ImgDupForm) ImgDupFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["D"] = "汉明距离"
+	return m
+}
+
+//NewImgUploadFieldTrans 字段名称翻译
+func (form NewImgUploadForm) NewImgUploadFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Size"] = "图片大小"
+	m["Focus"] = "图片焦点"
+	return m
+}
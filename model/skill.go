@@ -1,20 +1,165 @@
 package model
 
+import (
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/util"
+)
+
 //NewSkillForm 新建技能
 type NewSkillForm struct {
-	Title string   `form:"title" validate:"required,lte=100" format:"title,trim"`     //技能名称，不可修改，同一用户下不能输入重复标题，不超过100个字符，必填
-	Price uint64   `form:"price" validate:"required,numeric,gte=1" format:"num,trim"` //技能价格（鸟币数/单位），大于0的整数，必填
-	Desc  string   `form:"desc,omitempty" validate:"lte=1000" format:"ucfirst,trim"`  //技能描述，少于1000个字符
-	Tags  []string `form:"tags,omitempty" validate:"unique,dive,required"`            //类型如：技能、实物、服务、数字商品等，或者其他自定义标签
+	Title string   `form:"title" validate:"required,lte=100" format:"title,trim"`               //技能名称，不可修改，同一用户下不能输入重复标题，不超过100个字符，必填
+	Price uint64   `form:"price" validate:"required,numeric,gte=1" format:"num,trim"`           //技能价格（鸟币数/单位），大于0的整数，必填
+	Desc  string   `form:"desc,omitempty" validate:"lte=1000" format:"ucfirst,trim"`            //技能描述，少于1000个字符
+	Tags  []string `form:"tags,omitempty" validate:"unique,dive,required,lte=30" format:"trim"` //类型如：技能、实物、服务、数字商品等，或者其他自定义标签。保存时转换为规范的标签名称
+
+	HasLoc    bool    `form:"hasLoc,omitempty"`                                               //是否设置位置，为false时忽略lat、lng、area、privacy
+	Lat       float64 `form:"lat,omitempty" validate:"required_with=HasLoc,gte=-90,lte=90"`   //纬度，hasLoc为true时必填
+	Lng       float64 `form:"lng,omitempty" validate:"required_with=HasLoc,gte=-180,lte=180"` //经度，hasLoc为true时必填
+	Area      string  `form:"area,omitempty" validate:"lte=50" format:"trim"`                 //大致区域，如：北京市朝阳区
+	Privacy   uint32  `form:"privacy,omitempty" validate:"lte=10000"`                         //隐私半径（米），保存的位置按此半径模糊处理，不小于config的MinPrivacy
+	ServiceKm uint32  `form:"serviceKm,omitempty" validate:"lte=20000"`                       //服务半径（公里），0表示不限制
+	IsRemote  bool    `form:"isRemote,omitempty"`                                             //是否可以远程提供
+
+	HasStock bool   `form:"hasStock,omitempty"` //是否限制库存
+	Stock    uint64 `form:"stock,omitempty"`    //库存数量，hasStock为true时有效
+
+	Tiers []PriceTierForm `form:"tiers,omitempty" validate:"lte=10,dive"` //价格档位，如：10次=25鸟币，最多10个，数量不能重复
+
+	Focus []string `form:"focus,omitempty" validate:"lte=9"` //图片的焦点"x,y"，按顺序对应上传的图片，为空表示不指定。Middle和Small缩略图以焦点为中心裁剪
 }
 
 //UpdateSkillForm 更新技能
 type UpdateSkillForm struct {
-	SkillID uint64   `json:"skillID" validate:"required,numeric" format:"num,trim"`     //技能ID
-	Price   uint64   `json:"price" validate:"required,numeric,gte=1" format:"num,trim"` //技能价格（鸟币数/单位），大于0的整数，必填
-	Desc    string   `json:"desc,omitempty" validate:"lte=1000" format:"ucfirst,trim"`  //技能描述，少于1000个字符
-	Tags    []string `json:"tags,omitempty" validate:"lte=5,unique,dive,required"`      //类型如：技能、实物、服务、数字商品等，或者其他自定义标签
-	Pics    []string `json:"pics,omitempty" validate:"lte=9,unique,dive,required"`      //图片的hash数组，图片最多上传9张
+	SkillID uint64   `json:"skillID" validate:"required,numeric" format:"num,trim"`                     //技能ID
+	Price   uint64   `json:"price" validate:"required,numeric,gte=1" format:"num,trim"`                 //技能价格（鸟币数/单位），大于0的整数，必填
+	Desc    string   `json:"desc,omitempty" validate:"lte=1000" format:"ucfirst,trim"`                  //技能描述，少于1000个字符
+	Tags    []string `json:"tags,omitempty" validate:"lte=5,unique,dive,required,lte=30" format:"trim"` //类型如：技能、实物、服务、数字商品等，或者其他自定义标签。保存时转换为规范的标签名称
+	Pics    []string `json:"pics,omitempty" validate:"lte=9,unique,dive,required"`                      //图片的hash数组，图片最多上传9张
+
+	//不传hasLoc表示不修改位置，hasLoc为false表示清除位置；不传serviceKm、isRemote表示不修改
+	HasLoc    *bool   `json:"hasLoc,omitempty"`                                   //是否设置位置，为false时忽略lat、lng、area、privacy
+	Lat       float64 `json:"lat,omitempty" validate:"gte=-90,lte=90"`            //纬度，hasLoc为true时必填
+	Lng       float64 `json:"lng,omitempty" validate:"gte=-180,lte=180"`          //经度，hasLoc为true时必填
+	Area      string  `json:"area,omitempty" validate:"lte=50" format:"trim"`     //大致区域，如：北京市朝阳区
+	Privacy   uint32  `json:"privacy,omitempty" validate:"lte=10000"`             //隐私半径（米），保存的位置按此半径模糊处理，不小于config的MinPrivacy
+	ServiceKm *uint32 `json:"serviceKm,omitempty" validate:"omitempty,lte=20000"` //服务半径（公里），0表示不限制
+	IsRemote  *bool   `json:"isRemote,omitempty"`                                 //是否可以远程提供
+
+	//库存只在传入时更新，hasStock为false时清除库存，只传stock时修改原有库存的数量。补货时传入新的库存数量，售罄自动下架的技能补货后自动上架
+	HasStock *bool   `json:"hasStock,omitempty"` //是否限制库存
+	Stock    *uint64 `json:"stock,omitempty"`    //库存数量，限制库存时有效
+
+	Tiers []PriceTierForm `json:"tiers,omitempty" validate:"lte=10,dive"` //价格档位，如：10次=25鸟币，最多10个，数量不能重复
+}
+
+//PriceTierForm 价格档位
+type PriceTierForm struct {
+	Qty   uint64 `json:"qty" form:"qty" validate:"required,gte=2"`     //数量（单位），大于1
+	Price uint64 `json:"price" form:"price" validate:"required,gte=1"` //此数量的总价（鸟币数）
+}
+
+//PriceTiers 转换为价格档位，按数量正序排列，数量重复时返回false
+func PriceTiers(tiers []PriceTierForm) ([]db.PriceTier, bool) {
+	res := []db.PriceTier{}
+	for _, tier := range tiers {
+		res = append(res, db.PriceTier{Qty: tier.Qty, Price: tier.Price})
+	}
+	return db.SortTiers(res)
+}
+
+//SkillJobRes 新建技能的响应
+type SkillJobRes struct {
+	*db.Skill
+	JobID uint64 `json:"jobID,omitempty"` //图片处理任务ID，没有上传图片时为0
+}
+
+//SkillRes 技能详情，包含技能快照历史
+type SkillRes struct {
+	*db.Skill
+	IsDeleted bool       `json:"isDeleted,omitempty"` //是否已删除，仅本人可以看到已删除的技能
+	Snaps     []*db.Snap `json:"snaps"`               //技能快照历史，按version倒序排列
+}
+
+//SkillVersionsRes 技能的版本历史
+type SkillVersionsRes struct {
+	SkillID  uint64     `json:"skillID"`
+	Version  uint64     `json:"version"`  //技能当前的版本，可能尚未生成快照
+	Held     []uint64   `json:"held"`     //当前用户持有的鸟币所包含的此技能的版本
+	Versions []*db.Snap `json:"versions"` //技能快照，按version倒序排列
+}
+
+//SkillDiffForm 比较技能的两个版本，url参数
+type SkillDiffForm struct {
+	From uint64 `url:"from" validate:"required,numeric"` //旧版本
+	To   uint64 `url:"to" validate:"numeric"`            //新版本，为0时使用技能当前的版本
+}
+
+//SkillDiffRes 技能两个版本间的差异，未改变的字段不返回
+type SkillDiffRes struct {
+	SkillID uint64          `json:"skillID"`
+	From    uint64          `json:"from"`
+	To      uint64          `json:"to"`
+	Price   *PriceDiff      `json:"price,omitempty"` //价格
+	Desc    []util.TextDiff `json:"desc,omitempty"`  //描述的文本差异
+	Tags    *ListDiff       `json:"tags,omitempty"`  //标签
+	Pics    *ListDiff       `json:"pics,omitempty"`  //图片，以原图的hash表示
+}
+
+//PriceDiff 价格差异
+type PriceDiff struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+//ListDiff 数组差异
+type ListDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+//SearchSkillForm 搜索技能，url参数
+type SearchSkillForm struct {
+	Q      string   `url:"q" validate:"lte=100" format:"trim"`                                          //关键字，搜索技能名称、描述和标签
+	Tags   []string `url:"tags" validate:"lte=5,unique,dive,required,lte=20" format:"trim"`             //标签，技能需包含全部标签
+	Min    uint64   `url:"min" validate:"numeric"`                                                      //最低价格
+	Max    uint64   `url:"max" validate:"omitempty,numeric,gtefield=Min"`                               //最高价格，0表示不限制
+	Owner  string   `url:"owner" validate:"lte=20" format:"trim"`                                       //技能所属的鸟币号
+	Sort   string   `url:"sort" validate:"omitempty,oneof=relevance newest price -price" format:"trim"` //排序：relevance相关度（有关键字时默认），newest最新（无关键字时默认），price价格从低到高，-price价格从高到低
+	Cursor string   `url:"cursor" validate:"lte=200"`                                                   //分页游标，即上一页返回的next
+	Limit  int      `url:"limit" validate:"omitempty,gte=1,lte=50"`                                     //每页数量，默认20
+}
+
+//SearchSkillRes 搜索技能的响应
+type SearchSkillRes struct {
+	Skills []*SkillSearchItem `json:"skills"`
+	Next   string             `json:"next,omitempty"` //下一页的游标，为空时表示没有更多数据
+}
+
+//SkillSearchItem 搜索到的技能
+type SkillSearchItem struct {
+	db.Skill `xorm:"extends"`
+	Rank     float64 `json:"rank,omitempty" xorm:"'rank'"` //关键字相关度
+}
+
+//SkillCursor 技能搜索的分页游标，json+base64编码后返回给客户端
+type SkillCursor struct {
+	ID    uint64 `json:"id"`
+	Rank  string `json:"r,omitempty"` //相关度保留6位小数的精确文本，避免浮点数经json往返后比较不相等
+	Price uint64 `json:"p,omitempty"`
+}
+
+//NearbySkillForm 搜索附近的技能，url参数
+type NearbySkillForm struct {
+	Lat   *float64 `url:"lat" validate:"required,gte=-90,lte=90"`   //纬度
+	Lng   *float64 `url:"lng" validate:"required,gte=-180,lte=180"` //经度
+	Km    float64  `url:"km" validate:"omitempty,gt=0,lte=100"`     //搜索半径（公里），默认10
+	Limit int      `url:"limit" validate:"omitempty,gte=1,lte=50"`  //数量，默认20
+}
+
+//SkillNearbyItem 附近的技能
+type SkillNearbyItem struct {
+	db.Skill `xorm:"extends"`
+	Distance float64 `json:"distance" xorm:"'distance'"` //距离（公里），按模糊处理后的位置计算，误差约为隐私半径
 }
 
 //===========err trans=============
@@ -26,6 +171,15 @@ func (form NewSkillForm) NewSkillFieldTrans() FieldTrans {
 	m["Price"] = "价格"
 	m["Desc"] = "描述"
 	m["Tags"] = "标签"
+	m["Lat"] = "纬度"
+	m["Lng"] = "经度"
+	m["Area"] = "区域"
+	m["Privacy"] = "隐私半径"
+	m["ServiceKm"] = "服务半径"
+	m["Stock"] = "库存"
+	m["Tiers"] = "价格档位"
+	m["Qty"] = "数量"
+	m["Focus"] = "图片焦点"
 	return m
 }
 
@@ -37,5 +191,45 @@ func (form UpdateSkillForm) UpdateSkillFieldTrans() FieldTrans {
 	m["Desc"] = "描述"
 	m["Tags"] = "标签"
 	m["Pics"] = "图片"
+	m["Lat"] = "纬度"
+	m["Lng"] = "经度"
+	m["Area"] = "区域"
+	m["Privacy"] = "隐私半径"
+	m["ServiceKm"] = "服务半径"
+	m["Stock"] = "库存"
+	m["Tiers"] = "价格档位"
+	m["Qty"] = "数量"
+	return m
+}
+
+//SearchSkillFieldTrans 字段本地化，供validator使用
+func (form SearchSkillForm) SearchSkillFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Q"] = "关键字"
+	m["Tags"] = "标签"
+	m["Min"] = "最低价格"
+	m["Max"] = "最高价格"
+	m["Owner"] = "鸟币号"
+	m["Sort"] = "排序"
+	m["Cursor"] = "分页游标"
+	m["Limit"] = "每页数量"
+	return m
+}
+
+//SkillDiffFieldTrans 字段本地化，供validator使用
+func (form SkillDiffForm) SkillDiffFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["From"] = "旧版本"
+	m["To"] = "新版本"
+	return m
+}
+
+//NearbySkillFieldTrans 字段本地化，供validator使用
+func (form NearbySkillForm) NearbySkillFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Lat"] = "纬度"
+	m["Lng"] = "经度"
+	m["Km"] = "搜索半径"
+	m["Limit"] = "数量"
 	return m
 }
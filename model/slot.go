@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+//NewSlotsForm 发布技能的可预约时段
+type NewSlotsForm struct {
+	SkillID uint64     `json:"skillID" validate:"required,numeric"`         //技能ID
+	Slots   []SlotForm `json:"slots" validate:"required,gte=1,lte=50,dive"` //时段，一次最多发布50个，不能与已发布的时段重叠
+}
+
+//SlotForm 时段
+type SlotForm struct {
+	Start time.Time `json:"start" validate:"required"`             //开始时间，RFC3339格式，须晚于当前时间
+	End   time.Time `json:"end" validate:"required,gtfield=Start"` //结束时间，RFC3339格式
+}
+
+//CalendarRes 日历订阅地址
+type CalendarRes struct {
+	URL string `json:"url"` //iCalendar(.ics)订阅地址，包含签名，请勿泄露
+}
+
+//===========err trans=============
+
+//NewSlotsFieldTrans 字段本地化，供validator使用
+func (form NewSlotsForm) NewSlotsFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["SkillID"] = "技能ID"
+	m["Slots"] = "时段"
+	m["Start"] = "开始时间"
+	m["End"] = "结束时间"
+	return m
+}
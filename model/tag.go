@@ -0,0 +1,29 @@
+package model
+
+//TagSuggestForm 标签自动补全，url参数
+type TagSuggestForm struct {
+	Q string `url:"q" validate:"required,lte=30" format:"trim"` //标签名称或别名的前缀
+}
+
+//MergeTagForm 合并重复的标签（管理员）
+type MergeTagForm struct {
+	Into string   `json:"into" validate:"required,lte=30" format:"trim"`                             //保留的标签
+	From []string `json:"from" validate:"required,lte=20,unique,dive,required,lte=30" format:"trim"` //被合并的标签，合并后成为保留标签的别名
+}
+
+//===========err trans=============
+
+//TagSuggestFieldTrans 字段本地化，供validator使用
+func (form TagSuggestForm) TagSuggestFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Q"] = "标签"
+	return m
+}
+
+//MergeTagFieldTrans 字段本地化，供validator使用
+func (form MergeTagForm) MergeTagFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Into"] = "保留的标签"
+	m["From"] = "被合并的标签"
+	return m
+}
@@ -1,28 +1,155 @@
 package model
 
+import (
+	"reqing.org/niaobi-go/db"
+	"reqing.org/niaobi-go/util"
+)
+
 //NewPayForm 发行或转手
 type NewPayForm struct {
-	TransCoin string `json:"transCoin" validate:"required,lte=20" format:"trim"`         //交易的鸟币名
-	Receiver  string `json:"receiver" validate:"required,lte=20" format:"trim"`          //收款方鸟币号
-	Amount    uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"` //转账数额，大于0的整数
-	IsMarker  bool   `json:"isMarker"`                                                   //是否是血盟，血盟为true时，忽略技能快照组snap_set_id
+	TransCoin string `json:"transCoin" validate:"required_without=InvoiceID,lte=20" format:"trim"`       //交易的鸟币名，按收款单付款且收款单只接受一种鸟币时可为空
+	Receiver  string `json:"receiver" validate:"required_without=InvoiceID,lte=20" format:"trim"`        //收款方鸟币号，按收款单付款时可为空
+	Amount    uint64 `json:"amount" validate:"required_without=InvoiceID,numeric" format:"num,trim"`     //转账数额，大于0的整数，按收款单付款时可为空
+	IsMarker  bool   `json:"isMarker"`                                                                   //是否是血盟，血盟为true时，忽略技能快照组snap_set_id
+	InvoiceID uint64 `json:"invoiceID,omitempty" validate:"numeric"`                                     //收款单ID，由收款单确定收款方、鸟币和数额
+	Memo      string `json:"memo,omitempty" validate:"lte=100" format:"trim,!html"`                      //备注，不超过100个字符，按收款单付款且为空时使用收款单的备注
+	Sig       string `json:"sig,omitempty" validate:"omitempty,hexadecimal,len=128" format:"trim,lower"` //付款方对交易的ed25519签名（hex），已登记公钥时必填。签名内容见controller/txsign.go，其中备注为去除首尾空格并HTML转义后的内容
+	SignedAt  int64  `json:"signedAt,omitempty" validate:"required_with=Sig"`                            //签名时间（unix秒），与服务器时间相差不能超过config中的MaxSkewSeconds
+}
+
+//NewInvoiceForm 新建收款单
+type NewInvoiceForm struct {
+	Coins       []string `json:"coins,omitempty" validate:"lte=10,unique,dive,required,lte=20" format:"trim"` //接受的鸟币，为空时只接受自己发行的鸟币
+	Amount      uint64   `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"`                  //收款数额，大于0的整数
+	Memo        string   `json:"memo,omitempty" validate:"lte=100" format:"trim,!html"`                       //备注，不超过100个字符
+	ExpireHours uint32   `json:"expireHours,omitempty" validate:"lte=8760"`                                   //多少小时后过期，0表示不过期，最多一年
+	MultiUse    bool     `json:"multiUse,omitempty"`                                                          //是否可以多次付款，如固定价格的商品
 }
 
 //NewReqForm 兑现请求
 type NewReqForm struct {
-	Issuer   string `json:"issuer" validate:"required,lte=20" format:"trim"`            //发币者鸟币号(鸟币号即要兑现的鸟币)
-	Amount   uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"` //转账数额，大于0的整数
-	SnapID   uint64 `json:"snapID" validate:"numeric" format:"num,trim"`                //实际兑现的技能ID
-	IsMarker bool   `json:"isMarker"`                                                   //是否是血盟，血盟为true时，忽略技能快照snap_id
+	Issuer   string `json:"issuer" validate:"required,lte=20" format:"trim"`                            //发币者鸟币号(鸟币号即要兑现的鸟币)
+	Amount   uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"`                 //转账数额，大于0的整数
+	SnapID   uint64 `json:"snapID" validate:"numeric" format:"num,trim"`                                //实际兑现的技能ID
+	IsMarker bool   `json:"isMarker"`                                                                   //是否是血盟，血盟为true时，忽略技能快照snap_id
+	SlotID   uint64 `json:"slotID" validate:"numeric"`                                                  //预约的时段，须为所兑现技能的时段，0表示不预约
+	TierQty  uint64 `json:"tierQty" validate:"numeric"`                                                 //所选价格档位的数量，0表示按单价兑现。兑现数额须为所选价格的整数倍
+	Memo     string `json:"memo,omitempty" validate:"lte=100" format:"trim,!html"`                      //备注，不超过100个字符
+	Sig      string `json:"sig,omitempty" validate:"omitempty,hexadecimal,len=128" format:"trim,lower"` //持有者对交易的ed25519签名（hex），已登记公钥时必填。签名内容见controller/txsign.go，其中备注为去除首尾空格并HTML转义后的内容
+	SignedAt int64  `json:"signedAt,omitempty" validate:"required_with=Sig"`                            //签名时间（unix秒），与服务器时间相差不能超过config中的MaxSkewSeconds
 }
 
 //NewRepayForm 兑现
 type NewRepayForm struct {
-	ReqID    uint64 `json:"reqID" validate:"required,numeric" format:"num,trim"`        //兑现请求ID
-	Bearer   string `json:"bearer" validate:"required,lte=20" format:"trim"`            //发币者鸟币号(鸟币号即要兑现的鸟币)
-	Amount   uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"` //转账数额，大于0的整数
-	SnapID   uint64 `json:"snapID" validate:"numeric" format:"num,trim"`                //实际兑现的技能ID
-	IsMarker bool   `json:"isMarker"`                                                   //是否是血盟，血盟为true时，忽略技能快照snap_id
+	ReqID    uint64 `json:"reqID" validate:"required,numeric" format:"num,trim"`                        //兑现请求ID
+	Bearer   string `json:"bearer" validate:"required,lte=20" format:"trim"`                            //发币者鸟币号(鸟币号即要兑现的鸟币)
+	Amount   uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"`                 //转账数额，大于0的整数
+	SnapID   uint64 `json:"snapID" validate:"numeric" format:"num,trim"`                                //实际兑现的技能ID
+	IsMarker bool   `json:"isMarker"`                                                                   //是否是血盟，血盟为true时，忽略技能快照snap_id
+	Memo     string `json:"memo,omitempty" validate:"lte=100" format:"trim,!html"`                      //备注，不超过100个字符
+	Sig      string `json:"sig,omitempty" validate:"omitempty,hexadecimal,len=128" format:"trim,lower"` //发行者对交易的ed25519签名（hex），已登记公钥时必填。签名内容见controller/txsign.go，其中备注为去除首尾空格并HTML转义后的内容
+	SignedAt int64  `json:"signedAt,omitempty" validate:"required_with=Sig"`                            //签名时间（unix秒），与服务器时间相差不能超过config中的MaxSkewSeconds
+}
+
+//NewVoucherForm 新建代金券，转手的鸟币从持有量中预留，领取时转账给领取者
+type NewVoucherForm struct {
+	TransCoin   string `json:"transCoin" validate:"required,lte=20" format:"trim"`                         //鸟币名
+	Amount      uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"`                 //数额，大于0的整数
+	IsMarker    bool   `json:"isMarker"`                                                                   //是否是血盟
+	Memo        string `json:"memo,omitempty" validate:"lte=100" format:"trim,!html"`                      //备注，不超过100个字符
+	ExpireHours uint32 `json:"expireHours" validate:"required,gte=1,lte=720"`                              //有效期（小时），过期后释放预留的鸟币，最多30天
+	Sig         string `json:"sig,omitempty" validate:"omitempty,hexadecimal,len=128" format:"trim,lower"` //创建者对代金券的ed25519签名（hex），已登记公钥时必填。签名内容见controller/txsign.go
+	SignedAt    int64  `json:"signedAt,omitempty" validate:"required_with=Sig"`                            //签名时间（unix秒）
+}
+
+//ClaimVoucherForm 领取代金券
+type ClaimVoucherForm struct {
+	Code string `json:"code" validate:"required,lte=1024" format:"trim"` //领取码，或扫描代金券二维码得到的内容
+}
+
+//VoucherRes 新建的代金券
+type VoucherRes struct {
+	*db.Voucher
+	URI string `json:"uri"` //代金券二维码的内容，见util.VoucherURI
+}
+
+//NewGiftForm 新建兑换码批次，发行自己的鸟币
+type NewGiftForm struct {
+	Amount      uint64 `json:"amount" validate:"required,numeric,gte=1" format:"num,trim"`                 //每个兑换码发行的数额，大于0的整数
+	Count       uint32 `json:"count" validate:"required,gte=1,lte=1000"`                                   //兑换码的数量，最多1000个
+	IsMarker    bool   `json:"isMarker"`                                                                   //是否是血盟
+	Memo        string `json:"memo,omitempty" validate:"lte=100" format:"trim,!html"`                      //备注，不超过100个字符
+	ExpireHours uint32 `json:"expireHours" validate:"required,gte=1,lte=8760"`                             //多少小时后过期，最多一年
+	Sig         string `json:"sig,omitempty" validate:"omitempty,hexadecimal,len=128" format:"trim,lower"` //发行者对批次的ed25519签名（hex），已登记公钥时必填。签名内容见controller/txsign.go
+	SignedAt    int64  `json:"signedAt,omitempty" validate:"required_with=Sig"`                            //签名时间（unix秒）
+}
+
+//ClaimGiftForm 领取兑换码
+type ClaimGiftForm struct {
+	Code string `json:"code" validate:"required,lte=16" format:"trim,upper"` //兑换码，不区分大小写
+}
+
+//GiftRes 兑换码批次和其中的兑换码
+type GiftRes struct {
+	*db.GiftBatch
+	Codes []*db.GiftCode `json:"codes"`
+}
+
+//PayQRCForm 生成付款码二维码，url参数
+type PayQRCForm struct {
+	To       string `url:"to" validate:"required,lte=20" format:"trim"` //收款方鸟币号
+	Coin     string `url:"coin" validate:"lte=20" format:"trim"`        //交易的鸟币名，为空时由付款方选择
+	Amount   uint64 `url:"amount" validate:"numeric"`                   //转账数额，0表示由付款方填写
+	IsMarker bool   `url:"marker"`                                      //是否是血盟
+	Memo     string `url:"memo" validate:"lte=100" format:"trim"`       //备注
+	W        uint   `url:"w" validate:"numeric"`                        //二维码大小，须为config中二维码的大小之一，0表示QRSizeMiddle
+}
+
+//PayURIForm 解析付款码
+type PayURIForm struct {
+	URI string `json:"uri" validate:"required,lte=1024"` //付款码，如：niaobi://pay?v=1&to=alice&amount=5，或旧的二维码中的鸟币号
+}
+
+//PayURIRes 解析后的付款码，字段名与NewPayForm相同，可直接作为转账(/tx/pay)的参数
+type PayURIRes struct {
+	Version   int    `json:"v"`                            //付款码的版本，旧的二维码为0
+	TransCoin string `json:"transCoin,omitempty"`          //交易的鸟币名，为空时由付款方选择
+	Receiver  string `json:"receiver"`                     //收款方鸟币号
+	Amount    uint64 `json:"amount,omitempty"`             //转账数额，为空时由付款方填写
+	IsMarker  bool   `json:"isMarker"`                     //是否是血盟
+	Memo      string `json:"memo,omitempty" format:"trim"` //备注，转账时再转义
+}
+
+//TxVerifyRes 交易签名的验证结果
+type TxVerifyRes struct {
+	Table    string `json:"table"`            //pay、req或repay
+	ID       uint64 `json:"id"`               //交易记录ID
+	Signer   string `json:"signer"`           //签名者：转账为付款方，兑现请求为持有者，接受兑现请求为发行者
+	Buddy    string `json:"buddy"`            //交易的另一方
+	Signed   bool   `json:"signed"`           //是否已签名
+	Valid    bool   `json:"valid"`            //签名是否正确
+	KeyID    uint64 `json:"keyID,omitempty"`  //签名使用的公钥ID
+	PubKey   string `json:"pubKey,omitempty"` //签名使用的公钥
+	SignedAt int64  `json:"signedAt,omitempty"`
+	Err      string `json:"err,omitempty"`      //签名不正确的原因
+	Source   string `json:"source,omitempty"`   //签名所在的记录：领取代金券的转账为voucher，领取兑换码的发行为gift（批次发行者的签名），为空表示交易记录本身
+	SourceID uint64 `json:"sourceID,omitempty"` //签名所在记录的ID
+}
+
+//LedgerProofRes 交易记录的账本证明：hash = sha256(prev + content)，hash按path依次合并得到检查点的root，见util.VerifyMerkleProof
+type LedgerProofRes struct {
+	Entry      *db.Ledger           `json:"entry"`
+	Content    string               `json:"content"`              //记录内容的规范编码
+	Checkpoint *db.LedgerCheckpoint `json:"checkpoint,omitempty"` //包含此记录的检查点，尚未生成检查点时为空
+	Index      int                  `json:"index"`                //记录在检查点中的位置，从0开始
+	Path       []util.MerkleStep    `json:"path,omitempty"`       //Merkle证明
+}
+
+//LedgerVerifyRes 账本的验证结果
+type LedgerVerifyRes struct {
+	Entries     int      `json:"entries"`     //验证的账本记录数
+	Checkpoints int      `json:"checkpoints"` //验证的检查点数
+	Problems    []string `json:"problems"`    //发现的问题，为空表示账本完整
 }
 
 //===========err trans=============
@@ -34,6 +161,21 @@ func (form NewPayForm) NewPayFieldTrans() FieldTrans {
 	m["Receiver"] = "收款方鸟币号"
 	m["IsMarker"] = "血盟标记"
 	m["Amount"] = "转账数额"
+	m["InvoiceID"] = "收款单ID"
+	m["Memo"] = "备注"
+	m["Sig"] = "交易签名"
+	m["SignedAt"] = "签名时间"
+	return m
+}
+
+//NewInvoiceFieldTrans 字段本地化，供validator使用
+func (form NewInvoiceForm) NewInvoiceFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Coins"] = "接受的鸟币"
+	m["Amount"] = "收款数额"
+	m["Memo"] = "备注"
+	m["ExpireHours"] = "过期时间"
+	m["MultiUse"] = "多次付款"
 	return m
 }
 
@@ -44,6 +186,11 @@ func (form NewReqForm) NewReqFieldTrans() FieldTrans {
 	m["SnapID"] = "技能快照"
 	m["IsMarker"] = "血盟标记"
 	m["Amount"] = "兑现数额"
+	m["SlotID"] = "预约时段"
+	m["TierQty"] = "价格档位"
+	m["Memo"] = "备注"
+	m["Sig"] = "交易签名"
+	m["SignedAt"] = "签名时间"
 	return m
 }
 
@@ -55,5 +202,67 @@ func (form NewRepayForm) NewRepayFieldTrans() FieldTrans {
 	m["SnapID"] = "技能快照"
 	m["IsMarker"] = "血盟标记"
 	m["Amount"] = "兑现数额"
+	m["Memo"] = "备注"
+	m["Sig"] = "交易签名"
+	m["SignedAt"] = "签名时间"
+	return m
+}
+
+//NewVoucherFieldTrans 字段本地化，供validator使用
+func (form NewVoucherForm) NewVoucherFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["TransCoin"] = "鸟币名"
+	m["Amount"] = "数额"
+	m["IsMarker"] = "血盟标记"
+	m["Memo"] = "备注"
+	m["ExpireHours"] = "有效期"
+	m["Sig"] = "签名"
+	m["SignedAt"] = "签名时间"
+	return m
+}
+
+//ClaimVoucherFieldTrans 字段本地化，供validator使用
+func (form ClaimVoucherForm) ClaimVoucherFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Code"] = "领取码"
+	return m
+}
+
+//NewGiftFieldTrans 字段本地化，供validator使用
+func (form NewGiftForm) NewGiftFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Amount"] = "数额"
+	m["Count"] = "兑换码数量"
+	m["IsMarker"] = "血盟标记"
+	m["Memo"] = "备注"
+	m["ExpireHours"] = "过期时间"
+	m["Sig"] = "签名"
+	m["SignedAt"] = "签名时间"
+	return m
+}
+
+//ClaimGiftFieldTrans 字段本地化，供validator使用
+func (form ClaimGiftForm) ClaimGiftFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["Code"] = "兑换码"
+	return m
+}
+
+//PayQRCFieldTrans 字段本地化，供validator使用
+func (form PayQRCForm) PayQRCFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["To"] = "收款方鸟币号"
+	m["Coin"] = "交易的鸟币名"
+	m["Amount"] = "转账数额"
+	m["IsMarker"] = "血盟标记"
+	m["Memo"] = "备注"
+	m["W"] = "二维码大小"
+	return m
+}
+
+//PayURIFieldTrans 字段本地化，供validator使用
+func (form PayURIForm) PayURIFieldTrans() FieldTrans {
+	m := FieldTrans{}
+	m["URI"] = "付款码"
 	return m
 }
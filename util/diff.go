@@ -0,0 +1,57 @@
+package util
+
+import (
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+//TextDiff 文本差异片段，Op为equal、insert、delete
+type TextDiff struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+//DiffText 比较两段文本，返回易读的差异片段（按语义合并过的字符级差异）
+func DiffText(from string, to string) []TextDiff {
+	dmp := diffmatchpatch.New()
+	diffs := dmp.DiffMain(from, to, false)
+	diffs = dmp.DiffCleanupSemantic(diffs)
+
+	res := []TextDiff{}
+	for _, d := range diffs {
+		op := "equal"
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = "insert"
+		case diffmatchpatch.DiffDelete:
+			op = "delete"
+		}
+		res = append(res, TextDiff{Op: op, Text: d.Text})
+	}
+	return res
+}
+
+//DiffList 比较两个字符串数组，返回新增和移除的元素，保持原有顺序
+func DiffList(from []string, to []string) (added []string, removed []string) {
+	fromSet := map[string]bool{}
+	for _, s := range from {
+		fromSet[s] = true
+	}
+	toSet := map[string]bool{}
+	for _, s := range to {
+		toSet[s] = true
+	}
+
+	added = []string{}
+	for _, s := range to {
+		if fromSet[s] == false {
+			added = append(added, s)
+		}
+	}
+	removed = []string{}
+	for _, s := range from {
+		if toSet[s] == false {
+			removed = append(removed, s)
+		}
+	}
+	return
+}
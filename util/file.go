@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"os"
 
@@ -30,6 +31,22 @@ func SaveFileTo(fh *multipart.FileHeader, destDirectory string) (int64, error) {
 	return io.Copy(out, src)
 }
 
+//ReadUpload 读取上传的文件
+func ReadUpload(fh *multipart.FileHeader) ([]byte, error) {
+	src, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return ioutil.ReadAll(src)
+}
+
+//GetHash256Bytes 计算数据的hash值，采用blake2b算法
+func GetHash256Bytes(data []byte) string {
+	sum := blake2b.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // GetHash256 计算文件的hash值，采用blake2b算法
 func GetHash256(filename string) (string, error) {
 	// Start hash
@@ -0,0 +1,58 @@
+package util
+
+import "math"
+
+//EarthRadiusKm 地球平均半径（公里）
+const EarthRadiusKm = 6371.0
+
+//kmPerDegree 每纬度对应的距离（公里）
+const kmPerDegree = 111.32
+
+//BlurLocation 按隐私半径（米）模糊处理位置：把经纬度对齐到边长为隐私半径的网格中心，同一网格内的位置都会得到相同的坐标
+func BlurLocation(lat float64, lng float64, meters uint32) (float64, float64) {
+	if meters == 0 {
+		return lat, lng
+	}
+	cell := float64(meters) / 1000 / kmPerDegree
+	blurLat := (math.Floor(lat/cell) + 0.5) * cell
+	blurLat = math.Max(-90, math.Min(90, blurLat))
+
+	cos := math.Cos(blurLat * math.Pi / 180)
+	if cos < 0.01 {
+		//靠近两极时经度无意义
+		return blurLat, 0
+	}
+	lngCell := cell / cos
+	blurLng := (math.Floor(lng/lngCell) + 0.5) * lngCell
+	if blurLng > 180 {
+		blurLng -= 360
+	}
+	return blurLat, blurLng
+}
+
+//BoundingBox 计算以某点为中心、半径为km的经纬度范围，用于在计算距离前先通过索引过滤
+//经度范围跨越±180度时，lngMin > lngMax
+func BoundingBox(lat float64, lng float64, km float64) (latMin, latMax, lngMin, lngMax float64) {
+	dLat := km / kmPerDegree
+	latMin = math.Max(-90, lat-dLat)
+	latMax = math.Min(90, lat+dLat)
+
+	cos := math.Min(math.Cos(latMin*math.Pi/180), math.Cos(latMax*math.Pi/180))
+	if latMin <= -90 || latMax >= 90 || cos < 0.01 {
+		//范围包含极点，所有经度都符合
+		return latMin, latMax, -180, 180
+	}
+	dLng := dLat / cos
+	if dLng >= 180 {
+		return latMin, latMax, -180, 180
+	}
+	lngMin = lng - dLng
+	lngMax = lng + dLng
+	if lngMin < -180 {
+		lngMin += 360
+	}
+	if lngMax > 180 {
+		lngMax -= 360
+	}
+	return
+}
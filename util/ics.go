@@ -0,0 +1,68 @@
+package util
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+//ICSEvent iCalendar的日程
+type ICSEvent struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	Updated     time.Time
+}
+
+//icsTimeLayout iCalendar的UTC时间格式
+const icsTimeLayout = "20060102T150405Z"
+
+//ICalendar 生成iCalendar(.ics)格式的日历（RFC 5545）
+func ICalendar(name string, events []ICSEvent) string {
+	var b strings.Builder
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//niaobi.org//niaobi-go//CN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "METHOD:PUBLISH")
+	writeICSLine(&b, "X-WR-CALNAME:"+escapeICSText(name))
+	for _, event := range events {
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, "UID:"+event.UID)
+		writeICSLine(&b, "DTSTAMP:"+event.Updated.UTC().Format(icsTimeLayout))
+		writeICSLine(&b, "DTSTART:"+event.Start.UTC().Format(icsTimeLayout))
+		writeICSLine(&b, "DTEND:"+event.End.UTC().Format(icsTimeLayout))
+		writeICSLine(&b, "SUMMARY:"+escapeICSText(event.Summary))
+		if event.Description != "" {
+			writeICSLine(&b, "DESCRIPTION:"+escapeICSText(event.Description))
+		}
+		writeICSLine(&b, "END:VEVENT")
+	}
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.String()
+}
+
+//escapeICSText 转义TEXT类型的值
+func escapeICSText(text string) string {
+	return strings.NewReplacer("\\", "\\\\", ";", "\\;", ",", "\\,", "\r\n", "\\n", "\n", "\\n").Replace(text)
+}
+
+//writeICSLine 写入一行，每行不超过75字节，超出时折行（CRLF后加一个空格），不拆分utf8字符
+func writeICSLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+		//续行的空格占1字节
+		limit = 74
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//MerkleStep Merkle证明的一步：与兄弟节点合并得到上一层的节点，Left为true时兄弟节点在左边
+type MerkleStep struct {
+	Hash string `json:"hash"` //兄弟节点的哈希（hex）
+	Left bool   `json:"left"`
+}
+
+//Merkle树的计算方式（参考RFC 6962）：
+//叶子节点 = sha256(0x00 + 叶子)，中间节点 = sha256(0x01 + 左 + 右)
+//某一层的节点为奇数个时，最后一个节点直接提升到上一层
+
+//MerkleRoot 计算Merkle根哈希，没有叶子时返回nil
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return nil
+	}
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+//MerkleProof 第index个叶子到根的证明，依次与证明中的兄弟节点合并即得到根哈希
+func MerkleProof(leaves [][]byte, index int) []MerkleStep {
+	if index < 0 || index >= len(leaves) {
+		return nil
+	}
+	path := []MerkleStep{}
+	level := merkleLeaves(leaves)
+	for len(level) > 1 {
+		if index%2 == 1 {
+			path = append(path, MerkleStep{Hash: hex.EncodeToString(level[index-1]), Left: true})
+		} else if index+1 < len(level) {
+			path = append(path, MerkleStep{Hash: hex.EncodeToString(level[index+1])})
+		}
+		level = merkleLevel(level)
+		index /= 2
+	}
+	return path
+}
+
+//VerifyMerkleProof 验证叶子是否包含在根哈希为root的Merkle树中
+func VerifyMerkleProof(leaf []byte, path []MerkleStep, root []byte) bool {
+	node := merkleHash(0x00, leaf)
+	for _, step := range path {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return false
+		}
+		if step.Left {
+			node = merkleHash(0x01, sibling, node)
+		} else {
+			node = merkleHash(0x01, node, sibling)
+		}
+	}
+	return bytes.Equal(node, root)
+}
+
+func merkleLeaves(leaves [][]byte) [][]byte {
+	level := make([][]byte, len(leaves))
+	for i, leaf := range leaves {
+		level[i] = merkleHash(0x00, leaf)
+	}
+	return level
+}
+
+func merkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			break
+		}
+		next = append(next, merkleHash(0x01, level[i], level[i+1]))
+	}
+	return next
+}
+
+func merkleHash(prefix byte, parts ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
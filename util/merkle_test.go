@@ -0,0 +1,101 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+)
+
+func merkleTestLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range leaves {
+		sum := sha256.Sum256([]byte("leaf " + strconv.Itoa(i)))
+		leaves[i] = sum[:]
+	}
+	return leaves
+}
+
+func TestMerkleRoundTrip(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		leaves := merkleTestLeaves(n)
+		root := MerkleRoot(leaves)
+		if len(root) != sha256.Size {
+			t.Fatalf("n=%d: root length %d", n, len(root))
+		}
+		for i := 0; i < n; i++ {
+			path := MerkleProof(leaves, i)
+			if VerifyMerkleProof(leaves[i], path, root) == false {
+				t.Errorf("n=%d index=%d: proof does not verify", n, i)
+			}
+			//证明不能用于其他叶子
+			other := leaves[(i+1)%n]
+			if n > 1 && VerifyMerkleProof(other, path, root) {
+				t.Errorf("n=%d index=%d: proof verifies a different leaf", n, i)
+			}
+			//篡改证明中的任一步都不能通过验证
+			for j := range path {
+				tampered := append([]MerkleStep{}, path...)
+				tampered[j].Left = !tampered[j].Left
+				if VerifyMerkleProof(leaves[i], tampered, root) {
+					t.Errorf("n=%d index=%d: flipped step %d still verifies", n, i, j)
+				}
+				tampered[j] = MerkleStep{Hash: hex.EncodeToString(make([]byte, sha256.Size)), Left: path[j].Left}
+				if VerifyMerkleProof(leaves[i], tampered, root) {
+					t.Errorf("n=%d index=%d: zeroed step %d still verifies", n, i, j)
+				}
+			}
+		}
+	}
+}
+
+func TestMerkleShape(t *testing.T) {
+	leaves := merkleTestLeaves(3)
+	leaf := func(i int) []byte { return merkleHash(0x00, leaves[i]) }
+
+	//单个叶子：根为叶子节点的哈希，证明为空
+	if root := MerkleRoot(leaves[:1]); bytes.Equal(root, leaf(0)) == false {
+		t.Errorf("single leaf root = %x", root)
+	}
+	if path := MerkleProof(leaves[:1], 0); len(path) != 0 {
+		t.Errorf("single leaf proof = %v", path)
+	}
+
+	//3个叶子：第3个叶子直接提升到上一层，root = H(H(l0, l1), l2)
+	want := merkleHash(0x01, merkleHash(0x01, leaf(0), leaf(1)), leaf(2))
+	if root := MerkleRoot(leaves); bytes.Equal(root, want) == false {
+		t.Errorf("3 leaves root = %x, want %x", root, want)
+	}
+	path := MerkleProof(leaves, 2)
+	if len(path) != 1 || path[0].Left == false || path[0].Hash != hex.EncodeToString(merkleHash(0x01, leaf(0), leaf(1))) {
+		t.Errorf("promoted leaf proof = %+v", path)
+	}
+
+	//叶子和中间节点使用不同的前缀，两个叶子拼接后不能伪装成中间节点
+	if bytes.Equal(MerkleRoot(leaves[:2]), MerkleRoot([][]byte{append(append([]byte{}, leaf(0)...), leaf(1)...)})) {
+		t.Error("internal node collides with a leaf")
+	}
+}
+
+func TestMerkleEdgeCases(t *testing.T) {
+	if root := MerkleRoot(nil); root != nil {
+		t.Errorf("empty root = %x", root)
+	}
+	leaves := merkleTestLeaves(5)
+	for _, index := range []int{-1, 5, 100} {
+		if path := MerkleProof(leaves, index); path != nil {
+			t.Errorf("MerkleProof(index=%d) = %v, want nil", index, path)
+		}
+	}
+	if path := MerkleProof(nil, 0); path != nil {
+		t.Errorf("MerkleProof(nil) = %v", path)
+	}
+	root := MerkleRoot(leaves)
+	if VerifyMerkleProof(leaves[0], []MerkleStep{{Hash: "not hex"}}, root) {
+		t.Error("invalid hex in proof verifies")
+	}
+	if VerifyMerkleProof(leaves[0], nil, root) {
+		t.Error("empty proof verifies against a multi-leaf root")
+	}
+}
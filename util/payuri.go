@@ -0,0 +1,176 @@
+package util
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+//PayURI 付款码，二维码的内容：niaobi://pay?v=1&to=收款方&coin=鸟币&amount=数额&marker=1&memo=备注
+//coin、amount为空时由付款方选择和填写。旧的二维码内容只有鸟币号，解析为收款方，版本为0
+type PayURI struct {
+	Version  int
+	To       string //收款方鸟币号
+	Coin     string //交易的鸟币名
+	Amount   uint64 //转账数额
+	IsMarker bool   //是否是血盟
+	Memo     string //备注
+}
+
+const (
+	//PayURIScheme 付款码的scheme
+	PayURIScheme = "niaobi"
+	//PayURIVersion 付款码的当前版本，新增参数时增加版本号，旧版本的客户端拒绝解析新版本的付款码
+	PayURIVersion = 1
+	//payURIMaxName 鸟币号的最大长度
+	payURIMaxName = 20
+	//payURIMaxMemo 备注的最大字符数
+	payURIMaxMemo = 100
+)
+
+var (
+	//ErrPayURI 付款码格式不正确
+	ErrPayURI = errors.New("invalid pay uri")
+	//ErrPayURIVersion 付款码的版本高于PayURIVersion
+	ErrPayURIVersion = errors.New("unsupported pay uri version")
+)
+
+//String 生成付款码，参数按名称排序，空参数省略
+func (p *PayURI) String() string {
+	query := url.Values{}
+	query.Set("v", strconv.Itoa(PayURIVersion))
+	query.Set("to", p.To)
+	if p.Coin != "" {
+		query.Set("coin", p.Coin)
+	}
+	if p.Amount > 0 {
+		query.Set("amount", strconv.FormatUint(p.Amount, 10))
+	}
+	if p.IsMarker {
+		query.Set("marker", "1")
+	}
+	if p.Memo != "" {
+		query.Set("memo", p.Memo)
+	}
+	return PayURIScheme + "://pay?" + query.Encode()
+}
+
+//ParsePayURI 解析并检查付款码，只有鸟币号时（旧的二维码）解析为收款方
+func ParsePayURI(s string) (*PayURI, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") == false {
+		if s == "" || len(s) > payURIMaxName || strings.ContainsAny(s, "/?&=# ") {
+			return nil, ErrPayURI
+		}
+		return &PayURI{To: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || strings.ToLower(u.Scheme) != PayURIScheme || u.Host != "pay" || strings.Trim(u.Path, "/") != "" {
+		return nil, ErrPayURI
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, ErrPayURI
+	}
+	version, err := strconv.Atoi(query.Get("v"))
+	if err != nil || version < 1 {
+		return nil, ErrPayURI
+	}
+	if version > PayURIVersion {
+		return nil, ErrPayURIVersion
+	}
+
+	p := &PayURI{Version: version, To: query.Get("to"), Coin: query.Get("coin"), Memo: query.Get("memo")}
+	if p.To == "" || len(p.To) > payURIMaxName || len(p.Coin) > payURIMaxName {
+		return nil, ErrPayURI
+	}
+	if utf8.ValidString(p.Memo) == false || utf8.RuneCountInString(p.Memo) > payURIMaxMemo {
+		return nil, ErrPayURI
+	}
+	if amount := query.Get("amount"); amount != "" {
+		p.Amount, err = strconv.ParseUint(amount, 10, 64)
+		if err != nil {
+			return nil, ErrPayURI
+		}
+	}
+	switch query.Get("marker") {
+	case "", "0":
+	case "1":
+		p.IsMarker = true
+	default:
+		return nil, ErrPayURI
+	}
+	return p, nil
+}
+
+//VoucherURI 代金券二维码的内容：niaobi://voucher?v=1&code=领取码&from=创建者&coin=鸟币&amount=数额&marker=1&memo=备注&hours=有效期&ts=签名时间&key=公钥ID&sig=签名
+//领取只需要code，其余参数和签名供没有网络时查看和验证，签名内容见controller/txsign.go
+type VoucherURI struct {
+	Version  int
+	Code     string //领取码
+	From     string //创建者鸟币号
+	Coin     string //鸟币名
+	Amount   uint64 //数额
+	IsMarker bool   //是否是血盟
+	Memo     string //备注
+	Hours    uint32 //有效期（小时）
+	SignedAt int64  //签名时间（unix秒）
+	KeyID    uint64 //签名使用的公钥ID，0表示未签名
+	Sig      string //创建者的ed25519签名（hex）
+}
+
+//String 生成代金券二维码的内容，空参数省略
+func (v *VoucherURI) String() string {
+	query := url.Values{}
+	query.Set("v", strconv.Itoa(PayURIVersion))
+	query.Set("code", v.Code)
+	query.Set("from", v.From)
+	query.Set("coin", v.Coin)
+	query.Set("amount", strconv.FormatUint(v.Amount, 10))
+	if v.IsMarker {
+		query.Set("marker", "1")
+	}
+	if v.Memo != "" {
+		query.Set("memo", v.Memo)
+	}
+	query.Set("hours", strconv.FormatUint(uint64(v.Hours), 10))
+	if v.KeyID > 0 {
+		query.Set("ts", strconv.FormatInt(v.SignedAt, 10))
+		query.Set("key", strconv.FormatUint(v.KeyID, 10))
+		query.Set("sig", v.Sig)
+	}
+	return PayURIScheme + "://voucher?" + query.Encode()
+}
+
+//ParseVoucherURI 解析代金券二维码的内容，只检查领取码和版本
+func ParseVoucherURI(s string) (*VoucherURI, error) {
+	u, err := url.Parse(strings.TrimSpace(s))
+	if err != nil || strings.ToLower(u.Scheme) != PayURIScheme || u.Host != "voucher" {
+		return nil, ErrPayURI
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, ErrPayURI
+	}
+	version, err := strconv.Atoi(query.Get("v"))
+	if err != nil || version < 1 {
+		return nil, ErrPayURI
+	}
+	if version > PayURIVersion {
+		return nil, ErrPayURIVersion
+	}
+	v := &VoucherURI{Version: version, Code: query.Get("code"), From: query.Get("from"), Coin: query.Get("coin"), Memo: query.Get("memo"), Sig: query.Get("sig")}
+	if v.Code == "" {
+		return nil, ErrPayURI
+	}
+	v.Amount, _ = strconv.ParseUint(query.Get("amount"), 10, 64)
+	v.IsMarker = query.Get("marker") == "1"
+	hours, _ := strconv.ParseUint(query.Get("hours"), 10, 32)
+	v.Hours = uint32(hours)
+	v.SignedAt, _ = strconv.ParseInt(query.Get("ts"), 10, 64)
+	v.KeyID, _ = strconv.ParseUint(query.Get("key"), 10, 64)
+	return v, nil
+}
@@ -1,98 +1,370 @@
 package util
 
-import "os"
+import (
+	"encoding/binary"
+	"errors"
+)
 
-//GetPicDimensions 根据后缀获取图片大小
-func GetPicDimensions(file *os.File) (width int, height int) {
-	bytes := make([]byte, 4)
-	n, _ := file.ReadAt(bytes, 0)
-	if n < 4 {
-		return 0, 0
+//PicInfo 从图片文件头解析出的信息
+type PicInfo struct {
+	Format      string //格式：jpg、png、gif、bmp、webp
+	Width       int    //宽，已按EXIF方向旋转
+	Height      int    //高，已按EXIF方向旋转
+	Orientation int    //EXIF方向1-8，没有EXIF方向时为0
+	Frames      int    //帧数，静态图为1
+}
+
+var (
+	//ErrPicFormat 无法识别或不支持解析的图片格式
+	ErrPicFormat = errors.New("pic: unknown format")
+	//ErrPicCorrupt 图片文件头不完整或已损坏
+	ErrPicCorrupt = errors.New("pic: corrupt header")
+)
+
+//SniffPicFormat 根据文件头识别图片格式，可识别jpg、png、gif、bmp、webp，以及heic、avif（ISO BMFF的ftyp）
+//无法识别时返回空字符串
+func SniffPicFormat(data []byte) string {
+	switch {
+	case len(data) >= 8 && string(data[:8]) == "\x89PNG\r\n\x1a\n":
+		return "png"
+	case len(data) >= 3 && data[0] == 0xFF && data[1] == 0xD8 && data[2] == 0xFF:
+		return "jpg"
+	case len(data) >= 6 && (string(data[:6]) == "GIF87a" || string(data[:6]) == "GIF89a"):
+		return "gif"
+	case len(data) >= 2 && string(data[:2]) == "BM":
+		return "bmp"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			return "heic"
+		case "avif", "avis":
+			return "avif"
+		}
 	}
-	if bytes[0] == 0x89 && bytes[1] == 0x50 && bytes[2] == 0x4E && bytes[3] == 0x47 {
-		return GetPngDimensions(file)
+	return ""
+}
+
+//DecodePicInfo 解析图片的格式、宽高、EXIF方向和帧数，只读取文件头和必要的块，不解码像素
+//所有读取都检查边界，文件不完整或长度字段不合法时返回ErrPicCorrupt，不会死循环
+func DecodePicInfo(data []byte) (*PicInfo, error) {
+	info := &PicInfo{Format: SniffPicFormat(data), Frames: 1}
+	var err error
+	switch info.Format {
+	case "jpg":
+		err = decodeJPG(data, info)
+	case "png":
+		err = decodePNG(data, info)
+	case "gif":
+		err = decodeGIF(data, info)
+	case "bmp":
+		err = decodeBMP(data, info)
+	case "webp":
+		err = decodeWebP(data, info)
+	default:
+		return nil, ErrPicFormat
 	}
-	if bytes[0] == 0xFF && bytes[1] == 0xD8 {
-		return GetJpgDimensions(file)
+	if err != nil {
+		return nil, err
 	}
-	if bytes[0] == 0x47 && bytes[1] == 0x49 && bytes[2] == 0x46 && bytes[3] == 0x38 {
-		return GetGifDimensions(file)
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, ErrPicCorrupt
 	}
-	if bytes[0] == 0x42 && bytes[1] == 0x4D {
-		return GetBmpDimensions(file)
+	//EXIF方向5-8为旋转90度或270度，宽高互换
+	if info.Orientation >= 5 && info.Orientation <= 8 {
+		info.Width, info.Height = info.Height, info.Width
 	}
-	return 0, 0
+	return info, nil
+}
+
+//picBytes 带边界检查的读取
+type picBytes []byte
+
+func (b picBytes) has(off int, n int) bool {
+	return off >= 0 && n >= 0 && off <= len(b) && n <= len(b)-off
 }
 
-//GetFormat 获取图片格式
-func GetFormat(file *os.File) string {
-	bytes := make([]byte, 4)
-	n, _ := file.ReadAt(bytes, 0)
-	if n < 4 {
-		return ""
+func (b picBytes) be16(off int) (int, bool) {
+	if b.has(off, 2) == false {
+		return 0, false
 	}
-	if bytes[0] == 0x89 && bytes[1] == 0x50 && bytes[2] == 0x4E && bytes[3] == 0x47 {
-		return "png"
+	return int(binary.BigEndian.Uint16(b[off:])), true
+}
+
+//decodeJPG 遍历标记段直到SOFn，途中读取APP1中的EXIF方向
+func decodeJPG(data []byte, info *PicInfo) error {
+	b := picBytes(data)
+	pos := 2
+	for {
+		//标记前可以有任意个0xFF填充字节
+		for b.has(pos, 2) && b[pos] == 0xFF && b[pos+1] == 0xFF {
+			pos++
+		}
+		if b.has(pos, 2) == false || b[pos] != 0xFF {
+			return ErrPicCorrupt
+		}
+		marker := b[pos+1]
+		pos += 2
+
+		//没有长度的独立标记：TEM、RSTn、SOI
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			continue
+		}
+		//扫描数据或文件结束前没有SOF
+		if marker == 0xDA || marker == 0xD9 {
+			return ErrPicCorrupt
+		}
+
+		length, ok := b.be16(pos)
+		if ok == false || length < 2 || b.has(pos, length) == false {
+			return ErrPicCorrupt
+		}
+		segment := b[pos+2 : pos+length]
+
+		switch {
+		case marker == 0xE1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00":
+			info.Orientation = exifOrientation(segment[6:])
+		//SOF0-SOF15，不包括DHT(C4)、JPG(C8)、DAC(CC)
+		case marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC:
+			if len(segment) < 6 {
+				return ErrPicCorrupt
+			}
+			info.Height = int(binary.BigEndian.Uint16(segment[1:]))
+			info.Width = int(binary.BigEndian.Uint16(segment[3:]))
+			return nil
+		}
+		pos += length
 	}
-	if bytes[0] == 0xFF && bytes[1] == 0xD8 {
-		return "jpg"
+}
+
+//exifOrientation 从TIFF格式的EXIF数据中读取IFD0的Orientation(0x0112)，读取失败时返回0
+func exifOrientation(tiff []byte) int {
+	b := picBytes(tiff)
+	if b.has(0, 8) == false {
+		return 0
 	}
-	if bytes[0] == 0x47 && bytes[1] == 0x49 && bytes[2] == 0x46 && bytes[3] == 0x38 {
-		return "gif"
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
 	}
-	if bytes[0] == 0x42 && bytes[1] == 0x4D {
-		return "bmp"
+	if order.Uint16(b[2:]) != 42 {
+		return 0
 	}
-	return ""
+	ifd := order.Uint32(b[4:])
+	if ifd > uint32(len(b)) || b.has(int(ifd), 2) == false {
+		return 0
+	}
+	count := int(order.Uint16(b[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := int(ifd) + 2 + i*12
+		if b.has(entry, 12) == false {
+			return 0
+		}
+		if order.Uint16(b[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(b[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 0
+			}
+			return orientation
+		}
+	}
+	return 0
 }
 
-//GetGifDimensions 获取Gif大小
-func GetGifDimensions(file *os.File) (width int, height int) {
-	bytes := make([]byte, 4)
-	file.ReadAt(bytes, 6)
-	width = int(bytes[0]) + int(bytes[1])*256
-	height = int(bytes[2]) + int(bytes[3])*256
-	return
+//decodePNG 读取IHDR的宽高，APNG的acTL中的帧数
+func decodePNG(data []byte, info *PicInfo) error {
+	b := picBytes(data)
+	if b.has(8, 25) == false || string(b[12:16]) != "IHDR" {
+		return ErrPicCorrupt
+	}
+	w := binary.BigEndian.Uint32(b[16:])
+	h := binary.BigEndian.Uint32(b[20:])
+	if w == 0 || h == 0 || w > 1<<31-1 || h > 1<<31-1 {
+		return ErrPicCorrupt
+	}
+	info.Width, info.Height = int(w), int(h)
+
+	//acTL必须在IDAT之前，遇到IDAT或数据不完整时停止查找
+	pos := 8
+	for b.has(pos, 12) {
+		length := binary.BigEndian.Uint32(b[pos:])
+		chunk := string(b[pos+4 : pos+8])
+		if chunk == "IDAT" || length > uint32(len(b)) {
+			break
+		}
+		if chunk == "acTL" && length >= 8 && b.has(pos+8, 8) {
+			if frames := binary.BigEndian.Uint32(b[pos+8:]); frames > 0 && frames < 1<<31 {
+				info.Frames = int(frames)
+			}
+			break
+		}
+		pos += 12 + int(length)
+	}
+	return nil
 }
 
-//GetBmpDimensions 获取bmp大小
-func GetBmpDimensions(file *os.File) (width int, height int) {
-	bytes := make([]byte, 8)
-	file.ReadAt(bytes, 18)
-	width = int(bytes[3])<<24 | int(bytes[2])<<16 | int(bytes[1])<<8 | int(bytes[0])
-	height = int(bytes[7])<<24 | int(bytes[6])<<16 | int(bytes[5])<<8 | int(bytes[4])
-	return
+//decodeGIF 读取逻辑屏幕宽高，遍历数据块统计帧数
+func decodeGIF(data []byte, info *PicInfo) error {
+	b := picBytes(data)
+	if b.has(0, 13) == false {
+		return ErrPicCorrupt
+	}
+	info.Width = int(binary.LittleEndian.Uint16(b[6:]))
+	info.Height = int(binary.LittleEndian.Uint16(b[8:]))
+
+	pos := 13
+	//全局颜色表
+	if b[10]&0x80 != 0 {
+		pos += 3 << (uint(b[10]&0x07) + 1)
+	}
+	frames := 0
+	//skipSubBlocks 跳过以0结尾的数据子块，返回下一个位置
+	var skipSubBlocks = func(pos int) (int, bool) {
+		for b.has(pos, 1) {
+			size := int(b[pos])
+			pos++
+			if size == 0 {
+				return pos, true
+			}
+			pos += size
+		}
+		return pos, false
+	}
+	for {
+		if b.has(pos, 1) == false {
+			//缺少结束符，已有完整的帧时视为正常结束
+			break
+		}
+		var ok bool
+		switch b[pos] {
+		case 0x3B: //结束符
+			pos = len(b)
+			ok = true
+		case 0x21: //扩展块
+			if b.has(pos, 2) == false {
+				break
+			}
+			pos, ok = skipSubBlocks(pos + 2)
+		case 0x2C: //图像描述符
+			if b.has(pos, 10) == false {
+				break
+			}
+			packed := b[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (uint(packed&0x07) + 1)
+			}
+			//LZW最小码长
+			pos++
+			pos, ok = skipSubBlocks(pos)
+			if ok {
+				frames++
+			}
+		}
+		if ok == false {
+			break
+		}
+	}
+	if frames == 0 {
+		return ErrPicCorrupt
+	}
+	info.Frames = frames
+	return nil
 }
 
-//GetPngDimensions 获取png大小
-func GetPngDimensions(file *os.File) (width int, height int) {
-	bytes := make([]byte, 8)
-	file.ReadAt(bytes, 16)
-	width = int(bytes[0])<<24 | int(bytes[1])<<16 | int(bytes[2])<<8 | int(bytes[3])
-	height = int(bytes[4])<<24 | int(bytes[5])<<16 | int(bytes[6])<<8 | int(bytes[7])
-	return
+//decodeBMP 支持BITMAPCOREHEADER(12字节)和BITMAPINFOHEADER及以上版本，高为负数时为自上而下存储
+func decodeBMP(data []byte, info *PicInfo) error {
+	b := picBytes(data)
+	if b.has(14, 4) == false {
+		return ErrPicCorrupt
+	}
+	headerSize := binary.LittleEndian.Uint32(b[14:])
+	if headerSize == 12 {
+		if b.has(18, 4) == false {
+			return ErrPicCorrupt
+		}
+		info.Width = int(binary.LittleEndian.Uint16(b[18:]))
+		info.Height = int(binary.LittleEndian.Uint16(b[20:]))
+		return nil
+	}
+	if headerSize < 40 || b.has(18, 8) == false {
+		return ErrPicCorrupt
+	}
+	w := int32(binary.LittleEndian.Uint32(b[18:]))
+	h := int32(binary.LittleEndian.Uint32(b[22:]))
+	if h < 0 {
+		if h == -1<<31 {
+			return ErrPicCorrupt
+		}
+		h = -h
+	}
+	info.Width, info.Height = int(w), int(h)
+	return nil
 }
 
-//GetJpgDimensions 获取jpg大小
-func GetJpgDimensions(file *os.File) (width int, height int) {
-	fi, _ := file.Stat()
-	fileSize := fi.Size()
-
-	position := int64(4)
-	bytes := make([]byte, 4)
-	file.ReadAt(bytes[:2], position)
-	length := int(bytes[0])<<8 + int(bytes[1])
-	for position < fileSize {
-		position += int64(length)
-		file.ReadAt(bytes, position)
-		length = int(bytes[2])<<8 + int(bytes[3])
-		if (bytes[1] == 0xC0 || bytes[1] == 0xC2) && bytes[0] == 0xFF && length > 7 {
-			file.ReadAt(bytes, position+5)
-			width = int(bytes[2])<<8 + int(bytes[3])
-			height = int(bytes[0])<<8 + int(bytes[1])
-			return
-		}
-		position += 2
-	}
-	return 0, 0
+//decodeWebP 支持有损（VP8）、无损（VP8L）和扩展（VP8X）格式，扩展格式读取动画帧数和EXIF方向
+func decodeWebP(data []byte, info *PicInfo) error {
+	b := picBytes(data)
+	if b.has(12, 8) == false {
+		return ErrPicCorrupt
+	}
+	switch string(b[12:16]) {
+	case "VP8 ":
+		//3字节帧标记 + 3字节起始码(9d 01 2a)，之后为14位的宽高
+		if b.has(20, 10) == false || b[23] != 0x9D || b[24] != 0x01 || b[25] != 0x2A {
+			return ErrPicCorrupt
+		}
+		info.Width = int(binary.LittleEndian.Uint16(b[26:]) & 0x3FFF)
+		info.Height = int(binary.LittleEndian.Uint16(b[28:]) & 0x3FFF)
+	case "VP8L":
+		//1字节签名(0x2f)，之后为14位的宽-1和高-1
+		if b.has(20, 5) == false || b[20] != 0x2F {
+			return ErrPicCorrupt
+		}
+		bits := binary.LittleEndian.Uint32(b[21:])
+		info.Width = int(bits&0x3FFF) + 1
+		info.Height = int(bits>>14&0x3FFF) + 1
+	case "VP8X":
+		//1字节标记 + 3字节保留，之后为24位的宽-1和高-1
+		if b.has(20, 10) == false {
+			return ErrPicCorrupt
+		}
+		info.Width = int(uint32(b[24])|uint32(b[25])<<8|uint32(b[26])<<16) + 1
+		info.Height = int(uint32(b[27])|uint32(b[28])<<8|uint32(b[29])<<16) + 1
+		animated := b[20]&0x02 != 0
+		frames := 0
+		pos := 12
+		for b.has(pos, 8) {
+			size := binary.LittleEndian.Uint32(b[pos+4:])
+			if size > uint32(len(b)) {
+				break
+			}
+			chunk := string(b[pos : pos+4])
+			end := pos + 8 + int(size)
+			if chunk == "ANMF" {
+				frames++
+			}
+			if chunk == "EXIF" && b.has(pos+8, int(size)) {
+				exif := b[pos+8 : end]
+				if len(exif) >= 6 && string(exif[:6]) == "Exif\x00\x00" {
+					exif = exif[6:]
+				}
+				info.Orientation = exifOrientation(exif)
+			}
+			//块的数据长度为奇数时有1字节填充
+			pos = end + int(size&1)
+		}
+		if animated && frames > 0 {
+			info.Frames = frames
+		}
+	default:
+		return ErrPicCorrupt
+	}
+	return nil
 }
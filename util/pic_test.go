@@ -0,0 +1,163 @@
+package util
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+//picCorpus testdata/pic中的样本文件，用作表驱动测试和模糊测试的种子
+func picCorpus(t testing.TB) map[string][]byte {
+	files, err := filepath.Glob(filepath.Join("testdata", "pic", "*"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no pic corpus: %v", err)
+	}
+	corpus := map[string][]byte{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corpus[filepath.Base(file)] = data
+	}
+	return corpus
+}
+
+func TestDecodePicInfo(t *testing.T) {
+	type want struct {
+		format      string
+		width       int
+		height      int
+		orientation int
+		frames      int
+		err         error
+	}
+	cases := map[string]want{
+		"jpg_basic.jpg":             {"jpg", 640, 480, 0, 1, nil},
+		"jpg_fill.jpg":              {"jpg", 320, 200, 0, 1, nil},
+		"jpg_rst.jpg":               {"jpg", 8, 8, 0, 1, nil},
+		"jpg_dht_before_sof.jpg":    {"jpg", 17, 9, 0, 1, nil},
+		"jpg_sof_truncated.jpg":     {err: ErrPicCorrupt},
+		"jpg_sof_short.jpg":         {err: ErrPicCorrupt},
+		"jpg_len0.jpg":              {err: ErrPicCorrupt},
+		"jpg_len1.jpg":              {err: ErrPicCorrupt},
+		"jpg_len_overflow.jpg":      {err: ErrPicCorrupt},
+		"jpg_no_sof.jpg":            {err: ErrPicCorrupt},
+		"jpg_exif_o1.jpg":           {"jpg", 100, 50, 1, 1, nil},
+		"jpg_exif_o5.jpg":           {"jpg", 50, 100, 5, 1, nil},
+		"jpg_exif_o6.jpg":           {"jpg", 50, 100, 6, 1, nil},
+		"jpg_exif_o7.jpg":           {"jpg", 50, 100, 7, 1, nil},
+		"jpg_exif_o8.jpg":           {"jpg", 50, 100, 8, 1, nil},
+		"jpg_exif_o6_mm.jpg":        {"jpg", 50, 100, 6, 1, nil},
+		"jpg_exif_bad_ifd.jpg":      {"jpg", 100, 50, 0, 1, nil},
+		"png_basic.png":             {"png", 300, 150, 0, 1, nil},
+		"png_apng.png":              {"png", 64, 32, 0, 5, nil},
+		"png_truncated.png":         {err: ErrPicCorrupt},
+		"png_zero.png":              {err: ErrPicCorrupt},
+		"gif_static.gif":            {"gif", 40, 30, 0, 1, nil},
+		"gif_anim.gif":              {"gif", 40, 30, 0, 3, nil},
+		"gif_no_trailer.gif":        {"gif", 40, 30, 0, 2, nil},
+		"gif_truncated.gif":         {err: ErrPicCorrupt},
+		"gif_no_frames.gif":         {err: ErrPicCorrupt},
+		"bmp_bottomup.bmp":          {"bmp", 4, 3, 0, 1, nil},
+		"bmp_topdown.bmp":           {"bmp", 4, 3, 0, 1, nil},
+		"bmp_min_height.bmp":        {err: ErrPicCorrupt},
+		"bmp_core.bmp":              {"bmp", 7, 5, 0, 1, nil},
+		"bmp_v5.bmp":                {"bmp", 9, 2, 0, 1, nil},
+		"bmp_truncated.bmp":         {err: ErrPicCorrupt},
+		"webp_vp8.webp":             {"webp", 120, 90, 0, 1, nil},
+		"webp_vp8_bad_start.webp":   {err: ErrPicCorrupt},
+		"webp_vp8l.webp":            {"webp", 200, 100, 0, 1, nil},
+		"webp_vp8l_bad_sig.webp":    {err: ErrPicCorrupt},
+		"webp_vp8x.webp":            {"webp", 1000, 700, 0, 1, nil},
+		"webp_vp8x_anim_odd.webp":   {"webp", 40, 50, 6, 3, nil},
+		"webp_vp8x_huge_chunk.webp": {"webp", 50, 40, 0, 1, nil},
+		"webp_truncated.webp":       {err: ErrPicCorrupt},
+		"unknown.bin":               {err: ErrPicFormat},
+		"heic.heic":                 {err: ErrPicFormat},
+	}
+	//SOF1、SOF3、SOF5-SOF15（不包括JPG(C8)、DAC(CC)）
+	for _, n := range []int{1, 3, 5, 6, 7, 9, 10, 11, 13, 14, 15} {
+		cases["jpg_sof"+strconv.Itoa(n)+".jpg"] = want{"jpg", 100 + n, 50 + n, 0, 1, nil}
+	}
+
+	corpus := picCorpus(t)
+	for name, c := range cases {
+		data, ok := corpus[name]
+		if ok == false {
+			t.Errorf("%s: missing from testdata/pic", name)
+			continue
+		}
+		info, err := DecodePicInfo(data)
+		if c.err != nil {
+			if err != c.err {
+				t.Errorf("%s: err = %v, want %v", name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected err %v", name, err)
+			continue
+		}
+		got := want{info.Format, info.Width, info.Height, info.Orientation, info.Frames, nil}
+		if got != c {
+			t.Errorf("%s: got %+v, want %+v", name, got, c)
+		}
+	}
+	for name := range corpus {
+		if _, ok := cases[name]; ok == false {
+			t.Errorf("%s: no expected result", name)
+		}
+	}
+}
+
+func TestSniffPicFormat(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"\xff\xd8":                 "",
+		"\xff\xd8\xff":             "jpg",
+		"GIF87a":                   "gif",
+		"BM":                       "bmp",
+		"\x00\x00\x00\x1cftypavif": "avif",
+		"\x00\x00\x00\x1cftypmp42": "",
+	}
+	for data, want := range cases {
+		if got := SniffPicFormat([]byte(data)); got != want {
+			t.Errorf("SniffPicFormat(%q) = %q, want %q", data, got, want)
+		}
+	}
+}
+
+//FuzzDecodePicInfo 任意输入都不能panic或死循环，成功时宽高必须为正数
+func FuzzDecodePicInfo(f *testing.F) {
+	for _, data := range picCorpus(f) {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		type result struct {
+			info *PicInfo
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			info, err := DecodePicInfo(data)
+			done <- result{info, err}
+		}()
+		select {
+		case res := <-done:
+			if res.err != nil {
+				if res.info != nil {
+					t.Fatalf("info %+v returned with err %v", res.info, res.err)
+				}
+				return
+			}
+			if res.info == nil || res.info.Width <= 0 || res.info.Height <= 0 || res.info.Frames <= 0 {
+				t.Fatalf("invalid info %+v", res.info)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("DecodePicInfo did not return within 1s for %d bytes", len(data))
+		}
+	})
+}
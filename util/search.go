@@ -0,0 +1,83 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+//SearchTerms 全文搜索的分词，用于生成skill表的terms字段，配合postgres的to_tsvector('simple', terms)使用
+//postgres默认的分词无法处理中文，这里采用二元切分：中日韩文字按单字+二元(bigram)切分，其它文字按单词切分并转为小写
+//例如："Go语言编程" -> "go 语 言 编 程 语言 言编 编程"
+func SearchTerms(texts ...string) string {
+	terms := []string{}
+	for _, text := range texts {
+		terms = append(terms, splitTerms(text, true)...)
+	}
+	return strings.Join(terms, " ")
+}
+
+//SearchQuery 搜索关键字的分词，配合postgres的plainto_tsquery('simple', query)使用
+//中日韩文字只使用二元切分（单个字时使用单字），并去除重复的词
+func SearchQuery(text string) string {
+	terms := []string{}
+	exist := map[string]bool{}
+	for _, term := range splitTerms(text, false) {
+		if exist[term] {
+			continue
+		}
+		exist[term] = true
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+//isCJK 是否是中日韩文字
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+//splitTerms 切分单词，withUnigram为true时，中日韩文字会同时生成单字
+func splitTerms(text string, withUnigram bool) []string {
+	terms := []string{}
+	word := []rune{}
+	cjk := []rune{}
+
+	var flushWord = func() {
+		if len(word) > 0 {
+			terms = append(terms, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	var flushCJK = func() {
+		if len(cjk) == 1 {
+			terms = append(terms, string(cjk))
+		} else if len(cjk) > 1 {
+			if withUnigram {
+				for _, r := range cjk {
+					terms = append(terms, string(r))
+				}
+			}
+			for i := 0; i < len(cjk)-1; i++ {
+				terms = append(terms, string(cjk[i:i+2]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+	return terms
+}
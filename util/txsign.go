@@ -0,0 +1,55 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+//TxSignKind 签名内容的类型
+const (
+	TxSignPay     = "pay"     //转账，付款方签名
+	TxSignReq     = "req"     //兑现请求，持有者签名
+	TxSignRepay   = "repay"   //接受兑现请求，发行者签名
+	TxSignVoucher = "voucher" //代金券，创建者签名
+	TxSignGift    = "gift"    //兑换码批次，发行者签名
+	TxSignKey     = "key"     //登记公钥，证明持有私钥
+	//TxSignVersion 签名内容的版本，修改字段时增加版本号
+	TxSignVersion = 1
+)
+
+//TxMessage 交易签名的规范编码，客户端与服务器须逐字节相同：首行为"niaobi:类型:版本"，之后的字段见CanonicalMessage
+func TxMessage(kind string, fields ...string) []byte {
+	return CanonicalMessage(PayURIScheme+":"+kind+":"+strconv.Itoa(TxSignVersion), fields...)
+}
+
+//CanonicalMessage 规范编码：首行为header，之后每行一个字段"名称=值"，字段顺序固定，行尾为\n（最后一行也有）
+//值中的\和换行分别写为\\和\n。fields为名称和值交替排列
+func CanonicalMessage(header string, fields ...string) []byte {
+	var b strings.Builder
+	b.WriteString(header)
+	b.WriteByte('\n')
+	for i := 0; i+1 < len(fields); i += 2 {
+		b.WriteString(fields[i])
+		b.WriteByte('=')
+		b.WriteString(txSignEscaper.Replace(fields[i+1]))
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+var txSignEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+
+//VerifyTxSig 使用ed25519公钥验证签名，公钥和签名均为hex编码
+func VerifyTxSig(pubKey string, sig string, msg []byte) bool {
+	key, err := hex.DecodeString(pubKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	s, err := hex.DecodeString(sig)
+	if err != nil || len(s) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), msg, s)
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalMessage(t *testing.T) {
+	got := string(CanonicalMessage("niaobi:test:1", "a", "plain", "memo", "x\\y\nz<b>&\"</b>\r\t", "empty", ""))
+	want := "niaobi:test:1\n" +
+		"a=plain\n" +
+		"memo=x\\\\y\\nz<b>&\"</b>\r\t\n" +
+		"empty=\n"
+	if got != want {
+		t.Errorf("CanonicalMessage:\n got %q\nwant %q", got, want)
+	}
+	//换行被转义，值中不能伪造出新的字段
+	forged := string(CanonicalMessage("h", "memo", "x\nts=1"))
+	if strings.Count(forged, "\n") != 2 {
+		t.Errorf("memo with a newline produced extra lines: %q", forged)
+	}
+	//反斜杠被转义，"\\n"与换行的编码不同
+	if string(CanonicalMessage("h", "m", "\\n")) == string(CanonicalMessage("h", "m", "\n")) {
+		t.Error("backslash-n and newline encode the same")
+	}
+	//奇数个字段时忽略最后一个名称
+	if got := string(CanonicalMessage("h", "a", "1", "b")); got != "h\na=1\n" {
+		t.Errorf("odd fields = %q", got)
+	}
+	if got := string(TxMessage(TxSignPay, "a", "1")); got != "niaobi:pay:1\na=1\n" {
+		t.Errorf("TxMessage = %q", got)
+	}
+}
+
+//RFC 8032 7.1 TEST 1
+func TestVerifyTxSigRFC8032(t *testing.T) {
+	seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	pub := "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	sig := "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+
+	key := ed25519.NewKeyFromSeed(seed)
+	if got := hex.EncodeToString(key.Public().(ed25519.PublicKey)); got != pub {
+		t.Fatalf("public key = %s", got)
+	}
+	if got := hex.EncodeToString(ed25519.Sign(key, nil)); got != sig {
+		t.Fatalf("signature = %s", got)
+	}
+	if VerifyTxSig(pub, sig, []byte{}) == false {
+		t.Error("RFC 8032 vector does not verify")
+	}
+
+	cases := map[string][3]string{
+		"message changed":   {pub, sig, "x"},
+		"signature changed": {pub, "f" + sig[1:], ""},
+		"uppercase hex":     {strings.ToUpper(pub), sig, ""},
+		"short key":         {pub[:62], sig, ""},
+		"short signature":   {pub, sig[:126], ""},
+		"not hex":           {pub, "zz" + sig[2:], ""},
+		"empty":             {"", "", ""},
+	}
+	for name, c := range cases {
+		valid := VerifyTxSig(c[0], c[1], []byte(c[2]))
+		//hex解码不区分大小写，大写的公钥同样有效
+		if valid != (name == "uppercase hex") {
+			t.Errorf("%s: valid = %v", name, valid)
+		}
+	}
+}